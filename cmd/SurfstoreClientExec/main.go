@@ -7,14 +7,24 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/user"
 	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/grpc/status"
 )
 
 // Arguments
 const ARG_COUNT int = 2
 
+// Arguments of the commands on the history of a file, command included
+var COMMAND_ARG_COUNTS = map[string]int{"history": 2, "restore": 3, "download": 4}
+
 // Usage strings
-const USAGE_STRING = "./run-client.sh -d -f config_file.txt baseDir blockSize"
+const USAGE_STRING = "./run-client.sh -d -f config_file.txt -compress codec [-key-file key_file | -passphrase-file passphrase_file] [-convergent] [-encrypt-names] [-watch] [-poll interval] [-author name] baseDir blockSize"
+const COMMAND_USAGE_STRING = "./run-client.sh -f config_file.txt [encryption flags] [-author name] (history file | restore file version | download file version dest)"
 
 const DEBUG_NAME = "d"
 const DEBUG_USAGE = "Output log statements"
@@ -22,47 +32,129 @@ const DEBUG_USAGE = "Output log statements"
 const CONFIG_NAME = "f config_file.txt"
 const CONFIG_USAGE = "Path to config file that specifies addresses for all Raft nodes"
 
+const COMPRESS_NAME = "compress codec"
+const COMPRESS_USAGE = "Send blocks compressed with codec (none, gzip) to the block stores that accept it"
+
+const KEY_FILE_NAME = "key-file key_file"
+const KEY_FILE_USAGE = "Encrypt blocks with the 32 byte key in key_file, raw or in hex"
+
+const PASSPHRASE_FILE_NAME = "passphrase-file passphrase_file"
+const PASSPHRASE_FILE_USAGE = "Encrypt blocks with a key derived from the passphrase in passphrase_file"
+
+const CONVERGENT_NAME = "convergent"
+const CONVERGENT_USAGE = "Derive the key of each block from its content, so clients with other keys share the blocks"
+
+const ENCRYPT_NAMES_NAME = "encrypt-names"
+const ENCRYPT_NAMES_USAGE = "Encrypt file names on the metastore too"
+
+const WATCH_NAME = "watch"
+const WATCH_USAGE = "Keep running and sync whenever files in baseDir change"
+
+const POLL_NAME = "poll interval"
+const POLL_USAGE = "How often a watching client pulls remote changes"
+
+const AUTHOR_NAME = "author name"
+const AUTHOR_USAGE = "Who the versions this client makes are by in the file history (default user@host)"
+
 const BASEDIR_NAME = "baseDir"
 const BASEDIR_USAGE = "Base directory of the client"
 
 const BLOCK_NAME = "blockSize"
 const BLOCK_USAGE = "Size of the blocks used to fragment files"
 
+const HISTORY_USAGE = "List the kept versions of file, file is named relative to baseDir"
+const RESTORE_USAGE = "Make a kept version of file its latest, the next sync gets it"
+const DOWNLOAD_USAGE = "Write a kept version of file to dest"
+
 // Exit codes
+const EX_FAILURE int = 1
 const EX_USAGE int = 64
 
+// Time of the versions in the history
+const HISTORY_TIME_FORMAT = "2006-01-02 15:04:05"
+
 func main() {
 	// Custom flag Usage message
 	flag.Usage = func() {
 		w := flag.CommandLine.Output()
 		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
+		fmt.Fprintf(w, "   or %s:\n", COMMAND_USAGE_STRING)
 		fmt.Fprintf(w, "  -%s: %v\n", DEBUG_NAME, DEBUG_USAGE)
 		fmt.Fprintf(w, "  -%s: %v\n", CONFIG_NAME, CONFIG_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", COMPRESS_NAME, COMPRESS_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", KEY_FILE_NAME, KEY_FILE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", PASSPHRASE_FILE_NAME, PASSPHRASE_FILE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CONVERGENT_NAME, CONVERGENT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", ENCRYPT_NAMES_NAME, ENCRYPT_NAMES_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", WATCH_NAME, WATCH_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", POLL_NAME, POLL_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", AUTHOR_NAME, AUTHOR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BASEDIR_NAME, BASEDIR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BLOCK_NAME, BLOCK_USAGE)
+		fmt.Fprintf(w, "  history: %v\n", HISTORY_USAGE)
+		fmt.Fprintf(w, "  restore: %v\n", RESTORE_USAGE)
+		fmt.Fprintf(w, "  download: %v\n", DOWNLOAD_USAGE)
 	}
 
 	// Parse command-line arguments and flags
 	debug := flag.Bool("d", false, DEBUG_USAGE)
 	configFile := flag.String("f", "", "(required) Config file")
+	compressionName := flag.String("compress", "none", COMPRESS_USAGE)
+	keyFile := flag.String("key-file", "", KEY_FILE_USAGE)
+	passphraseFile := flag.String("passphrase-file", "", PASSPHRASE_FILE_USAGE)
+	convergent := flag.Bool("convergent", false, CONVERGENT_USAGE)
+	encryptNames := flag.Bool("encrypt-names", false, ENCRYPT_NAMES_USAGE)
+	watch := flag.Bool("watch", false, WATCH_USAGE)
+	pollInterval := flag.Duration("poll", surfstore.DEFAULT_WATCH_POLL_INTERVAL, POLL_USAGE)
+	author := flag.String("author", "", AUTHOR_USAGE)
 	flag.Parse()
 
 	// Use tail arguments to hold non-flag arguments
 	args := flag.Args()
 
-	if len(args) != ARG_COUNT {
+	command := ""
+	if len(args) > 0 && len(args) == COMMAND_ARG_COUNTS[args[0]] {
+		command = args[0]
+	} else if len(args) != ARG_COUNT {
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
 	addrs := surfstore.LoadRaftConfigFile(*configFile)
 
-	baseDir := args[0]
-	blockSize, err := strconv.Atoi(args[1])
+	baseDir := ""
+	blockSize := 0
+	if command == "" {
+		var err error
+		baseDir = args[0]
+		blockSize, err = strconv.Atoi(args[1])
+		if err != nil {
+			flag.Usage()
+			os.Exit(EX_USAGE)
+		}
+	}
+	compression, err := surfstore.ParseCompression(*compressionName)
 	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
 
+	if *pollInterval <= 0 {
+		fmt.Fprintln(flag.CommandLine.Output(), "the poll interval has to be positive")
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	encryption, err := loadEncryption(*keyFile, *passphraseFile, *convergent, *encryptNames)
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	if *author == "" {
+		*author = defaultAuthor()
+	}
+
 	log.Println("Client syncing with ", addrs, baseDir, blockSize)
 
 	// Disable log outputs if debug flag is missing
@@ -72,5 +164,120 @@ func main() {
 	}
 
 	rpcClient := surfstore.NewSurfstoreRPCClient(addrs, baseDir, blockSize)
+	rpcClient.Compression = compression
+	rpcClient.Encryption = encryption
+	rpcClient.Author = *author
+	if command != "" {
+		if err := runCommand(rpcClient, args); err != nil {
+			fmt.Fprintln(os.Stderr, status.Convert(err).Message())
+			os.Exit(EX_FAILURE)
+		}
+		return
+	}
+	if *watch {
+		log.Fatal(surfstore.WatchSync(&rpcClient, *pollInterval))
+	}
 	surfstore.ClientSync(rpcClient)
 }
+
+// loadEncryption reads the key from keyFile or derives it from the
+// passphrase in passphraseFile, nil if neither is given
+func loadEncryption(keyFile, passphraseFile string, convergent, encryptNames bool) (*surfstore.BlockEncryption, error) {
+	var key []byte
+	switch {
+	case keyFile != "" && passphraseFile != "":
+		return nil, fmt.Errorf("give either a key file or a passphrase file")
+	case keyFile != "":
+		var err error
+		if key, err = surfstore.ReadKeyFile(keyFile); err != nil {
+			return nil, err
+		}
+	case passphraseFile != "":
+		passphrase, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		key = surfstore.KeyFromPassphrase(strings.TrimRight(string(passphrase), "\r\n"))
+	default:
+		if convergent || encryptNames {
+			return nil, fmt.Errorf("encryption needs a key file or a passphrase file")
+		}
+		return nil, nil
+	}
+	return surfstore.NewBlockEncryption(key, convergent, encryptNames)
+}
+
+// runCommand runs one of the commands on the history of a file
+func runCommand(client surfstore.RPCClient, args []string) error {
+	filename := args[1]
+	switch args[0] {
+	case "history":
+		var versions []*surfstore.FileVersion
+		if err := client.GetFileHistory(filename, &versions); err != nil {
+			return err
+		}
+		if len(versions) == 0 {
+			return fmt.Errorf("no versions of %s are kept", filename)
+		}
+		printHistory(versions)
+		return nil
+	case "restore":
+		version, err := strconv.ParseInt(args[2], 10, 32)
+		if err != nil {
+			return fmt.Errorf("%q is not a version", args[2])
+		}
+		var latestVersion int32
+		if err := client.RestoreFileVersion(filename, int32(version), &latestVersion); err != nil {
+			return err
+		}
+		if latestVersion == -1 {
+			return fmt.Errorf("could not restore version %d of %s", version, filename)
+		}
+		fmt.Printf("Restored version %d of %s as version %d\n", version, filename, latestVersion)
+		return nil
+	case "download":
+		version, err := strconv.ParseInt(args[2], 10, 32)
+		if err != nil {
+			return fmt.Errorf("%q is not a version", args[2])
+		}
+		return surfstore.DownloadFileVersion(client, filename, int32(version), args[3])
+	}
+	return fmt.Errorf("unknown command %s", args[0])
+}
+
+// printHistory lists the versions, the latest first
+func printHistory(versions []*surfstore.FileVersion) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tTIME\tAUTHOR\tBLOCKS")
+	for i := len(versions) - 1; i >= 0; i-- {
+		fileMetaData := versions[i].GetFileMetaData()
+		at := "unknown"
+		if versions[i].GetTimestamp() != 0 {
+			at = time.UnixMilli(versions[i].GetTimestamp()).Format(HISTORY_TIME_FORMAT)
+		}
+		author := fileMetaData.GetAuthor()
+		if author == "" {
+			author = "unknown"
+		}
+		blocks := strconv.Itoa(len(fileMetaData.GetBlockHashList()))
+		if hashList := fileMetaData.GetBlockHashList(); len(hashList) == 1 && hashList[0] == "0" {
+			blocks = "deleted"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", fileMetaData.GetVersion(), at, author, blocks)
+	}
+	w.Flush()
+}
+
+// defaultAuthor names the versions this client makes after the user and
+// the host
+func defaultAuthor() string {
+	name := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+	return name + "@" + host
+}
@@ -5,16 +5,32 @@ import (
 	"flag"
 	"io/ioutil"
 	"log"
+	"strings"
 )
 
 func main() {
 	serverId := flag.Int64("i", -1, "(required) Server ID")
 	configFile := flag.String("f", "", "(required) Config file, absolute path")
-	blockStoreAddr := flag.String("b", "", "(required) BlockStore address")
+	blockStoreAddrs := flag.String("b", "", "(required) BlockStore addresses, comma separated")
+	replicas := flag.Int("n", 0, "Number of BlockStores each block is stored on (0 = all)")
+	writeQuorum := flag.Int("w", 0, "Number of BlockStores a block must be written to (0 = majority of -n)")
 	debug := flag.Bool("d", false, "Output log statements")
+	heartbeatInterval := flag.Duration("heartbeat", surfstore.DEFAULT_HEARTBEAT_INTERVAL, "Interval between the leader's AppendEntries rounds")
+	dataDir := flag.String("data", "", "Directory for the write-ahead log (raft state is not persisted if empty)")
+	snapshotEntries := flag.Int64("snapshot-entries", surfstore.DEFAULT_SNAPSHOT_ENTRIES, "Compact the log after this many applied entries (0 = no limit)")
+	snapshotBytes := flag.Int64("snapshot-bytes", surfstore.DEFAULT_SNAPSHOT_BYTES, "Compact the log after this many bytes of applied entries (0 = no limit)")
+	manualElection := flag.Bool("m", false, "Never start elections, the leader is only changed with SetLeader (for testing)")
+	preVote := flag.Bool("prevote", true, "Make sure an election can be won before starting it")
+	checkQuorum := flag.Bool("check-quorum", true, "Step down as leader when a majority stops answering")
+	leaseReads := flag.Bool("lease", false, "Serve reads under a leader lease instead of confirming leadership with a heartbeat round")
+	clockDrift := flag.Float64("clock-drift", surfstore.DEFAULT_CLOCK_DRIFT_BOUND, "Bound on the relative clock drift between servers, shortens leases")
+	join := flag.Bool("join", false, "Start outside the cluster and wait to be added with AddServer")
+	gcInterval := flag.Duration("gc-interval", surfstore.DEFAULT_GC_INTERVAL, "Interval between collections of unreferenced blocks (0 = only on CollectGarbage)")
+	gcGracePeriod := flag.Duration("gc-grace", surfstore.DEFAULT_GC_GRACE_PERIOD, "Blocks used this recently are never collected")
+	historyLength := flag.Int("history", surfstore.DEFAULT_HISTORY_LENGTH, "Number of versions of each file to keep, the latest included (the same on every server)")
 	flag.Parse()
 
-	addrs := surfstore.LoadRaftConfigFile(*configFile)
+	cluster := surfstore.LoadRaftClusterConfig(*configFile)
 
 	// Disable log outputs if debug flag is missing
 	if !(*debug) {
@@ -22,13 +38,34 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	log.Fatal(startServer(*serverId, addrs, *blockStoreAddr))
+	config := surfstore.DefaultRaftConfig()
+	config.HeartbeatInterval = *heartbeatInterval
+	config.DataDir = *dataDir
+	config.SnapshotEntries = *snapshotEntries
+	config.SnapshotBytes = *snapshotBytes
+	config.ManualElection = *manualElection
+	config.PreVote = *preVote
+	config.CheckQuorum = *checkQuorum
+	config.LeaseReads = *leaseReads
+	config.ClockDriftBound = *clockDrift
+	config.Join = *join
+	config.GCInterval = *gcInterval
+	config.GCGracePeriod = *gcGracePeriod
+	config.HistoryLength = *historyLength
+
+	addrs := strings.Split(*blockStoreAddrs, surfstore.CONFIG_DELIMITER)
+	blockStores, err := surfstore.NewBlockStoreMap(addrs, int32(*replicas), int32(*writeQuorum))
+	if err != nil {
+		log.Fatal("Invalid BlockStores: ", err)
+	}
+
+	log.Fatal(startServer(*serverId, cluster, blockStores, config))
 }
 
-func startServer(id int64, addrs []string, blockStoreAddr string) error {
-	raftServer, err := surfstore.NewRaftServer(id, addrs, blockStoreAddr)
+func startServer(id int64, cluster *surfstore.ClusterConfig, blockStores *surfstore.BlockStoreMap, config surfstore.RaftConfig) error {
+	raftServer, err := surfstore.NewRaftServer(id, cluster, blockStores, config)
 	if err != nil {
-		log.Fatal("Error creating servers")
+		log.Fatal("Error creating servers: ", err)
 	}
 
 	return surfstore.ServeRaftServer(raftServer)
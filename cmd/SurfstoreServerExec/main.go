@@ -15,7 +15,7 @@ import (
 )
 
 // Usage String
-const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -l -d (blockStoreAddr*)"
+const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -l -d -storage <memory|disk> -data <dir> (blockStoreAddr*)"
 
 // Set of valid services
 var SERVICE_TYPES = map[string]bool{"meta": true, "block": true, "both": true}
@@ -31,7 +31,7 @@ func main() {
 		flag.VisitAll(func(f *flag.Flag) {
 			fmt.Fprintf(w, "  -%s: %v\n", f.Name, f.Usage)
 		})
-		fmt.Fprintf(w, "  (blockStoreAddr*): BlockStore Address (include self if service type is both)\n")
+		fmt.Fprintf(w, "  (blockStoreAddr*): BlockStore Addresses, blocks are spread over them by consistent hashing (include self if service type is both)\n")
 	}
 
 	// Parse command-line argument flags
@@ -39,13 +39,21 @@ func main() {
 	port := flag.Int("p", 8080, "(default = 8080) Port to accept connections")
 	localOnly := flag.Bool("l", false, "Only listen on localhost")
 	debug := flag.Bool("d", false, "Output log statements")
+	replicas := flag.Int("n", 0, "Number of BlockStores each block is stored on (0 = all)")
+	writeQuorum := flag.Int("w", 0, "Number of BlockStores a block must be written to (0 = majority of -n)")
+	storageEngine := flag.String("storage", surfstore.BLOCK_STORAGE_MEMORY, "Where the BlockStore keeps its blocks: memory, disk")
+	dataDir := flag.String("data", "", "Directory for the blocks of the disk storage")
+	maxBlockSize := flag.Int("max-block", int(surfstore.DEFAULT_MAX_BLOCK_SIZE), "Largest block the BlockStore accepts, in bytes")
+	historyLength := flag.Int("history", surfstore.DEFAULT_HISTORY_LENGTH, "Number of versions of each file the MetaStore keeps, the latest included")
 	flag.Parse()
 
-	// Use tail arguments to hold BlockStore address
-	args := flag.Args()
-	blockStoreAddr := ""
-	if len(args) == 1 {
-		blockStoreAddr = args[0]
+	// Use tail arguments to hold BlockStore addresses
+	blockStoreAddrs := flag.Args()
+	blockStores, err := surfstore.NewBlockStoreMap(blockStoreAddrs, int32(*replicas), int32(*writeQuorum))
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(EX_USAGE)
 	}
 
 	// Valid service type argument
@@ -67,24 +75,45 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	log.Fatal(startServer(addr, strings.ToLower(*service), blockStoreAddr))
+	// Only block services store blocks
+	var storage surfstore.BlockStorage
+	if strings.ToLower(*service) != "meta" {
+		storage, err = surfstore.NewBlockStorage(strings.ToLower(*storageEngine), *dataDir)
+		if err != nil {
+			fmt.Fprintln(flag.CommandLine.Output(), err)
+			flag.Usage()
+			os.Exit(EX_USAGE)
+		}
+	}
+
+	if *historyLength < 1 {
+		fmt.Fprintln(flag.CommandLine.Output(), "the history has to keep at least the latest version of a file")
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	log.Fatal(startServer(addr, strings.ToLower(*service), blockStores, storage, int32(*maxBlockSize), *historyLength))
 }
 
-func startServer(hostAddr string, serviceType string, blockStoreAddr string) error {
+func startServer(hostAddr string, serviceType string, blockStores *surfstore.BlockStoreMap, storage surfstore.BlockStorage, maxBlockSize int32, historyLength int) error {
 	//panic("todo")
 	// create a new RPC server
 	grpc_server := grpc.NewServer()
 	// register rpc services
 	if serviceType == "both" {
-		metaStore := surfstore.NewMetaStore(blockStoreAddr)
+		metaStore := surfstore.NewShardedMetaStore(blockStores)
+		metaStore.HistoryLength = historyLength
 		surfstore.RegisterMetaStoreServer(grpc_server, metaStore)
-		blockStore := surfstore.NewBlockStore()
+		blockStore := surfstore.NewBlockStoreWithStorage(storage)
+		blockStore.MaxBlockSize = maxBlockSize
 		surfstore.RegisterBlockStoreServer(grpc_server, blockStore)
 	} else if serviceType == "meta" {
-		metaStore := surfstore.NewMetaStore(blockStoreAddr)
+		metaStore := surfstore.NewShardedMetaStore(blockStores)
+		metaStore.HistoryLength = historyLength
 		surfstore.RegisterMetaStoreServer(grpc_server, metaStore)
 	} else {
-		blockStore := surfstore.NewBlockStore()
+		blockStore := surfstore.NewBlockStoreWithStorage(storage)
+		blockStore.MaxBlockSize = maxBlockSize
 		surfstore.RegisterBlockStoreServer(grpc_server, blockStore)
 	}
 	// listening socket
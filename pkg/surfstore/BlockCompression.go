@@ -0,0 +1,111 @@
+package surfstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+/*
+	Block compression
+
+	A block can travel and be stored compressed. Its hash and blockSize
+	always describe the uncompressed data, so the same content has the same
+	hash whichever codec a client picked and HasBlocks finds it either way.
+
+	Block stores keep blocks in the form they receive them and only
+	decompress to check the hash of a new block. Clients ask a block store
+	which codecs it accepts before sending it compressed blocks and can read
+	blocks in any codec.
+*/
+
+// ParseCompression returns the codec called name, e.g. "gzip"
+func ParseCompression(name string) (Compression, error) {
+	compression, ok := Compression_value[strings.ToUpper(name)]
+	if !ok {
+		return Compression_NONE, fmt.Errorf("unknown compression %q", name)
+	}
+	return Compression(compression), nil
+}
+
+// CompressBlock returns block compressed with compression, or block itself
+// if that doesn't make it smaller
+func CompressBlock(block *Block, compression Compression) (*Block, error) {
+	if compression == Compression_NONE || block.Compression != Compression_NONE {
+		return block, nil
+	}
+
+	var buf bytes.Buffer
+	switch compression {
+	case Compression_GZIP:
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(block.BlockData); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression %v", compression)
+	}
+
+	if buf.Len() >= len(block.BlockData) {
+		return block, nil
+	}
+	return &Block{
+		BlockData:   buf.Bytes(),
+		BlockSize:   block.BlockSize,
+		Compression: compression,
+	}, nil
+}
+
+// DecompressBlock returns the uncompressed block. The data must decompress
+// to exactly BlockSize bytes, so a forged block can't make us inflate more
+// than that.
+func DecompressBlock(block *Block) (*Block, error) {
+	if block.Compression == Compression_NONE {
+		return block, nil
+	}
+
+	var r io.Reader
+	switch block.Compression {
+	case Compression_GZIP:
+		gz, err := gzip.NewReader(bytes.NewReader(block.BlockData))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	default:
+		return nil, fmt.Errorf("unknown compression %v", block.Compression)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(block.BlockSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != int(block.BlockSize) {
+		return nil, fmt.Errorf("block decompresses to more or less than its %d bytes", block.BlockSize)
+	}
+	return &Block{BlockData: data, BlockSize: block.BlockSize}, nil
+}
+
+// uncompressedSize returns the size data had before it was compressed with
+// compression, gzip records it in the last four bytes of its stream
+func uncompressedSize(data []byte, compression Compression) (int32, error) {
+	switch compression {
+	case Compression_NONE:
+		return int32(len(data)), nil
+	case Compression_GZIP:
+		if len(data) < 4 {
+			return 0, fmt.Errorf("gzip stream of %d bytes is too short", len(data))
+		}
+		return int32(binary.LittleEndian.Uint32(data[len(data)-4:])), nil
+	default:
+		return 0, fmt.Errorf("unknown compression %v", compression)
+	}
+}
@@ -0,0 +1,398 @@
+package surfstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+)
+
+/*
+	Block encryption
+
+	A client can encrypt its blocks with AES-256-GCM before they leave it, so
+	block stores only ever see ciphertext. The hash of an encrypted block is
+	the hash of its ciphertext and block stores check and keep it like any
+	other block. The encryption is deterministic, the same content always
+	encrypts to the same block, so a client finds the hashes of its files
+	without asking anyone and HasBlocks recognises blocks uploaded before.
+
+	By default the nonce of a block is derived from its content with a key
+	of the client (a synthetic IV), so only clients sharing the key produce
+	the same block:
+
+		0x01 | codec | nonce (12 bytes) | AES-GCM(key, nonce, data)
+
+	With convergent encryption the key of a block is derived from the hash
+	of its content instead. Every client produces the same block for the
+	same content, whatever its own key, and clients share blocks. Each such
+	key encrypts a single plaintext, so the nonce is zero. Readers can't get
+	the key from the block, the FileMetaData of a file carries the keys of
+	its blocks encrypted with the client key:
+
+		0x02 | codec | AES-GCM(SHA-256(label | data), 0, data)
+
+	The price of sharing is that anyone who has some content can tell
+	whether a block store holds it.
+
+	codec is the compression of data, compressed before it is encrypted
+	since ciphertext doesn't compress. The header is authenticated along
+	with the data.
+
+	File names on the metastore can be encrypted too, deterministically so a
+	file keeps its name from one sync to the next.
+*/
+
+const (
+	sealedWithClientKey  byte = 1
+	sealedWithConvergent byte = 2
+)
+
+// format and codec byte in front of every encrypted block
+const sealedHeaderSize int = 2
+
+// labels that keep the keys derived from the client key apart
+const (
+	blockKeyLabel      = "surfstore block key"
+	blockNonceLabel    = "surfstore block nonce"
+	convergentKeyLabel = "surfstore convergent key"
+	wrapKeyLabel       = "surfstore block key wrapping"
+	nameKeyLabel       = "surfstore name key"
+	nameNonceLabel     = "surfstore name nonce"
+)
+
+type BlockEncryption struct {
+	// derive the key of each block from its content
+	Convergent bool
+	// encrypt file names on the metastore
+	EncryptNames bool
+
+	blockKey   cipher.AEAD
+	blockNonce []byte
+	wrapKey    cipher.AEAD
+	nameKey    cipher.AEAD
+	nameNonce  []byte
+
+	mtx sync.Mutex
+	// the encrypted convergent key of every block hash we came across
+	blockKeys map[string][]byte
+}
+
+// NewBlockEncryption derives the keys blocks and names are encrypted with
+// from key, which is ENCRYPTION_KEY_SIZE bytes long
+func NewBlockEncryption(key []byte, convergent bool, encryptNames bool) (*BlockEncryption, error) {
+	if len(key) != ENCRYPTION_KEY_SIZE {
+		return nil, fmt.Errorf("encryption keys are %d bytes, got %d", ENCRYPTION_KEY_SIZE, len(key))
+	}
+	e := &BlockEncryption{
+		Convergent:   convergent,
+		EncryptNames: encryptNames,
+		blockNonce:   hmacSHA256(key, []byte(blockNonceLabel)),
+		nameNonce:    hmacSHA256(key, []byte(nameNonceLabel)),
+		blockKeys:    make(map[string][]byte),
+	}
+	var err error
+	if e.blockKey, err = newGCM(hmacSHA256(key, []byte(blockKeyLabel))); err != nil {
+		return nil, err
+	}
+	if e.wrapKey, err = newGCM(hmacSHA256(key, []byte(wrapKeyLabel))); err != nil {
+		return nil, err
+	}
+	if e.nameKey, err = newGCM(hmacSHA256(key, []byte(nameKeyLabel))); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// KeyFromPassphrase stretches passphrase into a key with PBKDF2. The salt
+// is fixed, clients that share a passphrase have to end up with one key.
+func KeyFromPassphrase(passphrase string) []byte {
+	return pbkdf2SHA256([]byte(passphrase), []byte(PASSPHRASE_SALT), PASSPHRASE_ITERATIONS, ENCRYPTION_KEY_SIZE)
+}
+
+// ReadKeyFile reads a key file, which holds the key either in hex or as raw
+// bytes
+func ReadKeyFile(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := hex.DecodeString(strings.TrimSpace(string(content))); err == nil && len(key) == ENCRYPTION_KEY_SIZE {
+		return key, nil
+	}
+	if len(content) == ENCRYPTION_KEY_SIZE {
+		return content, nil
+	}
+	return nil, fmt.Errorf("key file %s holds neither %d bytes nor their hex", path, ENCRYPTION_KEY_SIZE)
+}
+
+// SealBlock compresses data with compression, if that makes it smaller, and
+// encrypts it into the block that is sent to the block stores
+func (e *BlockEncryption) SealBlock(data []byte, compression Compression) (*Block, error) {
+	inner, err := CompressBlock(&Block{BlockData: data, BlockSize: int32(len(data))}, compression)
+	if err != nil {
+		return nil, err
+	}
+
+	var sealed []byte
+	if e.Convergent {
+		key := convergentKey(data)
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		header := []byte{sealedWithConvergent, byte(inner.Compression)}
+		nonce := make([]byte, aead.NonceSize())
+		sealed = aead.Seal(header, nonce, inner.BlockData, header)
+		if err := e.rememberKey(GetBlockHashString(sealed), key); err != nil {
+			return nil, err
+		}
+	} else {
+		header := []byte{sealedWithClientKey, byte(inner.Compression)}
+		nonce := hmacSHA256(e.blockNonce, data)[:e.blockKey.NonceSize()]
+		sealed = e.blockKey.Seal(append(header, nonce...), nonce, inner.BlockData, header)
+	}
+	return &Block{BlockData: sealed, BlockSize: int32(len(sealed))}, nil
+}
+
+// OpenBlock decrypts and decompresses the block blockHash. Convergent blocks
+// need their key from the FileMetaData of a file they belong to.
+func (e *BlockEncryption) OpenBlock(blockHash string, block *Block) ([]byte, error) {
+	sealed := block.GetBlockData()
+	if len(sealed) < sealedHeaderSize {
+		return nil, fmt.Errorf("block %s is not encrypted", blockHash)
+	}
+	header := sealed[:sealedHeaderSize]
+	codec := Compression(header[1])
+
+	var inner []byte
+	var err error
+	switch header[0] {
+	case sealedWithClientKey:
+		nonceSize := e.blockKey.NonceSize()
+		if len(sealed) < sealedHeaderSize+nonceSize {
+			return nil, fmt.Errorf("block %s is too short", blockHash)
+		}
+		nonce := sealed[sealedHeaderSize : sealedHeaderSize+nonceSize]
+		inner, err = e.blockKey.Open(nil, nonce, sealed[sealedHeaderSize+nonceSize:], header)
+	case sealedWithConvergent:
+		var key []byte
+		key, err = e.convergentKeyOf(blockHash)
+		if err != nil {
+			return nil, err
+		}
+		var aead cipher.AEAD
+		aead, err = newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		inner, err = aead.Open(nil, make([]byte, aead.NonceSize()), sealed[sealedHeaderSize:], header)
+	default:
+		return nil, fmt.Errorf("block %s is encrypted in unknown format %d", blockHash, header[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt block %s: %v", blockHash, err)
+	}
+
+	size, err := uncompressedSize(inner, codec)
+	if err != nil {
+		return nil, err
+	}
+	opened, err := DecompressBlock(&Block{BlockData: inner, BlockSize: size, Compression: codec})
+	if err != nil {
+		return nil, err
+	}
+	return opened.BlockData, nil
+}
+
+// SealFileMetaData returns fileMetaData as the metastore gets it: with its
+// name encrypted and the keys of its blocks, as asked for
+func (e *BlockEncryption) SealFileMetaData(fileMetaData *FileMetaData) (*FileMetaData, error) {
+	sealed := &FileMetaData{
+		Filename:      e.metaStoreName(fileMetaData.GetFilename()),
+		Version:       fileMetaData.GetVersion(),
+		BlockHashList: fileMetaData.GetBlockHashList(),
+		Author:        fileMetaData.GetAuthor(),
+	}
+	hashList := fileMetaData.GetBlockHashList()
+	if e.Convergent && !(len(hashList) == 1 && hashList[0] == "0") {
+		e.mtx.Lock()
+		defer e.mtx.Unlock()
+		for _, hash := range hashList {
+			key, ok := e.blockKeys[hash]
+			if !ok {
+				return nil, fmt.Errorf("no key for block %s of %s", hash, fileMetaData.GetFilename())
+			}
+			sealed.BlockKeys = append(sealed.BlockKeys, key)
+		}
+	}
+	return sealed, nil
+}
+
+// OpenFileInfoMap returns the files of fileInfoMap by their own names and
+// keeps the keys of their blocks. Files whose names we can't decrypt were
+// stored with another key and are left out.
+func (e *BlockEncryption) OpenFileInfoMap(fileInfoMap map[string]*FileMetaData) map[string]*FileMetaData {
+	opened := make(map[string]*FileMetaData)
+	for _, fileMetaData := range fileInfoMap {
+		openedMetaData, err := e.OpenFileMetaData(fileMetaData)
+		if err != nil {
+			log.Printf("Skipping file %s: %v", fileMetaData.GetFilename(), err)
+			continue
+		}
+		opened[openedMetaData.Filename] = openedMetaData
+	}
+	return opened
+}
+
+// OpenFileMetaData returns fileMetaData by its own name and keeps the keys
+// of its blocks
+func (e *BlockEncryption) OpenFileMetaData(fileMetaData *FileMetaData) (*FileMetaData, error) {
+	name := fileMetaData.GetFilename()
+	if e.EncryptNames {
+		var err error
+		if name, err = e.openName(name); err != nil {
+			return nil, err
+		}
+	}
+	hashList := fileMetaData.GetBlockHashList()
+	e.mtx.Lock()
+	for i, key := range fileMetaData.GetBlockKeys() {
+		if i >= len(hashList) {
+			break
+		}
+		if _, ok := e.blockKeys[hashList[i]]; !ok {
+			e.blockKeys[hashList[i]] = key
+		}
+	}
+	e.mtx.Unlock()
+	return &FileMetaData{
+		Filename:      name,
+		Version:       fileMetaData.GetVersion(),
+		BlockHashList: fileMetaData.GetBlockHashList(),
+		BlockKeys:     fileMetaData.GetBlockKeys(),
+		Author:        fileMetaData.GetAuthor(),
+	}, nil
+}
+
+// metaStoreName returns the name the metastore knows the file name by
+func (e *BlockEncryption) metaStoreName(name string) string {
+	if e.EncryptNames {
+		return e.sealName(name)
+	}
+	return name
+}
+
+// rememberKey keeps key, encrypted with the client key, as the key of the
+// block blockHash. A block keeps the first encrypted key it got so its
+// files don't change on the metastore from one sync to the next.
+func (e *BlockEncryption) rememberKey(blockHash string, key []byte) error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if _, ok := e.blockKeys[blockHash]; ok {
+		return nil
+	}
+	nonce := make([]byte, e.wrapKey.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	e.blockKeys[blockHash] = e.wrapKey.Seal(nonce, nonce, key, []byte(blockHash))
+	return nil
+}
+
+// convergentKeyOf decrypts the key of the convergent block blockHash and
+// makes sure it is one
+func (e *BlockEncryption) convergentKeyOf(blockHash string) ([]byte, error) {
+	e.mtx.Lock()
+	wrapped, ok := e.blockKeys[blockHash]
+	e.mtx.Unlock()
+	nonceSize := e.wrapKey.NonceSize()
+	if !ok || len(wrapped) < nonceSize {
+		return nil, fmt.Errorf("no key for block %s", blockHash)
+	}
+	key, err := e.wrapKey.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], []byte(blockHash))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt the key of block %s: %v", blockHash, err)
+	}
+	return key, nil
+}
+
+// sealName encrypts name with a nonce derived from it, so it always
+// encrypts to the same string
+func (e *BlockEncryption) sealName(name string) string {
+	nonce := hmacSHA256(e.nameNonce, []byte(name))[:e.nameKey.NonceSize()]
+	return base64.RawURLEncoding.EncodeToString(e.nameKey.Seal(nonce, nonce, []byte(name), nil))
+}
+
+func (e *BlockEncryption) openName(sealed string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(sealed)
+	nonceSize := e.nameKey.NonceSize()
+	if err != nil || len(raw) < nonceSize {
+		return "", fmt.Errorf("not an encrypted name")
+	}
+	name, err := e.nameKey.Open(nil, raw[:nonceSize], raw[nonceSize:], nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt the name: %v", err)
+	}
+	if !bytes.Equal(raw[:nonceSize], hmacSHA256(e.nameNonce, name)[:nonceSize]) {
+		return "", fmt.Errorf("the name doesn't match its nonce")
+	}
+	return string(name), nil
+}
+
+func convergentKey(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(convergentKeyLabel))
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func hmacSHA256(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2SHA256 is PBKDF2 (RFC 8018) with HMAC-SHA256 as the pseudorandom
+// function
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := make([]byte, 0, keyLen+prf.Size())
+	var counter [4]byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], block)
+		prf.Write(counter[:])
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,372 @@
+package surfstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Block storage engines
+
+	A BlockStore keeps its blocks in a BlockStorage. The memory engine is a
+	map and loses everything when the process exits. The disk engine stores
+	every block as a file named after its hash, fanned out over directories
+	named after the first two hex digits of the hash so no directory grows
+	too big:
+
+		<dataDir>/3f/3fa2...c1
+
+	Compressed blocks are kept as they arrived, with the suffix of their
+	codec, e.g. <dataDir>/3f/3fa2...c1.gz.
+
+	A block is written to a temporary file in its fan-out directory, fsync'd
+	and renamed over its final name, and the directory is fsync'd after the
+	rename. A crash leaves either the whole block or no block behind, plus
+	maybe a temporary file that is removed on the next start.
+
+	Both engines remember when a block was last used, i.e. written or found
+	by HasBlocks, so garbage collection can spare blocks that a client is
+	about to refer to. The disk engine uses the modification time of the
+	block file for this.
+*/
+
+// BlockStorage holds the blocks of a BlockStore, keyed by their hash.
+// Engines are safe for concurrent use, BlockStore only keeps deletes apart
+// from the other calls.
+type BlockStorage interface {
+	// Get returns the block stored under hash, nil if there is none
+	Get(hash string) (*Block, error)
+	Put(hash string, block *Block) error
+	Has(hash string) (bool, error)
+	List() ([]string, error)
+	// Delete removes the block stored under hash, if there is one
+	Delete(hash string) error
+	// Touch marks the block stored under hash as used now
+	Touch(hash string) error
+	// LastUsed returns when the block stored under hash was last written or
+	// touched, the zero time if there is no such block
+	LastUsed(hash string) (time.Time, error)
+}
+
+// NewBlockStorage opens the storage engine called engine, one of
+// BLOCK_STORAGE_MEMORY and BLOCK_STORAGE_DISK. The disk engine keeps its
+// blocks in dataDir.
+func NewBlockStorage(engine string, dataDir string) (BlockStorage, error) {
+	switch engine {
+	case BLOCK_STORAGE_MEMORY:
+		return NewMemoryBlockStorage(), nil
+	case BLOCK_STORAGE_DISK:
+		if dataDir == "" {
+			return nil, fmt.Errorf("the disk block storage needs a data directory")
+		}
+		return OpenDiskBlockStorage(dataDir)
+	default:
+		return nil, fmt.Errorf("unknown block storage %q", engine)
+	}
+}
+
+type MemoryBlockStorage struct {
+	blocks map[string]*Block
+	used   map[string]time.Time
+	mtx    sync.RWMutex
+}
+
+func NewMemoryBlockStorage() *MemoryBlockStorage {
+	return &MemoryBlockStorage{
+		blocks: make(map[string]*Block),
+		used:   make(map[string]time.Time),
+	}
+}
+
+func (m *MemoryBlockStorage) Get(hash string) (*Block, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.blocks[hash], nil
+}
+
+func (m *MemoryBlockStorage) Put(hash string, block *Block) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.blocks[hash] = block
+	m.used[hash] = time.Now()
+	return nil
+}
+
+func (m *MemoryBlockStorage) Has(hash string) (bool, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	_, ok := m.blocks[hash]
+	return ok, nil
+}
+
+func (m *MemoryBlockStorage) List() ([]string, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	hashes := make([]string, 0, len(m.blocks))
+	for hash := range m.blocks {
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+func (m *MemoryBlockStorage) Delete(hash string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.blocks, hash)
+	delete(m.used, hash)
+	return nil
+}
+
+func (m *MemoryBlockStorage) Touch(hash string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.blocks[hash]; ok {
+		m.used[hash] = time.Now()
+	}
+	return nil
+}
+
+func (m *MemoryBlockStorage) LastUsed(hash string) (time.Time, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.used[hash], nil
+}
+
+// Block files are named after the hex SHA-256 of their content, plus the
+// suffix of their compression
+var blockFileName = regexp.MustCompile(`^([0-9a-f]{64})(\.[a-z]+)?$`)
+var blockHash = regexp.MustCompile("^[0-9a-f]{64}$")
+
+type DiskBlockStorage struct {
+	dataDir string
+}
+
+// OpenDiskBlockStorage opens (or creates) the block files in dataDir and
+// removes the temporary files of writes a crash cut short
+func OpenDiskBlockStorage(dataDir string) (*DiskBlockStorage, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+	tmpFiles, err := filepath.Glob(filepath.Join(dataDir, "*", "*"+BLOCK_TMP_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmpFile := range tmpFiles {
+		if err := os.Remove(tmpFile); err != nil {
+			return nil, err
+		}
+	}
+	return &DiskBlockStorage{dataDir: dataDir}, nil
+}
+
+func (d *DiskBlockStorage) fanOutDir(hash string) string {
+	return filepath.Join(d.dataDir, hash[:2])
+}
+
+// blockPath returns where the block hash is stored when it is compressed
+// with compression. Hashes come from clients, anything that isn't a block
+// hash could escape dataDir.
+func (d *DiskBlockStorage) blockPath(hash string, compression Compression) (string, error) {
+	if !blockHash.MatchString(hash) {
+		return "", fmt.Errorf("%q is not a block hash", hash)
+	}
+	suffix, ok := COMPRESSION_SUFFIXES[compression]
+	if !ok {
+		return "", fmt.Errorf("unknown compression %v", compression)
+	}
+	return filepath.Join(d.fanOutDir(hash), hash+suffix), nil
+}
+
+func compressionOfSuffix(suffix string) (Compression, error) {
+	for compression, compressionSuffix := range COMPRESSION_SUFFIXES {
+		if suffix == compressionSuffix {
+			return compression, nil
+		}
+	}
+	return Compression_NONE, fmt.Errorf("unknown block file suffix %q", suffix)
+}
+
+// findBlock returns the file of the block hash and its compression, an
+// empty path if there is none
+func (d *DiskBlockStorage) findBlock(hash string) (string, Compression, error) {
+	for _, compression := range SUPPORTED_COMPRESSIONS {
+		path, err := d.blockPath(hash, compression)
+		if err != nil {
+			return "", Compression_NONE, err
+		}
+		_, err = os.Stat(path)
+		if err == nil {
+			return path, compression, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", Compression_NONE, err
+		}
+	}
+	return "", Compression_NONE, nil
+}
+
+func (d *DiskBlockStorage) Get(hash string) (*Block, error) {
+	path, compression, err := d.findBlock(hash)
+	if err != nil || path == "" {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	blockSize, err := uncompressedSize(data, compression)
+	if err != nil {
+		return nil, fmt.Errorf("block file %s: %v", path, err)
+	}
+	return &Block{BlockData: data, BlockSize: blockSize, Compression: compression}, nil
+}
+
+// Put writes the block to a temporary file and renames it into place once
+// it is on disk. Blocks are named after their content, so a block that is
+// already stored, in any compression, is only touched.
+func (d *DiskBlockStorage) Put(hash string, block *Block) error {
+	existing, _, err := d.findBlock(hash)
+	if err != nil {
+		return err
+	}
+	if existing != "" {
+		return d.Touch(hash)
+	}
+	path, err := d.blockPath(hash, block.GetCompression())
+	if err != nil {
+		return err
+	}
+
+	dir := d.fanOutDir(hash)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, hash+".*"+BLOCK_TMP_SUFFIX)
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(block.GetBlockData()); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(dir)
+}
+
+func (d *DiskBlockStorage) Has(hash string) (bool, error) {
+	if !blockHash.MatchString(hash) {
+		return false, nil
+	}
+	path, _, err := d.findBlock(hash)
+	return path != "", err
+}
+
+func (d *DiskBlockStorage) List() ([]string, error) {
+	dirs, err := ioutil.ReadDir(d.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0)
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(d.dataDir, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		listed := make(map[string]bool)
+		for _, file := range files {
+			match := blockFileName.FindStringSubmatch(file.Name())
+			if !file.Mode().IsRegular() || match == nil || !strings.HasPrefix(match[1], dir.Name()) {
+				continue
+			}
+			if _, err := compressionOfSuffix(match[2]); err != nil {
+				continue
+			}
+			if !listed[match[1]] {
+				listed[match[1]] = true
+				hashes = append(hashes, match[1])
+			}
+		}
+	}
+	return hashes, nil
+}
+
+// Delete removes the block in every compression it is stored in
+func (d *DiskBlockStorage) Delete(hash string) error {
+	removed := false
+	for _, compression := range SUPPORTED_COMPRESSIONS {
+		path, err := d.blockPath(hash, compression)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		removed = true
+	}
+	if !removed {
+		return nil
+	}
+	return syncDir(d.fanOutDir(hash))
+}
+
+func (d *DiskBlockStorage) Touch(hash string) error {
+	path, _, err := d.findBlock(hash)
+	if err != nil || path == "" {
+		return err
+	}
+	now := time.Now()
+	err = os.Chtimes(path, now, now)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *DiskBlockStorage) LastUsed(hash string) (time.Time, error) {
+	path, _, err := d.findBlock(hash)
+	if err != nil || path == "" {
+		return time.Time{}, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// These lines guarantee all methods for the engines are implemented
+var _ BlockStorage = new(MemoryBlockStorage)
+var _ BlockStorage = new(DiskBlockStorage)
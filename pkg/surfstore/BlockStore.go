@@ -2,69 +2,208 @@ package surfstore
 
 import (
 	context "context"
+	"io"
 	"sync"
+	"time"
+
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 type BlockStore struct {
-	BlockMap map[string]*Block
-	mtx      sync.Mutex
+	Storage BlockStorage
+	// PutBlock turns away blocks bigger than this
+	MaxBlockSize int32
+	// storage calls go on in parallel, deletes hold it exclusively so a
+	// block can't be used between the check and its deletion
+	deleteMtx sync.RWMutex
 	UnimplementedBlockStoreServer
 }
 
 func (bs *BlockStore) GetBlock(ctx context.Context, blockHash *BlockHash) (*Block, error) {
 	//panic("todo")
-	bs.mtx.Lock()
-	defer bs.mtx.Unlock()
-	hashVal := blockHash.GetHash()
-	data := bs.BlockMap[hashVal].GetBlockData()
-	size := bs.BlockMap[hashVal].GetBlockSize()
+	return bs.getBlock(blockHash.GetHash())
+}
+
+func (bs *BlockStore) PutBlock(ctx context.Context, block *Block) (*Success, error) {
+	//panic("todo")
+	if _, err := bs.putBlock(block); err != nil {
+		return &Success{Flag: false}, err
+	}
+	return &Success{Flag: true}, nil
+}
+
+// Stores the blocks of the stream one at a time as they arrive, so a client
+// can't send faster than they are written
+func (bs *BlockStore) PutBlocks(stream BlockStore_PutBlocksServer) error {
+	stored := make([]string, 0)
+	for {
+		block, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&BlockHashes{Hashes: stored})
+		}
+		if err != nil {
+			return err
+		}
+		hashString, err := bs.putBlock(block)
+		if err != nil {
+			return err
+		}
+		stored = append(stored, hashString)
+	}
+}
+
+// Sends the blocks one at a time, Send blocks while the client is behind
+func (bs *BlockStore) GetBlocks(blockHashes *BlockHashes, stream BlockStore_GetBlocksServer) error {
+	for _, hash := range blockHashes.GetHashes() {
+		block, err := bs.getBlock(hash)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bs *BlockStore) getBlock(hashVal string) (*Block, error) {
+	bs.deleteMtx.RLock()
+	defer bs.deleteMtx.RUnlock()
+	block, err := bs.Storage.Get(hashVal)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, status.Errorf(codes.NotFound, "block %s not found", hashVal)
+	}
+	data := block.GetBlockData()
+	size := block.GetBlockSize()
 	/*
 		log.Println("server get1:", len(data), " ", data[:10])
 		log.Println("server get2:", size)
 	*/
 	return &Block{
-		BlockData: data,
-		BlockSize: size,
+		BlockData:   data,
+		BlockSize:   size,
+		Compression: block.GetCompression(),
 	}, nil
 }
 
-func (bs *BlockStore) PutBlock(ctx context.Context, block *Block) (*Success, error) {
-	//panic("todo")
-	bs.mtx.Lock()
-	defer bs.mtx.Unlock()
-	blockData := block.GetBlockData()
+// putBlock checks and stores block and returns its hash
+func (bs *BlockStore) putBlock(block *Block) (string, error) {
+	bs.deleteMtx.RLock()
+	defer bs.deleteMtx.RUnlock()
 	blockSize := block.GetBlockSize()
+	if blockSize > bs.MaxBlockSize {
+		return "", status.Errorf(codes.InvalidArgument, "block of %d bytes is over the limit of %d", blockSize, bs.MaxBlockSize)
+	}
+	// the hash is over the uncompressed data, the block is kept compressed
+	uncompressed, err := DecompressBlock(block)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "block doesn't decompress: %v", err)
+	}
+	blockData := uncompressed.GetBlockData()
+	if int(blockSize) != len(blockData) {
+		return "", status.Errorf(codes.InvalidArgument, "block size %d doesn't match its %d bytes of data", blockSize, len(blockData))
+	}
 	blockPrepared := &Block{
-		BlockData: blockData,
-		BlockSize: blockSize,
+		BlockData:   block.GetBlockData(),
+		BlockSize:   blockSize,
+		Compression: block.GetCompression(),
 	}
 	hashString := GetBlockHashString(blockData)
-	bs.BlockMap[hashString] = blockPrepared
-	return &Success{Flag: true}, nil
+	if err := bs.Storage.Put(hashString, blockPrepared); err != nil {
+		return "", err
+	}
+	return hashString, nil
 }
 
 // Given a list of hashes “in”, returns a list containing the
-// subset of in that are stored in the key-value store
+// subset of in that are stored in the key-value store. The client is about
+// to refer to them, so they count as used.
 func (bs *BlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error) {
 	//panic("todo")
-	bs.mtx.Lock()
-	defer bs.mtx.Unlock()
+	bs.deleteMtx.RLock()
+	defer bs.deleteMtx.RUnlock()
 	hashes := blockHashesIn.GetHashes()
 	var exist []string
 	for _, s := range hashes {
-		if _, ok := bs.BlockMap[s]; ok {
+		ok, err := bs.Storage.Has(s)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
 			//hashString := GetBlockHashString(block.GetBlockData())
+			if err := bs.Storage.Touch(s); err != nil {
+				return nil, err
+			}
 			exist = append(exist, s)
 		}
 	}
 	return &BlockHashes{Hashes: exist}, nil
 }
 
+func (bs *BlockStore) ListBlocks(ctx context.Context, _ *emptypb.Empty) (*BlockHashes, error) {
+	bs.deleteMtx.RLock()
+	defer bs.deleteMtx.RUnlock()
+	hashes, err := bs.Storage.List()
+	if err != nil {
+		return nil, err
+	}
+	return &BlockHashes{Hashes: hashes}, nil
+}
+
+func (bs *BlockStore) DeleteBlocks(ctx context.Context, blockHashes *BlockHashes) (*Success, error) {
+	bs.deleteMtx.Lock()
+	defer bs.deleteMtx.Unlock()
+	for _, hash := range blockHashes.GetHashes() {
+		if err := bs.Storage.Delete(hash); err != nil {
+			return &Success{Flag: false}, err
+		}
+	}
+	return &Success{Flag: true}, nil
+}
+
+// Deletes the given blocks unless they were used within the grace period:
+// a client may have uploaded them for an update the caller doesn't know
+// about yet
+func (bs *BlockStore) DeleteUnusedBlocks(ctx context.Context, unused *UnusedBlocks) (*BlockHashes, error) {
+	bs.deleteMtx.Lock()
+	defer bs.deleteMtx.Unlock()
+	gracePeriod := time.Duration(unused.GetGracePeriodMs()) * time.Millisecond
+	deleted := make([]string, 0)
+	for _, hash := range unused.GetHashes() {
+		lastUsed, err := bs.Storage.LastUsed(hash)
+		if err != nil {
+			return nil, err
+		}
+		if lastUsed.IsZero() || time.Since(lastUsed) < gracePeriod {
+			continue
+		}
+		if err := bs.Storage.Delete(hash); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, hash)
+	}
+	return &BlockHashes{Hashes: deleted}, nil
+}
+
+func (bs *BlockStore) GetCompressions(ctx context.Context, _ *emptypb.Empty) (*Compressions, error) {
+	return &Compressions{Compressions: SUPPORTED_COMPRESSIONS}, nil
+}
+
 // This line guarantees all method for BlockStore are implemented
 var _ BlockStoreInterface = new(BlockStore)
 
 func NewBlockStore() *BlockStore {
+	return NewBlockStoreWithStorage(NewMemoryBlockStorage())
+}
+
+func NewBlockStoreWithStorage(storage BlockStorage) *BlockStore {
 	return &BlockStore{
-		BlockMap: map[string]*Block{},
+		Storage:      storage,
+		MaxBlockSize: DEFAULT_MAX_BLOCK_SIZE,
 	}
 }
@@ -0,0 +1,88 @@
+package surfstore
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ConsistentHashRing places the block stores of a BlockStoreMap on a ring of
+// hashes. Block hashes are hex SHA-256 strings like the ring positions, so
+// comparing them as strings walks the ring in order.
+type ConsistentHashRing struct {
+	// ring position -> block store address
+	ServerMap map[string]string
+	// the ring positions in ascending order
+	positions []string
+
+	Addrs       []string
+	Replicas    int
+	WriteQuorum int
+}
+
+// NewBlockStoreMap describes blocks spread over addrs with replicas copies
+// each, writeQuorum of which must be written. A replicas of 0 stores every
+// block on all of them and a writeQuorum of 0 picks a majority of replicas.
+func NewBlockStoreMap(addrs []string, replicas int32, writeQuorum int32) (*BlockStoreMap, error) {
+	if replicas == 0 {
+		replicas = int32(len(addrs))
+	}
+	if replicas < 0 || int(replicas) > len(addrs) {
+		return nil, fmt.Errorf("%d replicas don't fit on %d block stores", replicas, len(addrs))
+	}
+	if writeQuorum == 0 && replicas > 0 {
+		writeQuorum = replicas/2 + 1
+	}
+	if writeQuorum < 0 || writeQuorum > replicas {
+		return nil, fmt.Errorf("write quorum %d is not between 1 and the %d replicas", writeQuorum, replicas)
+	}
+	return &BlockStoreMap{
+		Addrs:        addrs,
+		VirtualNodes: DEFAULT_VIRTUAL_NODES,
+		Replicas:     replicas,
+		WriteQuorum:  writeQuorum,
+	}, nil
+}
+
+func NewConsistentHashRing(blockStores *BlockStoreMap) *ConsistentHashRing {
+	ring := &ConsistentHashRing{
+		ServerMap:   make(map[string]string),
+		Addrs:       blockStores.GetAddrs(),
+		Replicas:    int(blockStores.GetReplicas()),
+		WriteQuorum: int(blockStores.GetWriteQuorum()),
+	}
+	if ring.Replicas > len(ring.Addrs) {
+		ring.Replicas = len(ring.Addrs)
+	}
+
+	virtualNodes := int(blockStores.GetVirtualNodes())
+	if virtualNodes < 1 {
+		virtualNodes = 1
+	}
+	for _, addr := range ring.Addrs {
+		for i := 0; i < virtualNodes; i++ {
+			position := GetBlockHashString([]byte(fmt.Sprintf("blockstore%s#%d", addr, i)))
+			ring.ServerMap[position] = addr
+			ring.positions = append(ring.positions, position)
+		}
+	}
+	sort.Strings(ring.positions)
+	return ring
+}
+
+// GetResponsibleServers returns the block stores that hold blockHash: the
+// first Replicas distinct ones clockwise from it
+func (c *ConsistentHashRing) GetResponsibleServers(blockHash string) []string {
+	servers := make([]string, 0, c.Replicas)
+	if len(c.positions) == 0 {
+		return servers
+	}
+
+	start := sort.SearchStrings(c.positions, blockHash)
+	for i := 0; i < len(c.positions) && len(servers) < c.Replicas; i++ {
+		addr := c.ServerMap[c.positions[(start+i)%len(c.positions)]]
+		if !stringExist(addr, servers) {
+			servers = append(servers, addr)
+		}
+	}
+	return servers
+}
@@ -0,0 +1,119 @@
+package surfstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// dirWatcher adds the paths that change under a directory tree to a
+// changedPaths, with fsnotify. fsnotify watches single directories, so
+// every directory of the tree gets a watch, including the ones created
+// later.
+type dirWatcher struct {
+	watcher *fsnotify.Watcher
+	baseDir string
+	changed *changedPaths
+
+	Errors chan error
+}
+
+func newDirWatcher(baseDir string, changed *changedPaths) (*dirWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &dirWatcher{
+		watcher: watcher,
+		baseDir: baseDir,
+		changed: changed,
+		Errors:  make(chan error, 1),
+	}
+	if err := w.addTree(baseDir, false); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	go w.read()
+	return w, nil
+}
+
+// addTree watches dir and the directories under it. With changed, what is
+// in them changed too: it may have been written before the watch was up.
+func (w *dirWatcher) addTree(dir string, changed bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// gone again before we got to it
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if changed {
+			w.add(path)
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if err := w.watcher.Add(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	})
+}
+
+func (w *dirWatcher) read() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+					if err := w.addTree(event.Name, true); err != nil {
+						w.sendError(err)
+					}
+				}
+			}
+			w.add(event.Name)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// events were lost, the next sync looks at everything
+				w.changed.addAll()
+				continue
+			}
+			w.sendError(err)
+		}
+	}
+}
+
+// add marks path changed, unless it is one of the files syncing writes
+// itself: the index and the temporary files of downloads
+func (w *dirWatcher) add(path string) {
+	rel, err := filepath.Rel(w.baseDir, path)
+	if err != nil || rel == "." {
+		return
+	}
+	name := filepath.ToSlash(rel)
+	if name == DEFAULT_META_FILENAME || strings.HasSuffix(name, DOWNLOAD_TMP_SUFFIX) {
+		return
+	}
+	w.changed.add(name)
+}
+
+func (w *dirWatcher) sendError(err error) {
+	select {
+	case w.Errors <- err:
+	default:
+	}
+}
+
+func (w *dirWatcher) Close() error {
+	return w.watcher.Close()
+}
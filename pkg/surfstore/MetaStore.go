@@ -3,29 +3,145 @@ package surfstore
 import (
 	context "context"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
+	"google.golang.org/protobuf/proto"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 type MetaStore struct {
-	FileMetaMap    map[string]*FileMetaData
-	BlockStoreAddr string
-	mtx            sync.Mutex
+	FileMetaMap map[string]*FileMetaData
+	// the block stores and how blocks are spread over them
+	BlockStores *BlockStoreMap
+
+	// the index of the latest change to each file and of the latest change
+	// overall. A standalone metastore counts its changes, under raft the
+	// index is the log index of the update.
+	changedAt  map[string]int64
+	lastChange int64
+	// the latest WATCH_LOG_LENGTH changes, oldest first, and the index of
+	// the latest change that is no longer in it
+	changeLog     []*FileChange
+	changeLogFrom int64
+	// closed and replaced on every change
+	changed chan struct{}
+
+	// the latest HistoryLength versions of each file, the latest one
+	// included. Their blocks are spared by garbage collection.
+	HistoryLength int
+	history       map[string]*FileHistory
+
+	mtx sync.Mutex
 	UnimplementedMetaStoreServer
 }
 
+// GetFileInfoMap returns a copy of the map, which gets serialized after the
+// lock is released
 func (m *MetaStore) GetFileInfoMap(ctx context.Context, _ *emptypb.Empty) (*FileInfoMap, error) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 	return &FileInfoMap{
-		FileInfoMap: m.FileMetaMap,
+		FileInfoMap: m.copyFileMetaMap(),
 	}, nil
 }
 
 func (m *MetaStore) UpdateFile(ctx context.Context, fileMetaData *FileMetaData) (*Version, error) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
+	return m.updateFile(m.lastChange+1, time.Now(), fileMetaData)
+}
+
+// applyUpdate is UpdateFile for the update at index of the raft log, which
+// the leader accepted at at
+func (m *MetaStore) applyUpdate(index int64, at time.Time, fileMetaData *FileMetaData) (*Version, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.updateFile(index, at, fileMetaData)
+}
+
+// updateFile applies the update and records it as the change at index,
+// and as a version made at at, if it went through. Caller must hold mtx.
+func (m *MetaStore) updateFile(index int64, at time.Time, fileMetaData *FileMetaData) (*Version, error) {
+	version, err := m.putFileMetaData(fileMetaData)
+	if err == nil && version.GetVersion() != -1 {
+		m.changedAt[fileMetaData.GetFilename()] = index
+		m.lastChange = index
+		m.logChange(&FileChange{Index: index, FileMetaData: m.FileMetaMap[fileMetaData.GetFilename()]})
+		m.keepVersion(m.FileMetaMap[fileMetaData.GetFilename()], at)
+		m.notifyWatchers()
+	}
+	return version, err
+}
+
+// keepVersion adds fileMetaData to the history of its file and drops the
+// versions past HistoryLength. Caller must hold mtx.
+func (m *MetaStore) keepVersion(fileMetaData *FileMetaData, at time.Time) {
+	history, ok := m.history[fileMetaData.GetFilename()]
+	if !ok {
+		history = &FileHistory{}
+		m.history[fileMetaData.GetFilename()] = history
+	}
+	history.Versions = append(history.Versions, &FileVersion{
+		FileMetaData: proto.Clone(fileMetaData).(*FileMetaData),
+		Timestamp:    at.UnixMilli(),
+	})
+	if drop := len(history.Versions) - m.HistoryLength; drop > 0 {
+		history.Versions = append([]*FileVersion(nil), history.Versions[drop:]...)
+	}
+}
+
+func (m *MetaStore) GetFileHistory(ctx context.Context, input *FileHistoryInput) (*FileHistory, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	history, ok := m.history[input.GetFilename()]
+	if !ok {
+		return &FileHistory{}, nil
+	}
+	return &FileHistory{Versions: append([]*FileVersion(nil), history.Versions...)}, nil
+}
+
+func (m *MetaStore) RestoreFileVersion(ctx context.Context, input *RestoreFileVersionInput) (*Version, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.restoreVersion(m.lastChange+1, time.Now(), input)
+}
+
+// applyRestore is RestoreFileVersion for the restore at index of the raft
+// log, which the leader accepted at at
+func (m *MetaStore) applyRestore(index int64, at time.Time, input *RestoreFileVersionInput) (*Version, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.restoreVersion(index, at, input)
+}
+
+// restoreVersion updates the file to the blocks of a kept version of it.
+// Caller must hold mtx.
+func (m *MetaStore) restoreVersion(index int64, at time.Time, input *RestoreFileVersionInput) (*Version, error) {
+	var kept *FileMetaData
+	if history, ok := m.history[input.GetFilename()]; ok {
+		for _, version := range history.Versions {
+			if version.GetFileMetaData().GetVersion() == input.GetVersion() {
+				kept = version.GetFileMetaData()
+			}
+		}
+	}
+	if kept == nil {
+		return &Version{Version: -1}, fmt.Errorf("version %d of %s is not kept", input.GetVersion(), input.GetFilename())
+	}
+	return m.updateFile(index, at, &FileMetaData{
+		Filename:      kept.GetFilename(),
+		Version:       m.FileMetaMap[kept.GetFilename()].GetVersion() + 1,
+		BlockHashList: kept.GetBlockHashList(),
+		BlockKeys:     kept.GetBlockKeys(),
+		Author:        input.GetAuthor(),
+	})
+}
+
+// putFileMetaData stores fileMetaData if its version follows the stored
+// one. Caller must hold mtx.
+func (m *MetaStore) putFileMetaData(fileMetaData *FileMetaData) (*Version, error) {
 	fileName := fileMetaData.GetFilename()
 	fileVersion := fileMetaData.GetVersion()
 	// file doesn't exist
@@ -41,7 +157,8 @@ func (m *MetaStore) UpdateFile(ctx context.Context, fileMetaData *FileMetaData)
 		// check tombstone case || previously deleted
 		if len(hashList) == 1 && hashList[0] == "0" {
 			vv := inMetaData.Version + 1 // increment by 1
-			m.FileMetaMap[fileName] = fileMetaData
+			// a copy, fileMetaData may be a log entry that is being sent
+			m.FileMetaMap[fileName] = proto.Clone(fileMetaData).(*FileMetaData)
 			m.FileMetaMap[fileName].Version = vv
 			return &Version{Version: vv}, nil
 		}
@@ -54,19 +171,202 @@ func (m *MetaStore) UpdateFile(ctx context.Context, fileMetaData *FileMetaData)
 	}
 }
 
+// WatchChanges streams every change after input.SinceIndex in order, then
+// each change as it happens until the client goes away. A client that
+// reconnects with the index of the last change it got misses nothing. For
+// a client further behind than the change log reaches the changes are
+// coalesced: it gets the latest metadata of every file changed since, in
+// the order of their latest change.
+func (m *MetaStore) WatchChanges(input *WatchChangesInput, stream MetaStore_WatchChangesServer) error {
+	since := input.GetSinceIndex()
+	for {
+		changes, next := m.changesSince(since)
+		for _, change := range changes {
+			if err := stream.Send(change); err != nil {
+				return err
+			}
+			since = change.Index
+		}
+		select {
+		case <-next:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// changesSince returns the changes after index, coalesced per file if the
+// change log doesn't reach back that far, and a channel that is closed on
+// the next change
+func (m *MetaStore) changesSince(index int64) ([]*FileChange, <-chan struct{}) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if index >= m.changeLogFrom {
+		first := sort.Search(len(m.changeLog), func(i int) bool { return m.changeLog[i].Index > index })
+		return append([]*FileChange(nil), m.changeLog[first:]...), m.changed
+	}
+
+	changes := make([]*FileChange, 0)
+	for fileName, changedAt := range m.changedAt {
+		if changedAt > index {
+			changes = append(changes, &FileChange{Index: changedAt, FileMetaData: m.FileMetaMap[fileName]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Index < changes[j].Index })
+	return changes, m.changed
+}
+
+// logChange adds change to the change log and drops the oldest change past
+// WATCH_LOG_LENGTH. Caller must hold mtx.
+func (m *MetaStore) logChange(change *FileChange) {
+	m.changeLog = append(m.changeLog, change)
+	if drop := len(m.changeLog) - WATCH_LOG_LENGTH; drop > 0 {
+		m.changeLogFrom = m.changeLog[drop-1].Index
+		m.changeLog = append([]*FileChange(nil), m.changeLog[drop:]...)
+	}
+}
+
+// notifyWatchers wakes the WatchChanges streams up. Caller must hold mtx.
+func (m *MetaStore) notifyWatchers() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// addReferencedBlocks adds the hashes of the blocks the files and their
+// kept versions are made of to live
+func (m *MetaStore) addReferencedBlocks(live map[string]bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, fileMetaData := range m.FileMetaMap {
+		addBlockHashes(fileMetaData, live)
+	}
+	for _, history := range m.history {
+		for _, version := range history.Versions {
+			addBlockHashes(version.GetFileMetaData(), live)
+		}
+	}
+}
+
+// addBlockHashes adds the blocks of fileMetaData to live, a deleted file has
+// none
+func addBlockHashes(fileMetaData *FileMetaData, live map[string]bool) {
+	hashList := fileMetaData.GetBlockHashList()
+	if len(hashList) == 1 && hashList[0] == "0" {
+		return
+	}
+	for _, hash := range hashList {
+		live[hash] = true
+	}
+}
+
 func (m *MetaStore) GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddr, error) {
 	//panic("todo")
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
-	return &BlockStoreAddr{Addr: m.BlockStoreAddr}, nil
+	if len(m.BlockStores.GetAddrs()) == 0 {
+		return &BlockStoreAddr{}, nil
+	}
+	return &BlockStoreAddr{Addr: m.BlockStores.Addrs[0]}, nil
+}
+
+func (m *MetaStore) GetBlockStoreAddrs(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddrs, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return &BlockStoreAddrs{
+		Addrs:       m.BlockStores.GetAddrs(),
+		WriteQuorum: m.BlockStores.GetWriteQuorum(),
+	}, nil
+}
+
+func (m *MetaStore) GetBlockStoreMap(ctx context.Context, _ *emptypb.Empty) (*BlockStoreMap, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.BlockStores, nil
+}
+
+// setBlockStores switches to a new set of block stores
+func (m *MetaStore) setBlockStores(blockStores *BlockStoreMap) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.BlockStores = blockStores
+}
+
+// snapshotInto fills in the metastore's part of snapshot with copies taken
+// under mtx, so updates can go on while it is serialized
+func (m *MetaStore) snapshotInto(snapshot *RaftSnapshot) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	history := make(map[string]*FileHistory, len(m.history))
+	for fileName, fileHistory := range m.history {
+		history[fileName] = &FileHistory{Versions: append([]*FileVersion(nil), fileHistory.Versions...)}
+	}
+	snapshot.MetaMap = &FileInfoMap{FileInfoMap: m.copyFileMetaMap()}
+	snapshot.History = history
+	snapshot.BlockStores = m.BlockStores
+}
+
+// copyFileMetaMap returns a copy of FileMetaMap. Updates replace entries
+// rather than change them, so the entries themselves can be shared. Caller
+// must hold mtx.
+func (m *MetaStore) copyFileMetaMap() map[string]*FileMetaData {
+	fileMetaMap := make(map[string]*FileMetaData, len(m.FileMetaMap))
+	for fileName, fileMetaData := range m.FileMetaMap {
+		fileMetaMap[fileName] = fileMetaData
+	}
+	return fileMetaMap
+}
+
+// restore replaces every file's metadata and history, e.g. with the
+// contents of a snapshot as of index, and the block stores unless
+// blockStores is nil. Which files changed when is lost, they all count as
+// changed at index and watchers behind it get them coalesced. A file
+// without history keeps its latest version.
+func (m *MetaStore) restore(fileMetaMap map[string]*FileMetaData, history map[string]*FileHistory, blockStores *BlockStoreMap, index int64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if fileMetaMap == nil {
+		fileMetaMap = map[string]*FileMetaData{}
+	}
+	if history == nil {
+		history = map[string]*FileHistory{}
+	}
+	m.FileMetaMap = fileMetaMap
+	m.history = history
+	if blockStores != nil {
+		m.BlockStores = blockStores
+	}
+	m.changedAt = make(map[string]int64)
+	for fileName, fileMetaData := range fileMetaMap {
+		m.changedAt[fileName] = index
+		if _, ok := history[fileName]; !ok {
+			m.keepVersion(fileMetaData, time.UnixMilli(0))
+		}
+	}
+	m.lastChange = index
+	m.changeLog = nil
+	m.changeLogFrom = index
+	m.notifyWatchers()
 }
 
 // This line guarantees all method for MetaStore are implemented
 var _ MetaStoreInterface = new(MetaStore)
 
 func NewMetaStore(blockStoreAddr string) *MetaStore {
+	blockStores, _ := NewBlockStoreMap([]string{blockStoreAddr}, 1, 1)
+	return NewShardedMetaStore(blockStores)
+}
+
+// NewShardedMetaStore sends clients to the block stores of blockStores
+func NewShardedMetaStore(blockStores *BlockStoreMap) *MetaStore {
 	return &MetaStore{
-		FileMetaMap:    map[string]*FileMetaData{},
-		BlockStoreAddr: blockStoreAddr,
+		FileMetaMap:   map[string]*FileMetaData{},
+		BlockStores:   blockStores,
+		changedAt:     map[string]int64{},
+		lastChange:    -1,
+		changeLogFrom: -1,
+		changed:       make(chan struct{}),
+
+		HistoryLength: DEFAULT_HISTORY_LENGTH,
+		history:       map[string]*FileHistory{},
 	}
 }
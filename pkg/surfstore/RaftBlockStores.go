@@ -0,0 +1,169 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"log"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+/*
+	Block store membership
+
+	The block stores are part of the metastore state, so the leader changes
+	them through the log like a file update and every metastore replica hands
+	clients the same hash ring.
+
+	Once a new block store is on the committed ring the leader rebalances:
+	it asks every block store which blocks it holds, copies each block to
+	the owners the ring now gives it and then deletes it from the block
+	stores that no longer own it. The deletes go through the grace period
+	garbage collection uses, a client still on the old ring may have just
+	uploaded the block there. Those copies stay until a later rebalance.
+	Clients that miss a block on its owners ask the other block stores, so
+	blocks stay readable while they move and after a rebalance that was cut
+	short.
+*/
+
+// Adds a block store to the hash ring and moves the blocks it now owns onto
+// it. Adding a block store that is already on the ring rebalances again,
+// e.g. to finish an earlier rebalance that failed.
+func (s *RaftSurfstore) AddBlockStore(ctx context.Context, input *BlockStoreAddr) (*Success, error) {
+	if s.crashed() {
+		return &Success{Flag: false}, ERR_SERVER_CRASHED
+	}
+
+	s.raftMutex.Lock()
+	if !s.isLeader {
+		s.raftMutex.Unlock()
+		return &Success{Flag: false}, ERR_NOT_LEADER
+	}
+	if s.transferTarget != NO_TRANSFER {
+		s.raftMutex.Unlock()
+		return &Success{Flag: false}, ERR_TRANSFER_IN_PROGRESS
+	}
+	blockStores := s.metaStore.BlockStores
+	if !stringExist(input.Addr, blockStores.GetAddrs()) {
+		blockStores = proto.Clone(blockStores).(*BlockStoreMap)
+		blockStores.Addrs = append(blockStores.Addrs, input.Addr)
+
+		index, committed := s.appendEntry(&UpdateOperation{
+			Term:        s.term,
+			BlockStores: blockStores,
+		})
+		s.raftMutex.Unlock()
+
+		if _, err := s.awaitCommit(ctx, index, committed); err != nil {
+			return &Success{Flag: false}, err
+		}
+	} else {
+		s.raftMutex.Unlock()
+	}
+
+	if err := rebalanceBlocks(ctx, blockStores, s.config.GCGracePeriod); err != nil {
+		log.Printf("server %d failed to rebalance the blocks onto %s: %v", s.serverId, input.Addr, err)
+		return &Success{Flag: false}, err
+	}
+	return &Success{Flag: true}, nil
+}
+
+// rebalanceBlocks moves every block onto the block stores that own it on
+// the ring of blockStores and off the ones that don't, unless it was used
+// there within gracePeriod
+func rebalanceBlocks(ctx context.Context, blockStores *BlockStoreMap, gracePeriod time.Duration) error {
+	ring := NewConsistentHashRing(blockStores)
+
+	// hash -> block stores holding the block
+	holders := make(map[string][]string)
+	for _, addr := range ring.Addrs {
+		var hashes *BlockHashes
+		err := callBlockStore(ctx, addr, func(ctx context.Context, c BlockStoreClient) (err error) {
+			hashes, err = c.ListBlocks(ctx, &emptypb.Empty{})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, hash := range hashes.Hashes {
+			holders[hash] = append(holders[hash], addr)
+		}
+	}
+
+	// block store -> blocks it doesn't own anymore
+	stale := make(map[string][]string)
+	moved, staleCopies := 0, 0
+	for hash, holding := range holders {
+		owners := ring.GetResponsibleServers(hash)
+		for _, owner := range owners {
+			if stringExist(owner, holding) {
+				continue
+			}
+			if err := copyBlock(ctx, hash, holding[0], owner); err != nil {
+				return err
+			}
+			moved++
+		}
+		for _, addr := range holding {
+			if !stringExist(addr, owners) {
+				stale[addr] = append(stale[addr], hash)
+				staleCopies++
+			}
+		}
+	}
+
+	// only drop copies once every block is on all of its owners
+	deleted := 0
+	for addr, hashes := range stale {
+		err := callBlockStore(ctx, addr, func(ctx context.Context, c BlockStoreClient) error {
+			output, err := c.DeleteUnusedBlocks(ctx, &UnusedBlocks{Hashes: hashes, GracePeriodMs: gracePeriod.Milliseconds()})
+			if err != nil {
+				return err
+			}
+			deleted += len(output.Hashes)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("rebalanced %d blocks over %d block stores: %d copied, %d of %d stale copies deleted",
+		len(holders), len(ring.Addrs), moved, deleted, staleCopies)
+	return nil
+}
+
+// copyBlock copies the block hash from the block store at from to the one at to
+func copyBlock(ctx context.Context, hash string, from string, to string) error {
+	var block *Block
+	err := callBlockStore(ctx, from, func(ctx context.Context, c BlockStoreClient) (err error) {
+		block, err = c.GetBlock(ctx, &BlockHash{Hash: hash})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// the block moves in the codec it is stored in
+	if _, err := openBlock(hash, block); err != nil {
+		return fmt.Errorf("block store %s holds corrupt data for block %s: %v", from, hash, err)
+	}
+	return callBlockStore(ctx, to, func(ctx context.Context, c BlockStoreClient) error {
+		_, err := c.PutBlock(ctx, block)
+		return err
+	})
+}
+
+func callBlockStore(ctx context.Context, addr string, call func(ctx context.Context, c BlockStoreClient) error) error {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, BLOCK_STORE_RPC_TIMEOUT)
+	defer cancel()
+	return call(ctx, NewBlockStoreClient(conn))
+}
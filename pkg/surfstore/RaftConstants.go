@@ -2,7 +2,68 @@ package surfstore
 
 import (
 	"fmt"
+	"time"
 )
 
 var ERR_SERVER_CRASHED = fmt.Errorf("Server is crashed.")
 var ERR_NOT_LEADER = fmt.Errorf("Server is not the leader")
+var ERR_CONFIG_CHANGE_PENDING = fmt.Errorf("Another membership change is in progress")
+var ERR_CATCHUP_TIMEOUT = fmt.Errorf("New server did not catch up with the log in time")
+var ERR_TRANSFER_IN_PROGRESS = fmt.Errorf("Leadership is being transferred")
+var ERR_TRANSFER_TIMEOUT = fmt.Errorf("Leadership transfer did not complete in time")
+
+// Election timeouts are drawn uniformly from [MIN, MAX) for every election round
+const DEFAULT_ELECTION_TIMEOUT_MIN time.Duration = 400 * time.Millisecond
+const DEFAULT_ELECTION_TIMEOUT_MAX time.Duration = 800 * time.Millisecond
+
+// How often the leader asserts its leadership with empty AppendEntries
+const DEFAULT_HEARTBEAT_INTERVAL time.Duration = 100 * time.Millisecond
+
+// Resolution of the election timer
+const ELECTION_TICK time.Duration = 10 * time.Millisecond
+
+// Leases end this fraction of the minimum election timeout early, to allow
+// for clocks that run at slightly different rates
+const DEFAULT_CLOCK_DRIFT_BOUND float64 = 0.1
+
+// Upper bound on a single raft RPC to a peer
+const RAFT_RPC_TIMEOUT time.Duration = 200 * time.Millisecond
+
+// Take a snapshot once this many applied entries or bytes of them are in the log
+const DEFAULT_SNAPSHOT_ENTRIES int64 = 1000
+const DEFAULT_SNAPSHOT_BYTES int64 = 4 << 20
+
+// Snapshots are sent to followers in chunks of this size
+const SNAPSHOT_CHUNK_SIZE int = 256 << 10
+
+// The most entries sent in one AppendEntries, and the most AppendEntries the
+// leader has on their way to a follower that keeps up
+const MAX_APPEND_BATCH int = 256
+const MAX_APPEND_INFLIGHT int = 4
+
+// Backoff between attempts to reconnect to a peer
+const PEER_RECONNECT_BASE_DELAY time.Duration = 50 * time.Millisecond
+const PEER_RECONNECT_MAX_DELAY time.Duration = time.Second
+
+// Config file entries starting with this name servers that join as learners
+const LEARNER_PREFIX string = "learner"
+
+// How long AddServer waits for a learner to catch up before giving up
+const LEARNER_CATCHUP_TIMEOUT time.Duration = 10 * time.Second
+
+// How often the leader collects unreferenced blocks, and how long a block
+// stays safe from that after it was last written or asked for
+const DEFAULT_GC_INTERVAL time.Duration = 10 * time.Minute
+const DEFAULT_GC_GRACE_PERIOD time.Duration = time.Hour
+
+// How often the leader checks it still is one while streaming changes
+const WATCH_LEADER_CHECK_INTERVAL time.Duration = 500 * time.Millisecond
+
+// votedFor value when the node has not voted in the current term
+const NOT_VOTED int64 = -1
+
+// leaderId value when the node doesn't know the leader of its term
+const UNKNOWN_LEADER int64 = -1
+
+// transferTarget value when no leadership transfer is going on
+const NO_TRANSFER int64 = -1
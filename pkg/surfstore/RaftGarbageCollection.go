@@ -0,0 +1,145 @@
+package surfstore
+
+import (
+	context "context"
+	"log"
+	"time"
+
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+/*
+	Garbage collection of blocks
+
+	Overwriting or deleting a file leaves its old blocks on the block stores.
+	The metastore keeps the latest versions of each file, once a version
+	drops out of that history nothing may refer to its blocks anymore. The
+	leader collects them with a mark and sweep:
+
+	1. List the blocks on every block store
+	2. Mark the blocks that the metastore, a version it keeps or an entry
+	not yet applied to it refers to
+	3. Ask each block store to delete the blocks it listed that aren't
+	marked
+
+	A client uploads blocks before the UpdateFile that refers to them, so a
+	block that isn't marked may still be about to become live. Block stores
+	remember when a block was last written or found by HasBlocks and only
+	delete blocks that weren't used within the grace period. Listing comes
+	before marking, so a block that became live in between is marked.
+*/
+
+// Deletes the blocks that no file refers to from the block stores and
+// returns their hashes
+func (s *RaftSurfstore) CollectGarbage(ctx context.Context, _ *emptypb.Empty) (*BlockHashes, error) {
+	if s.isCrashed {
+		return nil, ERR_SERVER_CRASHED
+	}
+
+	deleted, err := s.collectGarbage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockHashes{Hashes: deleted}, nil
+}
+
+// gcLoop collects garbage every GCInterval while we lead
+func (s *RaftSurfstore) gcLoop() {
+	if s.config.GCInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.config.GCInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.raftMutex.Lock()
+		isLeader := s.isLeader
+		s.raftMutex.Unlock()
+		if s.crashed() || !isLeader {
+			continue
+		}
+		if _, err := s.collectGarbage(context.Background()); err != nil {
+			log.Printf("server %d failed to collect garbage: %v", s.serverId, err)
+		}
+	}
+}
+
+func (s *RaftSurfstore) collectGarbage(ctx context.Context) ([]string, error) {
+	s.gcMutex.Lock()
+	defer s.gcMutex.Unlock()
+
+	s.raftMutex.Lock()
+	if !s.isLeader {
+		s.raftMutex.Unlock()
+		return nil, ERR_NOT_LEADER
+	}
+	addrs := s.metaStore.BlockStores.GetAddrs()
+	s.raftMutex.Unlock()
+
+	// block store -> blocks it holds, a block store we can't reach is left
+	// for the next collection
+	stored := make(map[string][]string)
+	for _, addr := range addrs {
+		err := callBlockStore(ctx, addr, func(ctx context.Context, c BlockStoreClient) error {
+			hashes, err := c.ListBlocks(ctx, &emptypb.Empty{})
+			if err != nil {
+				return err
+			}
+			stored[addr] = hashes.Hashes
+			return nil
+		})
+		if err != nil {
+			log.Printf("server %d skips block store %s in this collection: %v", s.serverId, addr, err)
+		}
+	}
+
+	s.raftMutex.Lock()
+	if !s.isLeader {
+		s.raftMutex.Unlock()
+		return nil, ERR_NOT_LEADER
+	}
+	live := s.referencedBlocks()
+	s.raftMutex.Unlock()
+
+	gracePeriodMs := s.config.GCGracePeriod.Milliseconds()
+	deleted := make([]string, 0)
+	for addr, hashes := range stored {
+		garbage := make([]string, 0)
+		for _, hash := range hashes {
+			if !live[hash] {
+				garbage = append(garbage, hash)
+			}
+		}
+		if len(garbage) == 0 {
+			continue
+		}
+		err := callBlockStore(ctx, addr, func(ctx context.Context, c BlockStoreClient) error {
+			output, err := c.DeleteUnusedBlocks(ctx, &UnusedBlocks{Hashes: garbage, GracePeriodMs: gracePeriodMs})
+			if err != nil {
+				return err
+			}
+			deleted = append(deleted, output.Hashes...)
+			return nil
+		})
+		if err != nil {
+			log.Printf("server %d failed to delete garbage on block store %s: %v", s.serverId, addr, err)
+		}
+	}
+
+	log.Printf("server %d collected %d unreferenced blocks from %d block stores", s.serverId, len(deleted), len(stored))
+	return deleted, nil
+}
+
+// referencedBlocks returns the hashes of every block a file refers to,
+// including files in entries that are not applied yet. Caller must hold
+// raftMutex.
+func (s *RaftSurfstore) referencedBlocks() map[string]bool {
+	live := make(map[string]bool)
+	s.metaStore.addReferencedBlocks(live)
+	for idx := s.lastApplied + 1; idx <= s.lastLogIndex(); idx++ {
+		if fileMetaData := s.entryAt(idx).FileMetaData; fileMetaData != nil {
+			addBlockHashes(fileMetaData, live)
+		}
+	}
+	return live
+}
@@ -9,6 +9,12 @@ type RaftInterface interface {
 	AppendEntries(ctx context.Context, input *AppendEntryInput) (*AppendEntryOutput, error)
 	SetLeader(ctx context.Context, _ *emptypb.Empty) (*Success, error)
 	SendHeartbeat(ctx context.Context, _ *emptypb.Empty) (*Success, error)
+	AddServer(ctx context.Context, member *RaftMember) (*Success, error)
+	RemoveServer(ctx context.Context, member *RaftMember) (*Success, error)
+	PromoteLearner(ctx context.Context, member *RaftMember) (*Success, error)
+	TransferLeadership(ctx context.Context, input *TransferLeadershipInput) (*Success, error)
+	AddBlockStore(ctx context.Context, blockStoreAddr *BlockStoreAddr) (*Success, error)
+	CollectGarbage(ctx context.Context, _ *emptypb.Empty) (*BlockHashes, error)
 }
 
 type RaftTestingInterface interface {
@@ -22,4 +28,7 @@ type RaftSurfstoreInterface interface {
 	MetaStoreInterface
 	RaftInterface
 	RaftTestingInterface
+
+	// Stream the committed file changes after the given log index
+	WatchChanges(input *WatchChangesInput, stream RaftSurfstore_WatchChangesServer) error
 }
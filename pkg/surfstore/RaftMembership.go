@@ -0,0 +1,316 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"log"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	Cluster membership
+
+	The set of servers is itself stored in the log: an entry with a config
+	replaces the whole membership, and every server uses the latest config in
+	its log as soon as it stores it, committed or not. Changes only add or
+	remove one server at a time and the leader waits for each one to commit
+	before accepting the next, so the majorities of the old and the new
+	configuration always overlap. A new leader also waits until an entry of
+	its own term is committed: a change an earlier leader left uncommitted
+	could otherwise still win over one it makes, and the two majorities
+	wouldn't overlap (the single-server change bug of §4.1).
+
+	A new server first joins as a learner: it receives the log like everyone
+	else but doesn't vote and isn't counted for commits, so a server that
+	starts out empty can't stall the cluster while it catches up. It is
+	promoted to a voter once its log is close to the leader's.
+
+	Servers can also stay learners, listed as such in the config file or
+	added with AddServer as one. They serve reads that tolerate staleness
+	and are warm standbys to promote with PromoteLearner when a voter is
+	lost.
+*/
+
+// configAt returns the configuration in effect at index, which comes from
+// the last config entry at or before it. Caller must hold raftMutex.
+func (s *RaftSurfstore) configAt(index int64) *ClusterConfig {
+	if index > s.lastLogIndex() {
+		index = s.lastLogIndex()
+	}
+	for idx := index; idx > s.snapshotIndex; idx-- {
+		if config := s.entryAt(idx).Config; config != nil {
+			return config
+		}
+	}
+	return s.snapshotConfig
+}
+
+// refreshMembers switches to the latest configuration in the log and, on the
+// leader, starts or stops tracking replication for the servers that joined
+// or left. Caller must hold raftMutex.
+func (s *RaftSurfstore) refreshMembers() {
+	s.members = s.configAt(s.lastLogIndex())
+	s.closeStaleClients()
+	if !s.isLeader {
+		return
+	}
+	current := make(map[int64]bool)
+	for _, peer := range s.peers() {
+		current[peer.ServerId] = true
+		if _, ok := s.nextIndex[peer.ServerId]; !ok {
+			s.nextIndex[peer.ServerId] = s.lastLogIndex() + 1
+			s.matchIndex[peer.ServerId] = -1
+		}
+	}
+	for id := range s.nextIndex {
+		if !current[id] {
+			delete(s.nextIndex, id)
+			delete(s.matchIndex, id)
+		}
+	}
+	s.startReplicators()
+}
+
+// Caller must hold raftMutex
+func (s *RaftSurfstore) member(serverId int64) *RaftMember {
+	for _, member := range s.members.GetMembers() {
+		if member.ServerId == serverId {
+			return member
+		}
+	}
+	return nil
+}
+
+// Caller must hold raftMutex
+func (s *RaftSurfstore) isVoter(serverId int64) bool {
+	member := s.member(serverId)
+	return member != nil && !member.Learner
+}
+
+// peers returns every other server in the configuration, learners included.
+// Caller must hold raftMutex.
+func (s *RaftSurfstore) peers() []*RaftMember {
+	peers := make([]*RaftMember, 0, len(s.members.GetMembers()))
+	for _, member := range s.members.GetMembers() {
+		if member.ServerId != s.serverId {
+			peers = append(peers, member)
+		}
+	}
+	return peers
+}
+
+// isQuorum reports whether the voters in agreed make up a majority of the
+// voters of the configuration. Caller must hold raftMutex.
+func (s *RaftSurfstore) isQuorum(agreed func(serverId int64) bool) bool {
+	voters, count := 0, 0
+	for _, member := range s.members.GetMembers() {
+		if member.Learner {
+			continue
+		}
+		voters++
+		if agreed(member.ServerId) {
+			count++
+		}
+	}
+	return voters > 0 && count > voters/2
+}
+
+// hasUncommittedConfig reports whether a configuration change is still on
+// its way to being committed. Caller must hold raftMutex.
+func (s *RaftSurfstore) hasUncommittedConfig() bool {
+	for idx := s.lastLogIndex(); idx > s.commitIndex && idx > s.snapshotIndex; idx-- {
+		if s.entryAt(idx).Config != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds a server to the cluster. It joins as a learner, gets the log, and
+// becomes a voter once it has caught up with the commit index, unless it is
+// added as a learner. Calling it again for a server that is still a learner
+// resumes the promotion.
+func (s *RaftSurfstore) AddServer(ctx context.Context, newMember *RaftMember) (*Success, error) {
+	if s.isCrashed {
+		return &Success{Flag: false}, ERR_SERVER_CRASHED
+	}
+
+	err := s.changeMembers(ctx, func(member *RaftMember) (*RaftMember, error) {
+		if member != nil {
+			if member.Addr != newMember.Addr {
+				return nil, fmt.Errorf("server %d is already a member at %s", member.ServerId, member.Addr)
+			}
+			return member, nil
+		}
+		return &RaftMember{ServerId: newMember.ServerId, Addr: newMember.Addr, Learner: true}, nil
+	}, newMember.ServerId)
+	if err != nil {
+		return &Success{Flag: false}, err
+	}
+	if !newMember.Learner {
+		if err := s.promote(ctx, newMember.ServerId); err != nil {
+			return &Success{Flag: false}, err
+		}
+	}
+
+	log.Printf("server %d added server %d at %s", s.serverId, newMember.ServerId, newMember.Addr)
+	return &Success{Flag: true}, nil
+}
+
+// Turns a learner into a voter once it has caught up with the commit index.
+// Promoting a voter does nothing.
+func (s *RaftSurfstore) PromoteLearner(ctx context.Context, learner *RaftMember) (*Success, error) {
+	if s.isCrashed {
+		return &Success{Flag: false}, ERR_SERVER_CRASHED
+	}
+
+	if err := s.promote(ctx, learner.ServerId); err != nil {
+		return &Success{Flag: false}, err
+	}
+
+	log.Printf("server %d promoted server %d to voter", s.serverId, learner.ServerId)
+	return &Success{Flag: true}, nil
+}
+
+// promote waits for the learner serverId to catch up and makes it a voter
+func (s *RaftSurfstore) promote(ctx context.Context, serverId int64) error {
+	s.raftMutex.Lock()
+	member := s.member(serverId)
+	s.raftMutex.Unlock()
+	if member == nil {
+		return fmt.Errorf("server %d is not a member of the cluster", serverId)
+	}
+	if !member.Learner {
+		return nil
+	}
+
+	if err := s.awaitCatchUp(ctx, serverId); err != nil {
+		return err
+	}
+
+	return s.changeMembers(ctx, func(member *RaftMember) (*RaftMember, error) {
+		if member == nil {
+			return nil, fmt.Errorf("server %d was removed while being promoted", serverId)
+		}
+		return &RaftMember{ServerId: member.ServerId, Addr: member.Addr, Learner: false}, nil
+	}, serverId)
+}
+
+// Removes a server from the cluster. A leader that removes itself steps down
+// once the change is committed.
+func (s *RaftSurfstore) RemoveServer(ctx context.Context, oldMember *RaftMember) (*Success, error) {
+	if s.isCrashed {
+		return &Success{Flag: false}, ERR_SERVER_CRASHED
+	}
+
+	err := s.changeMembers(ctx, func(member *RaftMember) (*RaftMember, error) {
+		if member == nil {
+			return nil, fmt.Errorf("server %d is not a member of the cluster", oldMember.ServerId)
+		}
+		return nil, nil
+	}, oldMember.ServerId)
+	if err != nil {
+		return &Success{Flag: false}, err
+	}
+
+	log.Printf("server %d removed server %d", s.serverId, oldMember.ServerId)
+	return &Success{Flag: true}, nil
+}
+
+// changeMembers replaces the member serverId (nil if it isn't one) with what
+// change returns (nil to remove it), appends the new configuration to the
+// log and waits until it is committed. Nothing is appended if the member
+// stays the same.
+func (s *RaftSurfstore) changeMembers(ctx context.Context, change func(member *RaftMember) (*RaftMember, error), serverId int64) error {
+	if err := s.awaitCurrentTermCommit(ctx); err != nil {
+		return err
+	}
+
+	s.raftMutex.Lock()
+	if !s.isLeader {
+		s.raftMutex.Unlock()
+		return ERR_NOT_LEADER
+	}
+	if s.hasUncommittedConfig() || s.termAt(s.commitIndex) != s.term {
+		s.raftMutex.Unlock()
+		return ERR_CONFIG_CHANGE_PENDING
+	}
+	if s.transferTarget != NO_TRANSFER {
+		s.raftMutex.Unlock()
+		return ERR_TRANSFER_IN_PROGRESS
+	}
+
+	current := s.member(serverId)
+	updated, err := change(current)
+	if err != nil {
+		s.raftMutex.Unlock()
+		return err
+	}
+	if current != nil && updated != nil && proto.Equal(current, updated) {
+		s.raftMutex.Unlock()
+		return nil
+	}
+
+	config := &ClusterConfig{}
+	voters := 0
+	for _, member := range s.members.GetMembers() {
+		if member.ServerId == serverId {
+			continue
+		}
+		config.Members = append(config.Members, member)
+		if !member.Learner {
+			voters++
+		}
+	}
+	if updated != nil {
+		config.Members = append(config.Members, updated)
+		if !updated.Learner {
+			voters++
+		}
+	}
+	if voters == 0 {
+		s.raftMutex.Unlock()
+		return fmt.Errorf("the cluster needs at least one voting member")
+	}
+
+	index, committed := s.appendEntry(&UpdateOperation{
+		Term:   s.term,
+		Config: config,
+	})
+	s.raftMutex.Unlock()
+
+	_, err = s.awaitCommit(ctx, index, committed)
+	return err
+}
+
+// awaitCatchUp waits until the learner serverId holds every committed entry,
+// giving up after LEARNER_CATCHUP_TIMEOUT
+func (s *RaftSurfstore) awaitCatchUp(ctx context.Context, serverId int64) error {
+	ticker := time.NewTicker(s.config.HeartbeatInterval)
+	defer ticker.Stop()
+	timeout := time.After(LEARNER_CATCHUP_TIMEOUT)
+
+	for {
+		s.raftMutex.Lock()
+		if !s.isLeader {
+			s.raftMutex.Unlock()
+			return ERR_NOT_LEADER
+		}
+		match, ok := s.matchIndex[serverId]
+		caughtUp := ok && match >= s.commitIndex
+		s.raftMutex.Unlock()
+		if caughtUp {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			return ERR_CATCHUP_TIMEOUT
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
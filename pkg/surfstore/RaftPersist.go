@@ -0,0 +1,354 @@
+package surfstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	Write-ahead log for the durable raft state
+
+	Every record is framed as
+
+		| payload length (uint32) | crc32c of payload (uint32) | payload |
+
+	and the payload starts with a one byte record type. Records are only
+	appended and every append is fsync'd before we answer the RPC that caused
+	it, so on restart replaying the file front to back rebuilds term,
+	votedFor, the log and the last known commit index. A crash in the middle
+	of an append leaves a torn record at the tail, which is cut off on replay.
+
+	Once a snapshot is taken the entries it covers are dropped by rewriting
+	the log into a new file that replaces the old one. The snapshot itself is
+	a serialized RaftSnapshot in its own file next to the log.
+*/
+
+const (
+	// term and votedFor changed
+	WAL_RECORD_STATE byte = 1
+	// one log entry stored at the given index, anything after it is gone
+	WAL_RECORD_ENTRY byte = 2
+	// commit index advanced, entries up to it can be applied on replay
+	WAL_RECORD_COMMIT byte = 3
+)
+
+const WAL_HEADER_SIZE int = 8
+
+// Records bigger than this can only be garbage from a torn write
+const WAL_MAX_RECORD_SIZE uint32 = 64 << 20
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+type raftWAL struct {
+	file *os.File
+	path string
+}
+
+// walState is the raft state rebuilt from the write-ahead log
+type walState struct {
+	term     int64
+	votedFor int64
+	// log holds the entries from firstIndex on
+	firstIndex  int64
+	log         []*UpdateOperation
+	commitIndex int64
+}
+
+func raftWALPath(dataDir string, serverId int64) string {
+	return filepath.Join(dataDir, fmt.Sprintf("raft_%d.wal", serverId))
+}
+
+func raftSnapshotPath(dataDir string, serverId int64) string {
+	return filepath.Join(dataDir, fmt.Sprintf("raft_%d.snapshot", serverId))
+}
+
+// openRaftWAL opens (or creates) the write-ahead log of serverId in dataDir
+// and replays the entries from firstIndex on, anything before is covered by
+// a snapshot. A torn record at the end of the file is truncated away.
+func openRaftWAL(dataDir string, serverId int64, firstIndex int64) (*raftWAL, *walState, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, nil, err
+	}
+	path := raftWALPath(dataDir, serverId)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := syncDir(dataDir); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	state, validSize, err := replayRaftWAL(file, firstIndex)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if info.Size() > validSize {
+		log.Printf("truncating torn tail of %s from %d to %d bytes", path, info.Size(), validSize)
+		if err := file.Truncate(validSize); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+	}
+	if _, err := file.Seek(validSize, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return &raftWAL{file: file, path: path}, state, nil
+}
+
+// replayRaftWAL reads records until the end of the file or the first record
+// that is incomplete or fails its checksum, returning the state they describe
+// and the size of the valid prefix of the file
+func replayRaftWAL(file *os.File, firstIndex int64) (*walState, int64, error) {
+	state := &walState{
+		term:        0,
+		votedFor:    NOT_VOTED,
+		firstIndex:  firstIndex,
+		log:         make([]*UpdateOperation, 0),
+		commitIndex: firstIndex - 1,
+	}
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, WAL_HEADER_SIZE)
+	var validSize int64
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			// clean EOF or a torn header
+			return state, validSize, nil
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if size == 0 || size > WAL_MAX_RECORD_SIZE {
+			return state, validSize, nil
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return state, validSize, nil
+		}
+		if crc32.Checksum(payload, walCRCTable) != checksum {
+			return state, validSize, nil
+		}
+		if err := state.apply(payload); err != nil {
+			return nil, 0, fmt.Errorf("corrupted write-ahead log record at offset %d: %v", validSize, err)
+		}
+		validSize += int64(WAL_HEADER_SIZE) + int64(size)
+	}
+}
+
+func (state *walState) apply(payload []byte) error {
+	body := payload[1:]
+	switch payload[0] {
+	case WAL_RECORD_STATE:
+		term, n := binary.Varint(body)
+		if n <= 0 {
+			return fmt.Errorf("bad state record")
+		}
+		votedFor, m := binary.Varint(body[n:])
+		if m <= 0 {
+			return fmt.Errorf("bad state record")
+		}
+		state.term = term
+		state.votedFor = votedFor
+	case WAL_RECORD_ENTRY:
+		index, n := binary.Varint(body)
+		position := index - state.firstIndex
+		if n <= 0 || position > int64(len(state.log)) {
+			return fmt.Errorf("bad entry record")
+		}
+		if position < 0 {
+			// left over from before the last snapshot
+			return nil
+		}
+		entry := &UpdateOperation{}
+		if err := proto.Unmarshal(body[n:], entry); err != nil {
+			return err
+		}
+		state.log = append(state.log[:position], entry)
+	case WAL_RECORD_COMMIT:
+		commitIndex, n := binary.Varint(body)
+		if n <= 0 {
+			return fmt.Errorf("bad commit record")
+		}
+		if commitIndex > state.commitIndex {
+			state.commitIndex = commitIndex
+		}
+	default:
+		return fmt.Errorf("unknown record type %d", payload[0])
+	}
+	return nil
+}
+
+// saveState records a new term or vote
+func (w *raftWAL) saveState(term, votedFor int64) error {
+	if w == nil {
+		return nil
+	}
+	body := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutVarint(body, term)
+	n += binary.PutVarint(body[n:], votedFor)
+	return w.write(walRecord(WAL_RECORD_STATE, body[:n]))
+}
+
+// saveEntries records entries stored from startIndex on, dropping whatever
+// the log held at and after startIndex
+func (w *raftWAL) saveEntries(startIndex int64, entries []*UpdateOperation) error {
+	if w == nil || len(entries) == 0 {
+		return nil
+	}
+	var records []byte
+	for i, entry := range entries {
+		data, err := proto.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		body := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(data))
+		n := binary.PutVarint(body, startIndex+int64(i))
+		records = append(records, walRecord(WAL_RECORD_ENTRY, append(body[:n], data...))...)
+	}
+	return w.write(records)
+}
+
+// saveCommitIndex records that everything up to commitIndex is committed
+func (w *raftWAL) saveCommitIndex(commitIndex int64) error {
+	if w == nil {
+		return nil
+	}
+	body := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(body, commitIndex)
+	return w.write(walRecord(WAL_RECORD_COMMIT, body[:n]))
+}
+
+// rewrite replaces the whole log with one holding only the given state,
+// which is how entries covered by a snapshot are dropped. The new log is
+// written next to the old one and renamed over it, so a crash leaves either
+// of them intact.
+func (w *raftWAL) rewrite(term, votedFor, firstIndex int64, entries []*UpdateOperation, commitIndex int64) error {
+	if w == nil {
+		return nil
+	}
+	tmpPath := w.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	newWAL := &raftWAL{file: tmp, path: w.path}
+	if err := newWAL.saveState(term, votedFor); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := newWAL.saveEntries(firstIndex, entries); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := newWAL.saveCommitIndex(commitIndex); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmpPath, w.path); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := syncDir(filepath.Dir(w.path)); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	w.file.Close()
+	w.file = tmp
+	return nil
+}
+
+func (w *raftWAL) write(records []byte) error {
+	if _, err := w.file.Write(records); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+func (w *raftWAL) Close() error {
+	if w == nil {
+		return nil
+	}
+	return w.file.Close()
+}
+
+func walRecord(recordType byte, body []byte) []byte {
+	payload := append([]byte{recordType}, body...)
+	record := make([]byte, WAL_HEADER_SIZE, WAL_HEADER_SIZE+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, walCRCTable))
+	return append(record, payload...)
+}
+
+// syncDir makes a newly created file in dir survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// saveRaftSnapshot durably replaces the snapshot of serverId in dataDir
+func saveRaftSnapshot(dataDir string, serverId int64, data []byte) error {
+	path := raftSnapshotPath(dataDir, serverId)
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(dataDir)
+}
+
+// loadRaftSnapshot reads the snapshot of serverId in dataDir, returning nil
+// if none was taken yet
+func loadRaftSnapshot(dataDir string, serverId int64) (*RaftSnapshot, []byte, error) {
+	data, err := os.ReadFile(raftSnapshotPath(dataDir, serverId))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshot := &RaftSnapshot{}
+	if err := proto.Unmarshal(data, snapshot); err != nil {
+		return nil, nil, err
+	}
+	return snapshot, data, nil
+}
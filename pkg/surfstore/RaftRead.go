@@ -0,0 +1,112 @@
+package surfstore
+
+import (
+	context "context"
+	"time"
+)
+
+/*
+	Linearizable reads
+
+	A leader can't answer reads from its metastore just because it believes
+	it is the leader: a newer leader may have been elected behind its back and
+	committed updates it hasn't seen. Before a read the leader
+	(§6.4 of the Raft thesis)
+
+	1. makes sure an entry of its own term is committed, so its commit index
+	   covers everything earlier leaders committed
+	2. remembers the commit index as the read index
+	3. checks it is still the leader by getting a round of AppendEntries
+	   acknowledged by a majority
+	4. answers once the read index is applied
+
+	With leases enabled step 3 is skipped while the majority acknowledged
+	AppendEntries recently enough that none of them can have voted for
+	another candidate yet, which trades a round trip for a bound on how far
+	the clocks of the servers drift apart. Voters do vote for the server a
+	leadership transfer hands over to, so there is no lease from the moment
+	the leader sends TimeoutNow until that server's election is surely over.
+*/
+
+// readBarrier returns once the metastore reflects every update committed
+// before the call, or an error if this node can't prove it is the leader
+func (s *RaftSurfstore) readBarrier(ctx context.Context) error {
+	if err := s.awaitCurrentTermCommit(ctx); err != nil {
+		return err
+	}
+
+	s.raftMutex.Lock()
+	if !s.isLeader {
+		s.raftMutex.Unlock()
+		return ERR_NOT_LEADER
+	}
+	term := s.term
+	leased := s.config.LeaseReads && s.transferTarget == NO_TRANSFER && s.holdsLease()
+	s.raftMutex.Unlock()
+
+	if !leased {
+		start := time.Now()
+		s.broadcastAppendEntries()
+
+		s.raftMutex.Lock()
+		confirmed := s.isLeader && s.term == term && s.isQuorum(func(serverId int64) bool {
+			return serverId == s.serverId || !s.lastAck[serverId].Before(start)
+		})
+		s.raftMutex.Unlock()
+		if !confirmed {
+			return ERR_NOT_LEADER
+		}
+	}
+
+	// the leader applies entries in the same step that commits them, so
+	// everything up to the commit index we started from is applied
+	return nil
+}
+
+// awaitCurrentTermCommit waits until an entry of the leader's term is
+// committed, appending a no-op entry if it has none yet (§6.4 step 1)
+func (s *RaftSurfstore) awaitCurrentTermCommit(ctx context.Context) error {
+	ticker := time.NewTicker(ELECTION_TICK)
+	defer ticker.Stop()
+
+	for {
+		s.raftMutex.Lock()
+		if !s.isLeader {
+			s.raftMutex.Unlock()
+			return ERR_NOT_LEADER
+		}
+		if s.termAt(s.commitIndex) == s.term {
+			s.raftMutex.Unlock()
+			return nil
+		}
+		if s.lastLogTerm() != s.term {
+			s.storeEntries(s.lastLogIndex()+1, &UpdateOperation{Term: s.term})
+			s.notifyReplicators()
+		}
+		s.raftMutex.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// holdsLease reports whether a majority acknowledged AppendEntries sent
+// recently enough that they still refuse to vote for anyone else. A voter
+// ignores candidates for ElectionTimeoutMin after hearing from the leader,
+// the lease ends earlier by the clock drift bound so a fast clock on the
+// voter's side can't outrun it. Acknowledgements of AppendEntries sent
+// before leaseFloor don't count. Caller must hold raftMutex.
+func (s *RaftSurfstore) holdsLease() bool {
+	lease := time.Duration(float64(s.config.ElectionTimeoutMin) * (1 - s.config.ClockDriftBound))
+	now := time.Now()
+	return s.isQuorum(func(serverId int64) bool {
+		if serverId == s.serverId {
+			return true
+		}
+		sent := s.lastAck[serverId]
+		return !sent.Before(s.leaseFloor) && now.Before(sent.Add(lease))
+	})
+}
@@ -0,0 +1,394 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"sync"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+)
+
+/*
+	Log replication
+
+	The leader runs one replicator per peer for its term. UpdateFile only
+	appends to the log and wakes the replicators, which send whatever their
+	peer is missing in batches of up to MAX_APPEND_BATCH entries, so the
+	entries of concurrent calls travel in the same AppendEntries.
+
+	While a peer keeps up its replicator moves nextIndex past the entries it
+	sent without waiting for the answer, keeping up to MAX_APPEND_INFLIGHT
+	requests in flight. A rejected or failed request puts the peer back into
+	probing: one request at a time from nextIndex until one succeeds.
+
+	broadcastAppendEntries is the synchronous round used for heartbeats and
+	wherever the caller needs to know the round is over.
+
+	Connections to the other servers are dialed once and kept while they
+	are members.
+*/
+
+// replicator is the leader's state for pipelining entries to one peer.
+// Fields other than the channels are protected by raftMutex.
+type replicator struct {
+	// wakes the goroutine sending to the peer
+	notify chan struct{}
+	// closed when the leader steps down or the peer leaves the cluster
+	stop chan struct{}
+
+	inflight     int
+	probing      bool
+	snapshotting bool
+	// the last request failed to reach the peer
+	unreachable bool
+}
+
+func (r *replicator) wake() {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// peerConn is the connection to another server
+type peerConn struct {
+	addr   string
+	conn   *grpc.ClientConn
+	client RaftSurfstoreClient
+}
+
+// startReplicators starts replicating to peers that just joined and stops
+// for those that left. Caller must hold raftMutex.
+func (s *RaftSurfstore) startReplicators() {
+	current := make(map[int64]bool)
+	for _, peer := range s.peers() {
+		current[peer.ServerId] = true
+		if _, ok := s.replicators[peer.ServerId]; ok {
+			continue
+		}
+		r := &replicator{
+			notify:  make(chan struct{}, 1),
+			stop:    make(chan struct{}),
+			probing: true,
+		}
+		s.replicators[peer.ServerId] = r
+		s.peerCommit[peer.ServerId] = -1
+		go s.runReplicator(peer.ServerId, s.term, r)
+	}
+	for serverId, r := range s.replicators {
+		if !current[serverId] {
+			close(r.stop)
+			delete(s.replicators, serverId)
+		}
+	}
+}
+
+// Caller must hold raftMutex
+func (s *RaftSurfstore) stopReplicators() {
+	for serverId, r := range s.replicators {
+		close(r.stop)
+		delete(s.replicators, serverId)
+	}
+}
+
+// notifyReplicators tells every replicator there may be something new to
+// send. Caller must hold raftMutex.
+func (s *RaftSurfstore) notifyReplicators() {
+	for _, r := range s.replicators {
+		r.wake()
+	}
+}
+
+func (s *RaftSurfstore) runReplicator(serverId int64, term int64, r *replicator) {
+	for {
+		select {
+		case <-r.notify:
+		case <-r.stop:
+			return
+		}
+		for s.sendPipelined(serverId, term, r) {
+		}
+	}
+}
+
+// sendPipelined sends serverId its next batch of entries, or the new commit
+// index if it has every entry, without waiting for the answer. Returns
+// whether another request may follow right away.
+func (s *RaftSurfstore) sendPipelined(serverId int64, term int64, r *replicator) bool {
+	s.raftMutex.Lock()
+	defer s.raftMutex.Unlock()
+
+	if !s.isLeader || s.term != term || r.snapshotting {
+		return false
+	}
+	if r.inflight >= MAX_APPEND_INFLIGHT || (r.probing && r.inflight > 0) {
+		return false
+	}
+	next := s.nextIndex[serverId]
+	if next <= s.snapshotIndex {
+		// the entries it needs are compacted away
+		r.snapshotting = true
+		go func() {
+			s.sendSnapshot(serverId, term)
+			s.raftMutex.Lock()
+			r.snapshotting = false
+			s.raftMutex.Unlock()
+			r.wake()
+		}()
+		return false
+	}
+	if next > s.lastLogIndex() && (r.inflight > 0 || s.peerCommit[serverId] >= s.commitIndex) {
+		return false
+	}
+
+	input := s.appendEntriesInput(term, next)
+	r.inflight++
+	if !r.probing {
+		s.nextIndex[serverId] = next + int64(len(input.Entries))
+	}
+	go func() {
+		sent := time.Now()
+		output, err := s.sendAppendEntries(serverId, input)
+
+		s.raftMutex.Lock()
+		r.inflight--
+		s.handleAppendEntriesOutput(serverId, term, r, input, output, err, sent)
+		s.raftMutex.Unlock()
+		if err == nil {
+			// a peer that can't be reached is retried with the next
+			// update or heartbeat rather than in a busy loop
+			r.wake()
+		}
+	}()
+	return !r.probing && len(input.Entries) > 0
+}
+
+// broadcastAppendEntries sends one round of AppendEntries to every peer,
+// carrying the entries each peer is missing from its nextIndex on, and waits
+// for the answers. Returns false if the node was not the leader.
+func (s *RaftSurfstore) broadcastAppendEntries() bool {
+	s.raftMutex.Lock()
+	if !s.isLeader {
+		s.raftMutex.Unlock()
+		return false
+	}
+	term := s.term
+	peers := s.peers()
+	s.raftMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(serverId int64) {
+			defer wg.Done()
+			s.replicateTo(serverId, term)
+		}(peer.ServerId)
+	}
+	wg.Wait()
+
+	return true
+}
+
+// replicateTo sends AppendEntries for term to serverId starting at its
+// nextIndex, backing nextIndex off until the logs match (§5.3), until the
+// follower holds our whole log or a request fails
+func (s *RaftSurfstore) replicateTo(serverId int64, term int64) {
+	for {
+		s.raftMutex.Lock()
+		next, ok := s.nextIndex[serverId]
+		if !s.isLeader || s.term != term || !ok {
+			s.raftMutex.Unlock()
+			return
+		}
+		r := s.replicators[serverId]
+		if r != nil && r.inflight > 0 {
+			// entries past the last match may still be on their way, start
+			// from what is known to match so this round doesn't get rejected
+			next = s.matchIndex[serverId] + 1
+		}
+		if next <= s.snapshotIndex {
+			s.raftMutex.Unlock()
+			if !s.sendSnapshot(serverId, term) {
+				return
+			}
+			continue
+		}
+		input := s.appendEntriesInput(term, next)
+		s.raftMutex.Unlock()
+
+		sent := time.Now()
+		output, err := s.sendAppendEntries(serverId, input)
+
+		s.raftMutex.Lock()
+		rejected := s.handleAppendEntriesOutput(serverId, term, r, input, output, err, sent)
+		more := err == nil && output.Success && input.PrevLogIndex+int64(len(input.Entries)) < s.lastLogIndex()
+		s.raftMutex.Unlock()
+		if !rejected && !more {
+			return
+		}
+	}
+}
+
+// appendEntriesInput builds the AppendEntries carrying the entries from next
+// on, at most MAX_APPEND_BATCH of them. Caller must hold raftMutex.
+func (s *RaftSurfstore) appendEntriesInput(term int64, next int64) *AppendEntryInput {
+	entries := s.entriesFrom(next)
+	if len(entries) > MAX_APPEND_BATCH {
+		entries = entries[:MAX_APPEND_BATCH]
+	}
+	return &AppendEntryInput{
+		Term:         term,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  s.termAt(next - 1),
+		Entries:      append([]*UpdateOperation(nil), entries...),
+		LeaderCommit: s.commitIndex,
+		LeaderId:     s.serverId,
+	}
+}
+
+// handleAppendEntriesOutput records the answer of serverId to input, sent at
+// sent: how far its log matches ours, or where to retry if it was rejected
+// because of a log mismatch, in which case it returns true. r is nil if
+// nothing is being pipelined to the peer. Caller must hold raftMutex.
+func (s *RaftSurfstore) handleAppendEntriesOutput(serverId int64, term int64, r *replicator,
+	input *AppendEntryInput, output *AppendEntryOutput, err error, sent time.Time) bool {
+	if err == nil && output.Term > s.term {
+		s.becomeFollower(output.Term)
+		s.resetElectionTimer()
+		return false
+	}
+	if _, ok := s.nextIndex[serverId]; !s.isLeader || s.term != term || !ok {
+		return false
+	}
+	if r == nil {
+		r = &replicator{}
+	}
+
+	if err != nil {
+		// whatever we pipelined after the last match may be lost with it
+		r.unreachable = true
+		if !r.probing {
+			r.probing = true
+			s.nextIndex[serverId] = s.matchIndex[serverId] + 1
+		}
+		return false
+	}
+	r.unreachable = false
+	if sent.After(s.lastAck[serverId]) {
+		s.lastAck[serverId] = sent
+	}
+
+	if output.Success {
+		matched := input.PrevLogIndex + int64(len(input.Entries))
+		if matched > s.matchIndex[serverId] {
+			s.matchIndex[serverId] = matched
+		}
+		if matched+1 > s.nextIndex[serverId] {
+			s.nextIndex[serverId] = matched + 1
+		}
+		learned := input.LeaderCommit
+		if matched < learned {
+			learned = matched
+		}
+		if learned > s.peerCommit[serverId] {
+			s.peerCommit[serverId] = learned
+		}
+		r.probing = false
+		// a peer that was unreachable may have fallen behind the pipeline
+		r.wake()
+		s.advanceCommitIndex()
+		return false
+	}
+
+	// retry from the hint, but never behind what is known to match
+	next := s.nextIndexAfterConflict(output)
+	if next > s.nextIndex[serverId] {
+		next = s.nextIndex[serverId]
+	}
+	if next <= s.matchIndex[serverId] {
+		next = s.matchIndex[serverId] + 1
+	}
+	s.nextIndex[serverId] = next
+	r.probing = true
+	return true
+}
+
+// nextIndexAfterConflict uses a follower's conflict hint to pick the next
+// index to try: right after our last entry of the conflicting term if we
+// have that term, else the first index the follower holds for it.
+// Caller must hold raftMutex.
+func (s *RaftSurfstore) nextIndexAfterConflict(output *AppendEntryOutput) int64 {
+	if output.ConflictTerm != -1 {
+		for idx := s.lastLogIndex(); idx > s.snapshotIndex; idx-- {
+			if s.termAt(idx) == output.ConflictTerm {
+				return idx + 1
+			}
+			if s.termAt(idx) < output.ConflictTerm {
+				break
+			}
+		}
+	}
+	if output.ConflictIndex < 0 {
+		return 0
+	}
+	return output.ConflictIndex
+}
+
+// raftClient returns the connection to serverId, dialing it on first use
+func (s *RaftSurfstore) raftClient(serverId int64) (RaftSurfstoreClient, error) {
+	s.raftMutex.Lock()
+	defer s.raftMutex.Unlock()
+
+	member := s.member(serverId)
+	if member == nil {
+		return nil, fmt.Errorf("server %d is not a member of the cluster", serverId)
+	}
+	if peer, ok := s.rpcClients[serverId]; ok {
+		if peer.addr == member.Addr {
+			return peer.client, nil
+		}
+		peer.conn.Close()
+		delete(s.rpcClients, serverId)
+	}
+
+	// reconnect quickly to a server that comes back after a crash
+	conn, err := grpc.Dial(member.Addr, grpc.WithInsecure(), grpc.WithConnectParams(grpc.ConnectParams{
+		Backoff: backoff.Config{
+			BaseDelay:  PEER_RECONNECT_BASE_DELAY,
+			Multiplier: backoff.DefaultConfig.Multiplier,
+			Jitter:     backoff.DefaultConfig.Jitter,
+			MaxDelay:   PEER_RECONNECT_MAX_DELAY,
+		},
+		MinConnectTimeout: RAFT_RPC_TIMEOUT,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	client := NewRaftSurfstoreClient(conn)
+	s.rpcClients[serverId] = &peerConn{addr: member.Addr, conn: conn, client: client}
+	return client, nil
+}
+
+// closeStaleClients drops the connections to servers that left the cluster.
+// Caller must hold raftMutex.
+func (s *RaftSurfstore) closeStaleClients() {
+	for serverId, peer := range s.rpcClients {
+		if s.member(serverId) == nil {
+			peer.conn.Close()
+			delete(s.rpcClients, serverId)
+		}
+	}
+}
+
+func (s *RaftSurfstore) sendAppendEntries(serverId int64, input *AppendEntryInput) (*AppendEntryOutput, error) {
+	client, err := s.raftClient(serverId)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RAFT_RPC_TIMEOUT)
+	defer cancel()
+	return client.AppendEntries(ctx, input)
+}
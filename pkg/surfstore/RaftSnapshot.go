@@ -0,0 +1,220 @@
+package surfstore
+
+import (
+	context "context"
+	"log"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// maybeSnapshot compacts the log once the applied entries not yet covered
+// by a snapshot pass either of the configured thresholds.
+// Caller must hold raftMutex.
+func (s *RaftSurfstore) maybeSnapshot() {
+	uncompacted := s.lastApplied - s.snapshotIndex
+	if uncompacted <= 0 {
+		return
+	}
+	due := s.config.SnapshotEntries > 0 && uncompacted >= s.config.SnapshotEntries
+	if !due && s.config.SnapshotBytes > 0 {
+		var size int64
+		for idx := s.snapshotIndex + 1; idx <= s.lastApplied; idx++ {
+			size += int64(proto.Size(s.entryAt(idx)))
+		}
+		due = size >= s.config.SnapshotBytes
+	}
+	if due {
+		s.takeSnapshot()
+	}
+}
+
+// takeSnapshot captures the metastore, the block stores, the file history
+// and the cluster configuration as of lastApplied, and drops the log entries
+// it covers. Caller must hold raftMutex.
+func (s *RaftSurfstore) takeSnapshot() {
+	snapshot := &RaftSnapshot{
+		LastIncludedIndex: s.lastApplied,
+		LastIncludedTerm:  s.termAt(s.lastApplied),
+		Config:            s.configAt(s.lastApplied),
+	}
+	s.metaStore.snapshotInto(snapshot)
+	data, err := proto.Marshal(snapshot)
+	if err != nil {
+		log.Println("Error taking snapshot: ", err)
+		return
+	}
+
+	remaining := append([]*UpdateOperation(nil), s.entriesFrom(snapshot.LastIncludedIndex+1)...)
+	s.log = remaining
+	s.snapshotIndex = snapshot.LastIncludedIndex
+	s.snapshotTerm = snapshot.LastIncludedTerm
+	s.snapshotData = data
+	s.snapshotConfig = snapshot.Config
+	s.persistSnapshot()
+
+	log.Printf("server %d took a snapshot at index %d (%d bytes)", s.serverId, s.snapshotIndex, len(data))
+}
+
+// installSnapshot replaces our state with a snapshot received from the
+// leader, keeping any log entries after it. Caller must hold raftMutex.
+func (s *RaftSurfstore) installSnapshot(snapshot *RaftSnapshot, data []byte) {
+	s.snapshotIndex = snapshot.LastIncludedIndex
+	s.snapshotTerm = snapshot.LastIncludedTerm
+	s.snapshotData = data
+	s.metaStore.restore(snapshot.GetMetaMap().GetFileInfoMap(), snapshot.History, snapshot.BlockStores, snapshot.LastIncludedIndex)
+	if s.commitIndex < s.snapshotIndex {
+		s.commitIndex = s.snapshotIndex
+	}
+	s.lastApplied = s.snapshotIndex
+	if snapshot.Config != nil {
+		s.snapshotConfig = snapshot.Config
+	}
+	s.refreshMembers()
+	s.persistSnapshot()
+}
+
+// persistSnapshot writes the snapshot out and rewrites the write-ahead log
+// without the entries it covers. Caller must hold raftMutex.
+func (s *RaftSurfstore) persistSnapshot() {
+	if s.config.DataDir == "" {
+		return
+	}
+	if err := saveRaftSnapshot(s.config.DataDir, s.serverId, s.snapshotData); err != nil {
+		log.Fatal("Error writing the raft snapshot: ", err)
+	}
+	if err := s.wal.rewrite(s.term, s.votedFor, s.snapshotIndex+1, s.log, s.commitIndex); err != nil {
+		log.Fatal("Error compacting the raft log: ", err)
+	}
+}
+
+// 1. Reply immediately if term < currentTerm
+// 2. Create new snapshot file if first chunk (offset is 0)
+// 3. Write data into snapshot file at given offset
+// 4. Reply and wait for more data chunks if done is false
+// 5. If existing log entry has same index and term as snapshot’s last
+// included entry, retain log entries following it and reply
+// 6. Discard the entire log
+// 7. Reset state machine using snapshot contents
+func (s *RaftSurfstore) InstallSnapshot(ctx context.Context, input *InstallSnapshotInput) (*InstallSnapshotOutput, error) {
+	if s.isCrashed {
+		return &InstallSnapshotOutput{}, ERR_SERVER_CRASHED
+	}
+
+	s.raftMutex.Lock()
+	defer s.raftMutex.Unlock()
+
+	output := &InstallSnapshotOutput{
+		ServerId: s.serverId,
+		Success:  false,
+	}
+
+	if input.Term < s.term {
+		output.Term = s.term
+		return output, nil
+	}
+	s.becomeFollower(input.Term)
+	s.resetElectionTimer()
+	s.lastLeaderContact = time.Now()
+	s.leaderId = input.LeaderId
+	output.Term = s.term
+
+	if input.Offset == 0 {
+		s.incomingSnapshot = s.incomingSnapshot[:0]
+	}
+	if input.Offset != int64(len(s.incomingSnapshot)) {
+		// we missed a chunk, the leader starts over
+		return output, nil
+	}
+	s.incomingSnapshot = append(s.incomingSnapshot, input.Data...)
+	output.Success = true
+	if !input.Done {
+		return output, nil
+	}
+
+	data := s.incomingSnapshot
+	s.incomingSnapshot = nil
+	if input.LastIncludedIndex <= s.lastApplied {
+		// we are already past it
+		return output, nil
+	}
+	snapshot := &RaftSnapshot{}
+	if err := proto.Unmarshal(data, snapshot); err != nil {
+		output.Success = false
+		return output, err
+	}
+
+	if input.LastIncludedIndex <= s.lastLogIndex() && s.termAt(input.LastIncludedIndex) == input.LastIncludedTerm {
+		s.log = append([]*UpdateOperation(nil), s.entriesFrom(input.LastIncludedIndex+1)...)
+	} else {
+		s.log = make([]*UpdateOperation, 0)
+	}
+	s.installSnapshot(snapshot, data)
+
+	log.Printf("server %d installed a snapshot at index %d", s.serverId, s.snapshotIndex)
+	return output, nil
+}
+
+// sendSnapshot streams our snapshot to serverId in chunks of
+// SNAPSHOT_CHUNK_SIZE, for a follower that needs entries we already
+// compacted. Returns whether the follower took it.
+func (s *RaftSurfstore) sendSnapshot(serverId int64, term int64) bool {
+	s.raftMutex.Lock()
+	if !s.isLeader || s.term != term {
+		s.raftMutex.Unlock()
+		return false
+	}
+	data := s.snapshotData
+	lastIncludedIndex := s.snapshotIndex
+	lastIncludedTerm := s.snapshotTerm
+	s.raftMutex.Unlock()
+
+	for offset := 0; ; {
+		end := offset + SNAPSHOT_CHUNK_SIZE
+		if end > len(data) {
+			end = len(data)
+		}
+		input := &InstallSnapshotInput{
+			Term:              term,
+			LeaderId:          s.serverId,
+			LastIncludedIndex: lastIncludedIndex,
+			LastIncludedTerm:  lastIncludedTerm,
+			Offset:            int64(offset),
+			Data:              data[offset:end],
+			Done:              end == len(data),
+		}
+		output, err := s.sendInstallSnapshot(serverId, input)
+		if err != nil || s.observeTerm(output.Term) || !output.Success {
+			return false
+		}
+		if input.Done {
+			break
+		}
+		offset = end
+	}
+
+	s.raftMutex.Lock()
+	defer s.raftMutex.Unlock()
+	if _, ok := s.nextIndex[serverId]; !ok {
+		// removed from the cluster in the meantime
+		return false
+	}
+	if lastIncludedIndex > s.matchIndex[serverId] {
+		s.matchIndex[serverId] = lastIncludedIndex
+	}
+	if lastIncludedIndex+1 > s.nextIndex[serverId] {
+		s.nextIndex[serverId] = lastIncludedIndex + 1
+	}
+	return true
+}
+
+func (s *RaftSurfstore) sendInstallSnapshot(serverId int64, input *InstallSnapshotInput) (*InstallSnapshotOutput, error) {
+	client, err := s.raftClient(serverId)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RAFT_RPC_TIMEOUT)
+	defer cancel()
+	return client.InstallSnapshot(ctx, input)
+}
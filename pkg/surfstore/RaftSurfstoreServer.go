@@ -2,41 +2,90 @@ package surfstore
 
 import (
 	context "context"
+	"log"
 	"math"
+	"math/rand"
 	"sync"
 	"time"
 
-	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 type RaftSurfstore struct {
-	// TODO add any fields you need
 	isLeader bool
 	term     int64
+	votedFor int64
 	log      []*UpdateOperation
 
+	// The leader of the current term as far as we know, clients asking a
+	// follower are sent there
+	leaderId int64
+
+	// The log is compacted into a snapshot of the metastore as of
+	// snapshotIndex, snapshotData is what we send to lagging followers
+	snapshotIndex    int64
+	snapshotTerm     int64
+	snapshotData     []byte
+	incomingSnapshot []byte
+
 	metaStore *MetaStore
 
-	commitIndex    int64
-	pendingCommits []chan bool
+	commitIndex int64
+	// UpdateFile calls waiting for the entry at a log index to be applied
+	pendingCommits map[int64]chan *commitResult
 
 	lastApplied int64
 
+	// Durable storage for term, votedFor and the log, nil if disabled
+	wal *raftWAL
+
 	// Server Info
 	ip       string
-	ipList   []string
 	serverId int64
-
-	// volatile state on leaders
-	nextIndex  []int64
-	matchIndex []int64
-
-	// Leader protection
-	isLeaderMutex sync.RWMutex
-	isLeaderCond  *sync.Cond
-
-	rpcClients []RaftSurfstoreClient
+	config   RaftConfig
+
+	// The latest cluster configuration in the log, which is the one we act
+	// on, and the one as of snapshotIndex
+	members        *ClusterConfig
+	snapshotConfig *ClusterConfig
+
+	// volatile state on leaders, keyed by server id
+	nextIndex  map[int64]int64
+	matchIndex map[int64]int64
+	// when the latest AppendEntries a peer answered in our term was sent
+	lastAck map[int64]time.Time
+	// AppendEntries sent before this don't count towards the lease, a
+	// server we told to take over may win votes until then
+	leaseFloor time.Time
+	// the highest commit index each peer is known to have learned
+	peerCommit map[int64]int64
+	// the goroutines pipelining entries to the peers
+	replicators map[int64]*replicator
+
+	// when we last heard from the leader of our term
+	lastLeaderContact time.Time
+	// when we became leader
+	leaderSince time.Time
+
+	// the server the leader is handing leadership to, updates are turned
+	// away meanwhile
+	transferTarget int64
+
+	// Election timer: followers and candidates start an election once
+	// electionDeadline passes, the leader sends heartbeats instead
+	electionDeadline time.Time
+	electionRand     *rand.Rand
+
+	// Protects the raft state above
+	raftMutex sync.Mutex
+
+	// Only one garbage collection runs at a time
+	gcMutex sync.Mutex
+
+	// Connections to the other servers, keyed by server id
+	rpcClients map[int64]*peerConn
 	/*--------------- Chaos Monkey --------------*/
 	isCrashed      bool
 	isCrashedMutex sync.RWMutex
@@ -45,100 +94,307 @@ type RaftSurfstore struct {
 	UnimplementedRaftSurfstoreServer
 }
 
+// commitResult is the metastore's answer to a committed entry, version is
+// nil for configuration entries
+type commitResult struct {
+	version *Version
+	err     error
+}
+
 func (s *RaftSurfstore) GetFileInfoMap(ctx context.Context, empty *emptypb.Empty) (*FileInfoMap, error) {
-	if !s.isLeader {
-		return &FileInfoMap{}, ERR_NOT_LEADER
+	if s.isCrashed {
+		return &FileInfoMap{}, s.clientError(ERR_SERVER_CRASHED)
+	}
+	if err := s.readBarrier(ctx); err != nil {
+		return &FileInfoMap{}, s.clientError(err)
+	}
+	return s.metaStore.GetFileInfoMap(ctx, empty)
+}
+
+// WatchChanges streams the changes of the metastore like
+// MetaStore.WatchChanges, indexed by log index. Only the leader serves it:
+// it makes sure it is the leader before the first change and ends the
+// stream with a leader hint once it no longer is. Everything it streams is
+// committed, clients resume on the next leader from the last index they got.
+func (s *RaftSurfstore) WatchChanges(input *WatchChangesInput, stream RaftSurfstore_WatchChangesServer) error {
+	if s.isCrashed {
+		return s.clientError(ERR_SERVER_CRASHED)
+	}
+	if err := s.readBarrier(stream.Context()); err != nil {
+		return s.clientError(err)
+	}
+
+	leaderCheck := time.NewTicker(WATCH_LEADER_CHECK_INTERVAL)
+	defer leaderCheck.Stop()
+	since := input.GetSinceIndex()
+	for {
+		changes, next := s.metaStore.changesSince(since)
+		for _, change := range changes {
+			if err := stream.Send(change); err != nil {
+				return err
+			}
+			since = change.Index
+		}
+		select {
+		case <-next:
+		case <-leaderCheck.C:
+		case <-stream.Context().Done():
+			return nil
+		}
+
+		if s.isCrashed {
+			return s.clientError(ERR_SERVER_CRASHED)
+		}
+		s.raftMutex.Lock()
+		isLeader := s.isLeader
+		s.raftMutex.Unlock()
+		if !isLeader {
+			return s.clientError(ERR_NOT_LEADER)
+		}
 	}
-	return &FileInfoMap{
-		FileInfoMap: s.metaStore.FileMetaMap,
-	}, nil
+}
+
+// GetFileInfoMapStale answers from this server's metastore without checking
+// with the leader, so it works on followers and learners but may miss the
+// latest updates
+func (s *RaftSurfstore) GetFileInfoMapStale(ctx context.Context, empty *emptypb.Empty) (*FileInfoMap, error) {
+	if s.isCrashed {
+		return &FileInfoMap{}, s.clientError(ERR_SERVER_CRASHED)
+	}
+	return s.metaStore.GetFileInfoMap(ctx, empty)
 }
 
 func (s *RaftSurfstore) GetBlockStoreAddr(ctx context.Context, empty *emptypb.Empty) (*BlockStoreAddr, error) {
-	if !s.isLeader {
-		return &BlockStoreAddr{}, ERR_NOT_LEADER
+	if s.isCrashed {
+		return &BlockStoreAddr{}, s.clientError(ERR_SERVER_CRASHED)
+	}
+	s.raftMutex.Lock()
+	isLeader := s.isLeader
+	s.raftMutex.Unlock()
+	if !isLeader {
+		return &BlockStoreAddr{}, s.clientError(ERR_NOT_LEADER)
+	}
+	return s.metaStore.GetBlockStoreAddr(ctx, empty)
+}
+
+func (s *RaftSurfstore) GetBlockStoreAddrs(ctx context.Context, empty *emptypb.Empty) (*BlockStoreAddrs, error) {
+	if s.isCrashed {
+		return &BlockStoreAddrs{}, s.clientError(ERR_SERVER_CRASHED)
+	}
+	s.raftMutex.Lock()
+	isLeader := s.isLeader
+	s.raftMutex.Unlock()
+	if !isLeader {
+		return &BlockStoreAddrs{}, s.clientError(ERR_NOT_LEADER)
+	}
+	return s.metaStore.GetBlockStoreAddrs(ctx, empty)
+}
+
+func (s *RaftSurfstore) GetBlockStoreMap(ctx context.Context, empty *emptypb.Empty) (*BlockStoreMap, error) {
+	if s.isCrashed {
+		return &BlockStoreMap{}, s.clientError(ERR_SERVER_CRASHED)
+	}
+	s.raftMutex.Lock()
+	isLeader := s.isLeader
+	s.raftMutex.Unlock()
+	if !isLeader {
+		return &BlockStoreMap{}, s.clientError(ERR_NOT_LEADER)
 	}
-	// ???
-	return &BlockStoreAddr{Addr: "localhost:8081"}, nil
+	return s.metaStore.GetBlockStoreMap(ctx, empty)
 }
 
 func (s *RaftSurfstore) UpdateFile(ctx context.Context, filemeta *FileMetaData) (*Version, error) {
-	if !s.isLeader {
-		return &Version{}, ERR_NOT_LEADER
+	if s.isCrashed {
+		return &Version{}, s.clientError(ERR_SERVER_CRASHED)
 	}
 
-	op := UpdateOperation{
+	s.raftMutex.Lock()
+	if !s.isLeader {
+		s.raftMutex.Unlock()
+		return &Version{}, s.clientError(ERR_NOT_LEADER)
+	}
+	if s.transferTarget != NO_TRANSFER {
+		s.raftMutex.Unlock()
+		return &Version{}, s.clientError(ERR_TRANSFER_IN_PROGRESS)
+	}
+	index, committed := s.appendEntry(&UpdateOperation{
 		Term:         s.term,
 		FileMetaData: filemeta,
-	}
+		Timestamp:    time.Now().UnixMilli(),
+	})
+	s.raftMutex.Unlock()
 
-	s.log = append(s.log, &op)
-	committed := make(chan bool)
-	s.pendingCommits = append(s.pendingCommits, committed)
+	version, err := s.awaitCommit(ctx, index, committed)
+	if err != nil {
+		return version, s.clientError(err)
+	}
+	return version, nil
+}
 
-	go s.attemptCommit()
+func (s *RaftSurfstore) GetFileHistory(ctx context.Context, input *FileHistoryInput) (*FileHistory, error) {
+	if s.isCrashed {
+		return &FileHistory{}, s.clientError(ERR_SERVER_CRASHED)
+	}
+	if err := s.readBarrier(ctx); err != nil {
+		return &FileHistory{}, s.clientError(err)
+	}
+	return s.metaStore.GetFileHistory(ctx, input)
+}
 
-	success := <-committed
-	if success {
-		return s.metaStore.UpdateFile(ctx, filemeta)
+// RestoreFileVersion goes through the log like UpdateFile, the version to
+// restore is looked up when the entry is applied
+func (s *RaftSurfstore) RestoreFileVersion(ctx context.Context, input *RestoreFileVersionInput) (*Version, error) {
+	if s.isCrashed {
+		return &Version{}, s.clientError(ERR_SERVER_CRASHED)
 	}
 
-	return nil, nil
+	s.raftMutex.Lock()
+	if !s.isLeader {
+		s.raftMutex.Unlock()
+		return &Version{}, s.clientError(ERR_NOT_LEADER)
+	}
+	if s.transferTarget != NO_TRANSFER {
+		s.raftMutex.Unlock()
+		return &Version{}, s.clientError(ERR_TRANSFER_IN_PROGRESS)
+	}
+	index, committed := s.appendEntry(&UpdateOperation{
+		Term:      s.term,
+		Restore:   input,
+		Timestamp: time.Now().UnixMilli(),
+	})
+	s.raftMutex.Unlock()
+
+	version, err := s.awaitCommit(ctx, index, committed)
+	if err != nil {
+		return version, s.clientError(err)
+	}
+	return version, nil
 }
 
-func (s *RaftSurfstore) attemptCommit() {
-	targetIdx := s.commitIndex + 1
-	commitChan := make(chan *AppendEntryOutput, len(s.ipList))
-	for idx, _ := range s.ipList {
-		if int64(idx) == s.serverId {
-			continue
+// clientError turns the errors of the metastore RPCs into statuses clients
+// can act on: a crashed server or one handing off leadership looks
+// unavailable and a follower names the leader it knows of in a LeaderHint.
+// Other errors are passed through.
+func (s *RaftSurfstore) clientError(err error) error {
+	switch err {
+	case ERR_SERVER_CRASHED, ERR_TRANSFER_IN_PROGRESS:
+		return status.Error(codes.Unavailable, err.Error())
+	case ERR_NOT_LEADER:
+		s.raftMutex.Lock()
+		hint := &LeaderHint{LeaderId: UNKNOWN_LEADER}
+		if leader := s.member(s.leaderId); leader != nil && leader.ServerId != s.serverId {
+			hint.LeaderId = leader.ServerId
+			hint.LeaderAddr = leader.Addr
 		}
-		go s.commitEntry(int64(idx), targetIdx, commitChan)
-	}
+		s.raftMutex.Unlock()
 
-	commitCount := 1
-	for {
-		// TODO handle crashed nodes
-		commit := <-commitChan
-		if commit != nil && commit.Success {
-			commitCount++
+		st, detailErr := status.New(codes.FailedPrecondition, err.Error()).WithDetails(hint)
+		if detailErr != nil {
+			return status.Error(codes.FailedPrecondition, err.Error())
 		}
-		if commitCount > len(s.ipList)/2 {
-			s.pendingCommits[targetIdx] <- true
-			s.commitIndex = targetIdx
+		return st.Err()
+	}
+	return err
+}
+
+// appendEntry adds a new entry to the leader's log and returns its index and
+// the channel its commit result will be sent on.
+// Caller must hold raftMutex.
+func (s *RaftSurfstore) appendEntry(op *UpdateOperation) (int64, chan *commitResult) {
+	index := s.lastLogIndex() + 1
+	s.storeEntries(index, op)
+	committed := make(chan *commitResult, 1)
+	s.pendingCommits[index] = committed
+	s.notifyReplicators()
+	return index, committed
+}
+
+// awaitCommit waits until the entry at index is applied
+func (s *RaftSurfstore) awaitCommit(ctx context.Context, index int64, committed chan *commitResult) (*Version, error) {
+	select {
+	case result := <-committed:
+		return result.version, result.err
+	case <-ctx.Done():
+		s.raftMutex.Lock()
+		delete(s.pendingCommits, index)
+		s.raftMutex.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// advanceCommitIndex commits the highest index stored on a majority of the
+// voters. Only entries from the current term are committed by counting
+// replicas, older ones are committed along with them (§5.4.2).
+// Caller must hold raftMutex.
+func (s *RaftSurfstore) advanceCommitIndex() {
+	for n := s.lastLogIndex(); n > s.commitIndex; n-- {
+		if s.termAt(n) != s.term {
 			break
 		}
+		stored := func(serverId int64) bool {
+			if serverId == s.serverId {
+				return true
+			}
+			match, ok := s.matchIndex[serverId]
+			return ok && match >= n
+		}
+		if s.isQuorum(stored) {
+			s.commitIndex = n
+			s.applyCommitted()
+			// the followers learn the new commit index without waiting for
+			// the next heartbeat
+			s.notifyReplicators()
+			return
+		}
 	}
 }
 
-func (s *RaftSurfstore) commitEntry(serverIdx, entryIdx int64, commitChan chan *AppendEntryOutput) {
-	for {
-		addr := s.ipList[serverIdx]
-		conn, err := grpc.Dial(addr, grpc.WithInsecure())
-		if err != nil {
-			return
+// applyCommitted applies every committed entry not yet applied to the
+// metastore and hands the result to the call waiting on it, if any. A leader
+// that is no longer a member steps down once its removal is committed.
+// Caller must hold raftMutex.
+func (s *RaftSurfstore) applyCommitted() {
+	if s.lastApplied < s.commitIndex {
+		if err := s.wal.saveCommitIndex(s.commitIndex); err != nil {
+			log.Fatal("Error writing the raft log: ", err)
 		}
-		client := NewRaftSurfstoreClient(conn)
-
-		// TODO create correct AppendEntryInput from s.nextIndex, etc
-		input := &AppendEntryInput{
-			Term:         s.term,
-			PrevLogTerm:  -1,
-			PrevLogIndex: -1,
-			Entries:      s.log[:entryIdx+1],
-			LeaderCommit: s.commitIndex,
+	}
+	for s.lastApplied < s.commitIndex {
+		s.lastApplied++
+		entry := s.entryAt(s.lastApplied)
+		var version *Version
+		var err error
+		acceptedAt := time.UnixMilli(entry.Timestamp)
+		if entry.FileMetaData != nil {
+			version, err = s.metaStore.applyUpdate(s.lastApplied, acceptedAt, entry.FileMetaData)
+		}
+		if entry.Restore != nil {
+			version, err = s.metaStore.applyRestore(s.lastApplied, acceptedAt, entry.Restore)
+		}
+		if entry.BlockStores != nil {
+			s.metaStore.setBlockStores(entry.BlockStores)
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
-		output, _ := client.AppendEntries(ctx, input)
-		if output.Success {
-			commitChan <- output
-			return
+		if committed, ok := s.pendingCommits[s.lastApplied]; ok {
+			committed <- &commitResult{version: version, err: err}
+			delete(s.pendingCommits, s.lastApplied)
+		}
+
+		if entry.Config != nil && s.isLeader && s.member(s.serverId) == nil {
+			log.Printf("server %d was removed from the cluster, stepping down", s.serverId)
+			s.becomeFollower(s.term)
 		}
-		// TODO update state. s.nextIndex, etc
+	}
+	s.maybeSnapshot()
+}
 
-		// TODO handle crashed/ non success cases
+// failPendingCommits gives up on every UpdateFile call still waiting, their
+// entries may never be committed once we lose leadership.
+// Caller must hold raftMutex.
+func (s *RaftSurfstore) failPendingCommits() {
+	for index, committed := range s.pendingCommits {
+		committed <- &commitResult{version: &Version{}, err: ERR_NOT_LEADER}
+		delete(s.pendingCommits, index)
 	}
 }
 
@@ -156,37 +412,81 @@ func (s *RaftSurfstore) AppendEntries(ctx context.Context, input *AppendEntryInp
 		return &AppendEntryOutput{}, ERR_SERVER_CRASHED
 	}
 
-	// step down from leader, if AppendEntryOutput response is higher term
+	s.raftMutex.Lock()
+	defer s.raftMutex.Unlock()
 
 	output := &AppendEntryOutput{
+		ServerId:     s.serverId,
 		Success:      false,
 		MatchedIndex: -1,
 	}
 
-	if input.Term > s.term {
-		s.term = input.Term
+	//1. Reply false if term < currentTerm (§5.1)
+	if input.Term < s.term {
+		output.Term = s.term
+		return output, nil
+	}
+
+	// the sender is the leader of this term: step down if we were leading an
+	// older term and hold off our own election
+	s.becomeFollower(input.Term)
+	s.resetElectionTimer()
+	s.lastLeaderContact = time.Now()
+	s.leaderId = input.LeaderId
+	output.Term = s.term
+
+	// entries covered by our snapshot are committed, so they match
+	if input.PrevLogIndex < s.snapshotIndex {
+		skip := s.snapshotIndex - input.PrevLogIndex
+		if skip > int64(len(input.Entries)) {
+			skip = int64(len(input.Entries))
+		}
+		input.PrevLogIndex += skip
+		input.PrevLogTerm = s.termAt(input.PrevLogIndex)
+		input.Entries = input.Entries[skip:]
 	}
 
-	//1. Reply false if term < currentTerm (§5.1)
 	//2. Reply false if log doesn’t contain an entry at prevLogIndex whose term
 	//matches prevLogTerm (§5.3)
+	// (the empty prefix at index -1 always matches)
+	if input.PrevLogIndex > s.lastLogIndex() {
+		output.ConflictTerm = -1
+		output.ConflictIndex = s.lastLogIndex() + 1
+		return output, nil
+	}
+	if input.PrevLogIndex >= 0 && s.termAt(input.PrevLogIndex) != input.PrevLogTerm {
+		// tell the leader where our entries for the conflicting term start so
+		// it can skip the whole term in one round trip
+		output.ConflictTerm = s.termAt(input.PrevLogIndex)
+		output.ConflictIndex = input.PrevLogIndex
+		for output.ConflictIndex > 0 && s.termAt(output.ConflictIndex-1) == output.ConflictTerm {
+			output.ConflictIndex--
+		}
+		return output, nil
+	}
+
 	//3. If an existing entry conflicts with a new one (same index but different
 	//terms), delete the existing entry and all that follow it (§5.3)
 	//4. Append any new entries not already in the log
-	s.log = append(s.log, input.Entries...)
+	for i, entry := range input.Entries {
+		entryIdx := input.PrevLogIndex + 1 + int64(i)
+		if entryIdx <= s.lastLogIndex() && s.termAt(entryIdx) == entry.Term {
+			continue
+		}
+		s.storeEntries(entryIdx, input.Entries[i:]...)
+		break
+	}
+	lastNewEntry := input.PrevLogIndex + int64(len(input.Entries))
 
 	//5. If leaderCommit > commitIndex, set commitIndex = min(leaderCommit, index
 	//of last new entry)
-	// TODO only do this if leaderCommit > commitIndex
-	s.commitIndex = int64(math.Min(float64(input.LeaderCommit), float64(len(s.log)-1)))
-
-	for s.lastApplied < s.commitIndex {
-		s.lastApplied++
-		entry := s.log[s.lastApplied]
-		s.metaStore.UpdateFile(ctx, entry.FileMetaData)
+	if input.LeaderCommit > s.commitIndex {
+		s.commitIndex = int64(math.Max(float64(s.commitIndex), math.Min(float64(input.LeaderCommit), float64(lastNewEntry))))
 	}
+	s.applyCommitted()
 
 	output.Success = true
+	output.MatchedIndex = lastNewEntry
 
 	return output, nil
 }
@@ -198,8 +498,14 @@ func (s *RaftSurfstore) SetLeader(ctx context.Context, _ *emptypb.Empty) (*Succe
 	}
 
 	// otherwise, set leader; term++, broadcast heartbeat
-	s.isLeader = true
+	s.raftMutex.Lock()
 	s.term++
+	s.votedFor = s.serverId
+	s.persistState()
+	s.initLeaderState()
+	s.raftMutex.Unlock()
+
+	go s.broadcastAppendEntries()
 	return &Success{Flag: true}, nil
 }
 
@@ -209,42 +515,403 @@ func (s *RaftSurfstore) SendHeartbeat(ctx context.Context, _ *emptypb.Empty) (*S
 	if s.isCrashed {
 		return &Success{Flag: false}, ERR_SERVER_CRASHED
 	}
-	// not leader, do nothing
-	if !s.isLeader {
+
+	if !s.broadcastAppendEntries() {
 		return &Success{Flag: false}, ERR_NOT_LEADER
 	}
+	return &Success{Flag: true}, nil
+}
+
+// 1. Reply false if term < currentTerm (§5.1)
+// 2. If votedFor is null or candidateId, and candidate’s log is at least as
+// up-to-date as receiver’s log, grant vote (§5.2, §5.4)
+//
+// With pre-vote, check-quorum or lease reads on, a server that heard from
+// the current leader within the minimum election timeout ignores candidates
+// altogether, which keeps a leader's lease valid and stops a server that was
+// cut off from disrupting the cluster (§6.4.1). Candidates the leader handed
+// leadership to are the exception, the leader gives up its lease before it
+// hands over.
+func (s *RaftSurfstore) RequestVote(ctx context.Context, input *RequestVoteInput) (*RequestVoteOutput, error) {
+	if s.isCrashed {
+		return &RequestVoteOutput{}, ERR_SERVER_CRASHED
+	}
+
+	s.raftMutex.Lock()
+	defer s.raftMutex.Unlock()
+
+	output := &RequestVoteOutput{
+		ServerId:    s.serverId,
+		VoteGranted: false,
+	}
+
+	sticky := input.PreVote || s.config.CheckQuorum || s.config.LeaseReads
+	if input.Term < s.term || (sticky && !input.LeadershipTransfer && s.heardFromLeader()) {
+		output.Term = s.term
+		return output, nil
+	}
+	if input.PreVote {
+		// we would vote for it in its term, but nothing changes until it
+		// actually asks
+		output.Term = s.term
+		output.VoteGranted = input.Term > s.term && s.isLogUpToDate(input.LastLogIndex, input.LastLogTerm)
+		return output, nil
+	}
+	if input.Term > s.term {
+		s.becomeFollower(input.Term)
+	}
+	output.Term = s.term
+
+	if (s.votedFor == NOT_VOTED || s.votedFor == input.CandidateId) &&
+		s.isLogUpToDate(input.LastLogIndex, input.LastLogTerm) {
+		s.votedFor = input.CandidateId
+		s.persistState()
+		s.resetElectionTimer()
+		output.VoteGranted = true
+	}
+
+	return output, nil
+}
+
+// heardFromLeader reports whether we are the leader or recently got
+// AppendEntries from one. Caller must hold raftMutex.
+func (s *RaftSurfstore) heardFromLeader() bool {
+	return s.isLeader || time.Since(s.lastLeaderContact) < s.config.ElectionTimeoutMin
+}
+
+// A candidate's log is at least as up-to-date as ours if its last term is
+// newer, or the last terms match and its log is at least as long (§5.4.1)
+func (s *RaftSurfstore) isLogUpToDate(lastLogIndex, lastLogTerm int64) bool {
+	myLastTerm := s.lastLogTerm()
+	if lastLogTerm != myLastTerm {
+		return lastLogTerm > myLastTerm
+	}
+	return lastLogIndex >= s.lastLogIndex()
+}
+
+// Log indexes count from the start of history, s.log only holds the
+// entries after the last snapshot
+
+func (s *RaftSurfstore) lastLogIndex() int64 {
+	return s.snapshotIndex + int64(len(s.log))
+}
+
+func (s *RaftSurfstore) lastLogTerm() int64 {
+	return s.termAt(s.lastLogIndex())
+}
+
+// termAt returns the term of the entry at index, index -1 stands for the
+// empty prefix before the first entry and has term 0. Entries compacted into
+// the snapshot have an unknown term of -1.
+func (s *RaftSurfstore) termAt(index int64) int64 {
+	if index == s.snapshotIndex {
+		return s.snapshotTerm
+	}
+	if index < s.snapshotIndex {
+		return -1
+	}
+	if index > s.lastLogIndex() {
+		return 0
+	}
+	return s.entryAt(index).Term
+}
 
-	//  send a round of appendentries
-	for idx, addr := range s.ipList {
-		if int64(idx) == s.serverId {
+func (s *RaftSurfstore) entryAt(index int64) *UpdateOperation {
+	return s.log[index-s.snapshotIndex-1]
+}
+
+// entriesFrom returns the entries from index to the end of the log
+func (s *RaftSurfstore) entriesFrom(index int64) []*UpdateOperation {
+	return s.log[index-s.snapshotIndex-1:]
+}
+
+// electionLoop runs for the lifetime of the server. Followers and candidates
+// start an election when no leader has contacted them before their
+// randomized deadline. Learners and servers outside the cluster never do.
+// With CheckQuorum the leader steps down once it loses touch with a majority.
+func (s *RaftSurfstore) electionLoop() {
+	ticker := time.NewTicker(ELECTION_TICK)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if s.crashed() {
 			continue
 		}
 
-		conn, err := grpc.Dial(addr, grpc.WithInsecure())
-		if err != nil {
-			return nil, nil
+		s.raftMutex.Lock()
+		if s.isLeader && s.config.CheckQuorum && !s.hasRecentQuorum() {
+			log.Printf("server %d lost touch with a majority, stepping down in term %d", s.serverId, s.term)
+			s.becomeFollower(s.term)
+			s.resetElectionTimer()
 		}
-		client := NewRaftSurfstoreClient(conn)
-
-		// TODO create correct AppendEntryInput from s.nextIndex, etc
-		input := &AppendEntryInput{
-			Term:         s.term,
-			PrevLogTerm:  -1,
-			PrevLogIndex: -1,
-			// TODO figure out which entries to send
-			Entries:      make([]*UpdateOperation, 0),
-			LeaderCommit: s.commitIndex,
+		electionDue := !s.isLeader && !s.config.ManualElection && s.isVoter(s.serverId) &&
+			time.Now().After(s.electionDeadline)
+		if electionDue {
+			s.resetElectionTimer()
 		}
+		s.raftMutex.Unlock()
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
-		output, err := client.AppendEntries(ctx, input)
-		if output != nil {
-			// server is alive
+		if electionDue {
+			go s.startElection(false)
 		}
 	}
+}
 
-	return &Success{Flag: true}, nil
+// hasRecentQuorum reports whether a majority answered AppendEntries sent
+// within the last election timeout, a leader that was just elected gets
+// that long to hear from them (§6.2). Caller must hold raftMutex.
+func (s *RaftSurfstore) hasRecentQuorum() bool {
+	window := s.config.ElectionTimeoutMax
+	if time.Since(s.leaderSince) < window {
+		return true
+	}
+	return s.isQuorum(func(serverId int64) bool {
+		return serverId == s.serverId || time.Since(s.lastAck[serverId]) < window
+	})
+}
+
+// startElection turns the node into a candidate for the next term and asks
+// every voter for its vote, becoming leader once a majority agrees. transfer
+// is set when the leader told us to take over, which skips the pre-vote.
+func (s *RaftSurfstore) startElection(transfer bool) {
+	if s.config.PreVote && !transfer && !s.preVote() {
+		return
+	}
+
+	s.raftMutex.Lock()
+	if !s.isVoter(s.serverId) {
+		s.raftMutex.Unlock()
+		return
+	}
+	s.term++
+	s.votedFor = s.serverId
+	s.persistState()
+	s.resetElectionTimer()
+	term := s.term
+	input := &RequestVoteInput{
+		Term:         term,
+		CandidateId:  s.serverId,
+		LastLogIndex: s.lastLogIndex(),
+		LastLogTerm:  s.lastLogTerm(),
+
+		LeadershipTransfer: transfer,
+	}
+	s.raftMutex.Unlock()
+
+	log.Printf("server %d starting election for term %d", s.serverId, term)
+
+	if s.requestVotes(input) {
+		s.becomeLeader(term)
+	}
+}
+
+// preVote asks the voters whether they would elect us in the next term
+// before we move to it (§9.6). A server that can't win, e.g. because it was
+// cut off from the others, then keeps its term instead of bumping it on
+// every timeout and deposing the leader with it once it is back.
+func (s *RaftSurfstore) preVote() bool {
+	s.raftMutex.Lock()
+	if !s.isVoter(s.serverId) {
+		s.raftMutex.Unlock()
+		return false
+	}
+	term := s.term
+	input := &RequestVoteInput{
+		Term:         term + 1,
+		CandidateId:  s.serverId,
+		LastLogIndex: s.lastLogIndex(),
+		LastLogTerm:  s.lastLogTerm(),
+		PreVote:      true,
+	}
+	s.raftMutex.Unlock()
+
+	if !s.requestVotes(input) {
+		return false
+	}
+
+	s.raftMutex.Lock()
+	defer s.raftMutex.Unlock()
+	return s.term == term && !s.isLeader
+}
+
+// requestVotes sends input to every other voter and reports whether a
+// majority granted it, counting our own vote
+func (s *RaftSurfstore) requestVotes(input *RequestVoteInput) bool {
+	s.raftMutex.Lock()
+	voters := make([]int64, 0)
+	for _, peer := range s.peers() {
+		if !peer.Learner {
+			voters = append(voters, peer.ServerId)
+		}
+	}
+	s.raftMutex.Unlock()
+
+	votes := make(chan *RequestVoteOutput, len(voters))
+	for _, serverId := range voters {
+		go func(serverId int64) {
+			output, err := s.sendRequestVote(serverId, input)
+			if err != nil {
+				output = nil
+			}
+			votes <- output
+		}(serverId)
+	}
+
+	granted := map[int64]bool{s.serverId: true}
+	for responses := 0; ; responses++ {
+		if s.hasVoteQuorum(granted) {
+			return true
+		}
+		if responses == len(voters) {
+			return false
+		}
+
+		vote := <-votes
+		if vote == nil {
+			continue
+		}
+		if s.observeTerm(vote.Term) {
+			return false
+		}
+		if vote.VoteGranted {
+			granted[vote.ServerId] = true
+		}
+	}
+}
+
+// hasVoteQuorum reports whether the granted votes are a majority of the
+// voters in the current configuration
+func (s *RaftSurfstore) hasVoteQuorum(granted map[int64]bool) bool {
+	s.raftMutex.Lock()
+	defer s.raftMutex.Unlock()
+	return s.isQuorum(func(serverId int64) bool { return granted[serverId] })
+}
+
+// heartbeatLoop runs for the lifetime of the server. While the node is the
+// leader it sends a round of AppendEntries every HeartbeatInterval, which
+// both keeps the followers from starting elections and brings their logs
+// and commit index up to date.
+func (s *RaftSurfstore) heartbeatLoop() {
+	ticker := time.NewTicker(s.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if s.crashed() {
+			continue
+		}
+		// don't wait for slow peers, the next round starts on the next tick
+		go s.broadcastAppendEntries()
+	}
+}
+
+func (s *RaftSurfstore) sendRequestVote(serverId int64, input *RequestVoteInput) (*RequestVoteOutput, error) {
+	client, err := s.raftClient(serverId)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RAFT_RPC_TIMEOUT)
+	defer cancel()
+	return client.RequestVote(ctx, input)
+}
+
+// becomeLeader takes over as leader if we are still a candidate in term and
+// starts the term with a no-op entry, which commits whatever earlier leaders
+// left uncommitted and lets reads go ahead (§6.4)
+func (s *RaftSurfstore) becomeLeader(term int64) {
+	s.raftMutex.Lock()
+	if s.term != term || s.isLeader || s.votedFor != s.serverId {
+		s.raftMutex.Unlock()
+		return
+	}
+	s.initLeaderState()
+	s.storeEntries(s.lastLogIndex()+1, &UpdateOperation{Term: term})
+	s.raftMutex.Unlock()
+
+	log.Printf("server %d is the leader for term %d", s.serverId, term)
+	s.broadcastAppendEntries()
+}
+
+// initLeaderState marks the node as leader and optimistically assumes every
+// peer's log matches ours. Caller must hold raftMutex.
+func (s *RaftSurfstore) initLeaderState() {
+	s.isLeader = true
+	s.leaderId = s.serverId
+	s.leaderSince = time.Now()
+	s.nextIndex = make(map[int64]int64)
+	s.matchIndex = make(map[int64]int64)
+	s.lastAck = make(map[int64]time.Time)
+	s.peerCommit = make(map[int64]int64)
+	s.stopReplicators()
+	s.replicators = make(map[int64]*replicator)
+	s.refreshMembers()
+}
+
+// becomeFollower drops leadership and adopts term if it is newer than ours.
+// Caller must hold raftMutex.
+func (s *RaftSurfstore) becomeFollower(term int64) {
+	if term > s.term {
+		s.term = term
+		s.votedFor = NOT_VOTED
+		s.leaderId = UNKNOWN_LEADER
+		s.persistState()
+	}
+	if s.isLeader {
+		s.failPendingCommits()
+		s.stopReplicators()
+		s.leaderId = UNKNOWN_LEADER
+		s.transferTarget = NO_TRANSFER
+	}
+	s.isLeader = false
+}
+
+// observeTerm steps down if a peer reported a newer term, returning whether it did
+func (s *RaftSurfstore) observeTerm(term int64) bool {
+	s.raftMutex.Lock()
+	defer s.raftMutex.Unlock()
+	if term > s.term {
+		s.becomeFollower(term)
+		s.resetElectionTimer()
+		return true
+	}
+	return false
+}
+
+// persistState makes the current term and vote durable before we act on them.
+// Caller must hold raftMutex.
+func (s *RaftSurfstore) persistState() {
+	if err := s.wal.saveState(s.term, s.votedFor); err != nil {
+		log.Fatal("Error writing the raft state: ", err)
+	}
+}
+
+// storeEntries puts entries into the log from startIndex on, replacing
+// anything stored there, and makes them durable. Configuration entries take
+// effect right away, and dropping one reverts to the configuration before.
+// Caller must hold raftMutex.
+func (s *RaftSurfstore) storeEntries(startIndex int64, entries ...*UpdateOperation) {
+	changesConfig := false
+	for idx := startIndex; idx <= s.lastLogIndex(); idx++ {
+		changesConfig = changesConfig || s.entryAt(idx).Config != nil
+	}
+	for _, entry := range entries {
+		changesConfig = changesConfig || entry.Config != nil
+	}
+
+	s.log = append(s.log[:startIndex-s.snapshotIndex-1], entries...)
+	if err := s.wal.saveEntries(startIndex, entries); err != nil {
+		log.Fatal("Error writing the raft log: ", err)
+	}
+	if changesConfig {
+		s.refreshMembers()
+	}
+}
+
+// Caller must hold raftMutex
+func (s *RaftSurfstore) resetElectionTimer() {
+	spread := int64(s.config.ElectionTimeoutMax - s.config.ElectionTimeoutMin)
+	timeout := s.config.ElectionTimeoutMin + time.Duration(s.electionRand.Int63n(spread))
+	s.electionDeadline = time.Now().Add(timeout)
 }
 
 // for testing purpose
@@ -257,6 +924,10 @@ func (s *RaftSurfstore) Crash(ctx context.Context, _ *emptypb.Empty) (*Success,
 }
 
 func (s *RaftSurfstore) Restore(ctx context.Context, _ *emptypb.Empty) (*Success, error) {
+	s.raftMutex.Lock()
+	s.resetElectionTimer()
+	s.raftMutex.Unlock()
+
 	s.isCrashedMutex.Lock()
 	s.isCrashed = false
 	s.notCrashedCond.Broadcast()
@@ -265,16 +936,26 @@ func (s *RaftSurfstore) Restore(ctx context.Context, _ *emptypb.Empty) (*Success
 	return &Success{Flag: true}, nil
 }
 
+// crashed reads isCrashed for the loops that run alongside Crash and Restore
+func (s *RaftSurfstore) crashed() bool {
+	s.isCrashedMutex.RLock()
+	defer s.isCrashedMutex.RUnlock()
+	return s.isCrashed
+}
+
 func (s *RaftSurfstore) IsCrashed(ctx context.Context, _ *emptypb.Empty) (*CrashedState, error) {
 	return &CrashedState{IsCrashed: s.isCrashed}, nil
 }
 
 func (s *RaftSurfstore) GetInternalState(ctx context.Context, empty *emptypb.Empty) (*RaftInternalState, error) {
+	s.raftMutex.Lock()
+	defer s.raftMutex.Unlock()
+
 	fileInfoMap, _ := s.metaStore.GetFileInfoMap(ctx, empty)
 	return &RaftInternalState{
 		IsLeader: s.isLeader,
 		Term:     s.term,
-		Log:      s.log,
+		Log:      append([]*UpdateOperation(nil), s.log...),
 		MetaMap:  fileInfoMap,
 	}, nil
 }
@@ -0,0 +1,166 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Hands leadership to the voter targetId, e.g. before taking the leader down
+// for maintenance (§3.10 of the Raft thesis):
+//
+// 1. Stop accepting updates so the target can catch up
+// 2. Replicate until the target's log matches ours
+// 3. Send it TimeoutNow, so it starts an election right away and wins it
+// 4. Give up and accept updates again if the target has not taken over
+// within an election timeout
+func (s *RaftSurfstore) TransferLeadership(ctx context.Context, input *TransferLeadershipInput) (*Success, error) {
+	if s.isCrashed {
+		return &Success{Flag: false}, ERR_SERVER_CRASHED
+	}
+
+	s.raftMutex.Lock()
+	if !s.isLeader {
+		s.raftMutex.Unlock()
+		return &Success{Flag: false}, ERR_NOT_LEADER
+	}
+	if input.TargetId == s.serverId {
+		s.raftMutex.Unlock()
+		return &Success{Flag: true}, nil
+	}
+	if !s.isVoter(input.TargetId) {
+		s.raftMutex.Unlock()
+		return &Success{Flag: false}, fmt.Errorf("server %d is not a voting member", input.TargetId)
+	}
+	if s.transferTarget != NO_TRANSFER {
+		s.raftMutex.Unlock()
+		return &Success{Flag: false}, ERR_TRANSFER_IN_PROGRESS
+	}
+	s.transferTarget = input.TargetId
+	term := s.term
+	s.raftMutex.Unlock()
+
+	log.Printf("server %d transferring leadership to server %d", s.serverId, input.TargetId)
+	deadline := time.Now().Add(s.config.ElectionTimeoutMax)
+	err := s.transferTo(ctx, input.TargetId, term, deadline)
+
+	s.raftMutex.Lock()
+	if s.transferTarget == input.TargetId {
+		s.transferTarget = NO_TRANSFER
+	}
+	s.raftMutex.Unlock()
+
+	if err != nil {
+		log.Printf("server %d aborted the transfer to server %d: %v", s.serverId, input.TargetId, err)
+		return &Success{Flag: false}, err
+	}
+	return &Success{Flag: true}, nil
+}
+
+// transferTo waits for targetId to catch up, tells it to start an election
+// and waits until it leads the cluster
+func (s *RaftSurfstore) transferTo(ctx context.Context, targetId int64, term int64, deadline time.Time) error {
+	ticker := time.NewTicker(ELECTION_TICK)
+	defer ticker.Stop()
+
+	// wait for the next tick, or the error that ends the transfer
+	wait := func() error {
+		select {
+		case <-ticker.C:
+			if time.Now().After(deadline) {
+				return ERR_TRANSFER_TIMEOUT
+			}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for {
+		s.raftMutex.Lock()
+		if !s.isLeader || s.term != term {
+			s.raftMutex.Unlock()
+			return ERR_NOT_LEADER
+		}
+		caughtUp := s.matchIndex[targetId] == s.lastLogIndex()
+		s.raftMutex.Unlock()
+		if caughtUp {
+			break
+		}
+
+		s.broadcastAppendEntries()
+		if err := wait(); err != nil {
+			return err
+		}
+	}
+
+	// the target's election, which voters take part in however recently
+	// they heard from us, is over within an election timeout
+	s.raftMutex.Lock()
+	s.leaseFloor = time.Now().Add(s.config.ElectionTimeoutMax)
+	s.raftMutex.Unlock()
+	output, err := s.sendTimeoutNow(targetId, &TimeoutNowInput{Term: term, LeaderId: s.serverId})
+	if err != nil {
+		return err
+	}
+	if s.observeTerm(output.Term) {
+		return nil
+	}
+	if !output.Success {
+		return fmt.Errorf("server %d refused to take over", targetId)
+	}
+
+	// the target's RequestVote carries a newer term and deposes us, its
+	// first AppendEntries tells us it won
+	for {
+		s.raftMutex.Lock()
+		leaderId := s.leaderId
+		deposed := !s.isLeader || s.term != term
+		s.raftMutex.Unlock()
+		if deposed && leaderId == targetId {
+			return nil
+		}
+		if deposed && leaderId != UNKNOWN_LEADER {
+			return fmt.Errorf("server %d took over instead of server %d", leaderId, targetId)
+		}
+		if err := wait(); err != nil {
+			return err
+		}
+	}
+}
+
+// TimeoutNow makes the server start an election at once, it is how the
+// leader hands leadership over
+func (s *RaftSurfstore) TimeoutNow(ctx context.Context, input *TimeoutNowInput) (*TimeoutNowOutput, error) {
+	if s.isCrashed {
+		return &TimeoutNowOutput{}, ERR_SERVER_CRASHED
+	}
+
+	s.raftMutex.Lock()
+	defer s.raftMutex.Unlock()
+
+	output := &TimeoutNowOutput{
+		ServerId: s.serverId,
+		Term:     s.term,
+		Success:  false,
+	}
+	if input.Term < s.term || !s.isVoter(s.serverId) {
+		return output, nil
+	}
+
+	output.Success = true
+	go s.startElection(true)
+	return output, nil
+}
+
+func (s *RaftSurfstore) sendTimeoutNow(serverId int64, input *TimeoutNowInput) (*TimeoutNowOutput, error) {
+	client, err := s.raftClient(serverId)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RAFT_RPC_TIMEOUT)
+	defer cancel()
+	return client.TimeoutNow(ctx, input)
+}
@@ -2,6 +2,8 @@ package surfstore
 
 import (
 	"bufio"
+	"fmt"
+	"math/rand"
 	"net"
 
 	//	"google.golang.org/grpc"
@@ -13,11 +15,30 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	grpc "google.golang.org/grpc"
 )
 
+// LoadRaftConfigFile returns the addresses of every server in the config
+// file, indexed by server id
 func LoadRaftConfigFile(filename string) (ipList []string) {
+	for _, member := range LoadRaftClusterConfig(filename).Members {
+		ipList = append(ipList, member.Addr)
+	}
+	return ipList
+}
+
+// LoadRaftClusterConfig reads the cluster a config file describes. Servers
+// get their ids in the order they are listed, the ones listed as learnerN
+// instead of metadataN start out as learners:
+//
+//	M: 4
+//	metadata0: localhost:9007
+//	metadata1: localhost:9008
+//	metadata2: localhost:9009
+//	learner3: localhost:9010
+func LoadRaftClusterConfig(filename string) (cluster *ClusterConfig) {
 	configFD, e := os.Open(filename)
 	if e != nil {
 		log.Fatal("Error Open config file:", e)
@@ -41,45 +62,194 @@ func LoadRaftConfigFile(filename string) (ipList []string) {
 		splitRes := strings.Split(lineString, ": ")
 		if index == 0 {
 			serverCount, _ = strconv.Atoi(splitRes[1])
-			ipList = make([]string, serverCount, serverCount)
+			cluster = &ClusterConfig{Members: make([]*RaftMember, serverCount, serverCount)}
 		} else {
-			ipList[index-1] = splitRes[1]
+			cluster.Members[index-1] = &RaftMember{
+				ServerId: int64(index - 1),
+				Addr:     splitRes[1],
+				Learner:  strings.HasPrefix(splitRes[0], LEARNER_PREFIX),
+			}
 		}
 	}
+}
+
+// RaftConfig holds the tunable parameters of a RaftSurfstore node
+type RaftConfig struct {
+	// Election timeouts are drawn uniformly from [ElectionTimeoutMin, ElectionTimeoutMax)
+	ElectionTimeoutMin time.Duration
+	ElectionTimeoutMax time.Duration
+
+	// How often the leader sends AppendEntries to its followers. Must be well
+	// below ElectionTimeoutMin so followers don't time out between heartbeats.
+	HeartbeatInterval time.Duration
+
+	// Directory holding the write-ahead log. The raft state is only kept in
+	// memory if empty.
+	DataDir string
+
+	// The log is compacted into a snapshot once the applied entries in it
+	// reach SnapshotEntries entries or SnapshotBytes bytes, 0 disables a limit
+	SnapshotEntries int64
+	SnapshotBytes   int64
+
+	// When set the node never starts an election by itself and the leader
+	// only changes through SetLeader. The tests use this to pin the leader.
+	ManualElection bool
 
-	return
+	// PreVote makes candidates check that they could win before moving to a
+	// new term. CheckQuorum makes a leader that hasn't heard from a majority
+	// within an election timeout step down. Together they keep a server
+	// that rejoins after a partition from deposing a healthy leader.
+	PreVote     bool
+	CheckQuorum bool
+
+	// When set the leader serves reads without a round of heartbeats as long
+	// as a majority acknowledged one recently, see holdsLease. Lease reads
+	// stay correct as long as clocks drift apart by less than
+	// ClockDriftBound, a fraction of the elapsed time.
+	LeaseReads      bool
+	ClockDriftBound float64
+
+	// When set the node is not part of the cluster described by the config
+	// file. It waits for the leader to add it with AddServer and learns the
+	// members from the log.
+	Join bool
+
+	// The leader deletes the blocks no file refers to every GCInterval, 0
+	// leaves it to CollectGarbage. Blocks used within GCGracePeriod are
+	// spared, it must be longer than a client takes from uploading a block
+	// to the UpdateFile that refers to it.
+	GCInterval    time.Duration
+	GCGracePeriod time.Duration
+
+	// How many versions of each file the metastore keeps, the latest
+	// included. Every server of the cluster must keep the same number.
+	HistoryLength int
 }
 
-func NewRaftServer(id int64, ips []string, blockStoreAddr string) (*RaftSurfstore, error) {
-	// TODO any initialization you need to do here
+func DefaultRaftConfig() RaftConfig {
+	return RaftConfig{
+		ElectionTimeoutMin: DEFAULT_ELECTION_TIMEOUT_MIN,
+		ElectionTimeoutMax: DEFAULT_ELECTION_TIMEOUT_MAX,
+		HeartbeatInterval:  DEFAULT_HEARTBEAT_INTERVAL,
+		SnapshotEntries:    DEFAULT_SNAPSHOT_ENTRIES,
+		SnapshotBytes:      DEFAULT_SNAPSHOT_BYTES,
+		ManualElection:     false,
+		PreVote:            true,
+		CheckQuorum:        true,
+		LeaseReads:         false,
+		ClockDriftBound:    DEFAULT_CLOCK_DRIFT_BOUND,
+		Join:               false,
+		GCInterval:         DEFAULT_GC_INTERVAL,
+		GCGracePeriod:      DEFAULT_GC_GRACE_PERIOD,
+		HistoryLength:      DEFAULT_HISTORY_LENGTH,
+	}
+}
 
-	isCrashedMutex := sync.RWMutex{}
+func NewRaftServer(id int64, cluster *ClusterConfig, blockStores *BlockStoreMap, config RaftConfig) (*RaftSurfstore, error) {
+	if id < 0 || id >= int64(len(cluster.Members)) {
+		return nil, fmt.Errorf("server id %d is not in the config (%d servers)", id, len(cluster.Members))
+	}
+	if config.ElectionTimeoutMin <= 0 || config.ElectionTimeoutMax <= config.ElectionTimeoutMin {
+		return nil, fmt.Errorf("invalid election timeout range [%v, %v)", config.ElectionTimeoutMin, config.ElectionTimeoutMax)
+	}
+	if config.SnapshotEntries < 0 || config.SnapshotBytes < 0 {
+		return nil, fmt.Errorf("snapshot thresholds can't be negative")
+	}
+	if config.ClockDriftBound < 0 || config.ClockDriftBound >= 1 {
+		return nil, fmt.Errorf("clock drift bound %v must be in [0, 1)", config.ClockDriftBound)
+	}
+	if config.GCInterval < 0 || config.GCGracePeriod < 0 {
+		return nil, fmt.Errorf("garbage collection interval and grace period can't be negative")
+	}
+	if config.HistoryLength < 1 {
+		return nil, fmt.Errorf("the history has to keep at least the latest version of a file")
+	}
+	if config.HeartbeatInterval <= 0 || config.HeartbeatInterval >= config.ElectionTimeoutMin {
+		return nil, fmt.Errorf("heartbeat interval %v must be positive and below the election timeout", config.HeartbeatInterval)
+	}
 
-	server := RaftSurfstore{
-		// TODO initialize any fields you add here
-		ip:       ips[id],
-		ipList:   ips,
+	server := &RaftSurfstore{
+		ip:       cluster.Members[id].Addr,
 		serverId: id,
+		config:   config,
+
+		snapshotConfig: cluster,
 
-		commitIndex: -1,
-		lastApplied: -1,
+		commitIndex:    -1,
+		lastApplied:    -1,
+		snapshotIndex:  -1,
+		snapshotTerm:   0,
+		pendingCommits: make(map[int64]chan *commitResult),
+		transferTarget: NO_TRANSFER,
+		rpcClients:     make(map[int64]*peerConn),
 
-		isLeader:       false,
-		term:           0,
-		metaStore:      NewMetaStore(blockStoreAddr),
-		log:            make([]*UpdateOperation, 0),
-		isCrashed:      false,
-		notCrashedCond: sync.NewCond(&isCrashedMutex),
-		isCrashedMutex: isCrashedMutex,
+		isLeader:  false,
+		term:      0,
+		votedFor:  NOT_VOTED,
+		leaderId:  UNKNOWN_LEADER,
+		metaStore: NewShardedMetaStore(blockStores),
+		log:       make([]*UpdateOperation, 0),
+		isCrashed: false,
+
+		// every node needs its own seed, otherwise all of them time out together
+		electionRand: rand.New(rand.NewSource(time.Now().UnixNano() + id)),
+	}
+	server.metaStore.HistoryLength = config.HistoryLength
+	if config.Join {
+		server.snapshotConfig = &ClusterConfig{}
 	}
+	server.members = server.snapshotConfig
+	server.notCrashedCond = sync.NewCond(&server.isCrashedMutex)
+	server.resetElectionTimer()
 
-	// connect to clients
+	// pick up where we left off before a restart
+	if config.DataDir != "" {
+		snapshot, snapshotData, err := loadRaftSnapshot(config.DataDir, id)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the raft snapshot: %v", err)
+		}
+		if snapshot != nil {
+			server.snapshotIndex = snapshot.LastIncludedIndex
+			server.snapshotTerm = snapshot.LastIncludedTerm
+			server.snapshotData = snapshotData
+			if snapshot.Config != nil {
+				server.snapshotConfig = snapshot.Config
+			}
+			server.metaStore.restore(snapshot.GetMetaMap().GetFileInfoMap(), snapshot.History, snapshot.BlockStores, snapshot.LastIncludedIndex)
+			server.commitIndex = server.snapshotIndex
+			server.lastApplied = server.snapshotIndex
+		}
+
+		wal, state, err := openRaftWAL(config.DataDir, id, server.snapshotIndex+1)
+		if err != nil {
+			return nil, fmt.Errorf("could not recover the raft state: %v", err)
+		}
+		server.wal = wal
+		server.term = state.term
+		server.votedFor = state.votedFor
+		server.log = state.log
+		server.refreshMembers()
+		if state.commitIndex > server.commitIndex {
+			server.commitIndex = state.commitIndex
+		}
+		if server.commitIndex > server.lastLogIndex() {
+			server.commitIndex = server.lastLogIndex()
+		}
+		server.applyCommitted()
+		log.Printf("server %d recovered term %d with snapshot at %d and %d log entries, %d committed",
+			id, server.term, server.snapshotIndex, len(server.log), server.commitIndex+1)
+	}
 
-	return &server, nil
+	return server, nil
 }
 
-// TODO Start up the Raft server and any services here
+// Start the election timer and serve the raft and metastore RPCs
 func ServeRaftServer(server *RaftSurfstore) error {
+	go server.electionLoop()
+	go server.heartbeatLoop()
+	go server.gcLoop()
+
 	s := grpc.NewServer()
 	RegisterRaftSurfstoreServer(s, server)
 
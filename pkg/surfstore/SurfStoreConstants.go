@@ -1,10 +1,78 @@
 package surfstore
 
+import "time"
+
 const DEFAULT_META_FILENAME string = "index.txt"
 
+// Suffix of the temporary files downloads go to
+const DOWNLOAD_TMP_SUFFIX string = ".surfstore-download"
+
+// How many versions of each file the metastore keeps, the latest included
+const DEFAULT_HISTORY_LENGTH int = 10
+
+// How many of the latest changes the metastore keeps for WatchChanges,
+// watchers further behind get the latest metadata of each file instead
+const WATCH_LOG_LENGTH int = 1000
+
+// Date in the names of conflict copies
+const CONFLICT_COPY_DATE_FORMAT string = "2006-01-02"
+
 const FILENAME_INDEX int = 0
 const VERSION_INDEX int = 1
 const HASH_LIST_INDEX int = 2
 
 const CONFIG_DELIMITER string = ","
+
+// Upper bound on a call the leader makes to a block store
+const BLOCK_STORE_RPC_TIMEOUT time.Duration = 10 * time.Second
+
+// Block storage engines of a block store
+const BLOCK_STORAGE_MEMORY string = "memory"
+const BLOCK_STORAGE_DISK string = "disk"
+
+// Largest block a block store accepts by default, gRPC turns away messages
+// over 4MB
+const DEFAULT_MAX_BLOCK_SIZE int32 = 1 << 20
+
+// Suffix of block files that are still being written
+const BLOCK_TMP_SUFFIX string = ".tmp"
+
+// The codecs block stores accept, NONE included, and the suffix of the
+// block files compressed with them
+var SUPPORTED_COMPRESSIONS = []Compression{Compression_NONE, Compression_GZIP}
+var COMPRESSION_SUFFIXES = map[Compression]string{Compression_NONE: "", Compression_GZIP: ".gz"}
+
+// Size of the keys clients encrypt blocks with, AES-256
+const ENCRYPTION_KEY_SIZE int = 32
+
+// Passphrases are stretched into keys with PBKDF2-HMAC-SHA256
+const PASSPHRASE_SALT string = "surfstore passphrase"
+const PASSPHRASE_ITERATIONS int = 200000
+
+// Points each block store takes on the consistent hash ring
+const DEFAULT_VIRTUAL_NODES int32 = 64
 const HASH_DELIMITER string = " "
+
+// Watching clients sync once the base directory has been quiet for
+// WATCH_DEBOUNCE, and pull remote changes every
+// DEFAULT_WATCH_POLL_INTERVAL
+const WATCH_DEBOUNCE time.Duration = 500 * time.Millisecond
+const DEFAULT_WATCH_POLL_INTERVAL time.Duration = 30 * time.Second
+
+// Files modified less than this long before a scan are hashed again by the
+// next one, their modification time may not show a write right after
+const HASH_CACHE_MIN_AGE time.Duration = 2 * time.Second
+
+// Upper bound on a metastore call of a client, streams aside, and on
+// connecting to a metastore server before the call
+const METASTORE_RPC_TIMEOUT time.Duration = 10 * time.Second
+const METASTORE_DIAL_TIMEOUT time.Duration = 2 * time.Second
+
+// How long a watching client waits before it subscribes to changes again
+// after its stream broke
+const WATCH_RECONNECT_INTERVAL time.Duration = time.Second
+
+// How long clients look for the metastore leader, and how long they wait
+// before asking all servers again
+const LEADER_SEARCH_TIMEOUT time.Duration = 10 * time.Second
+const LEADER_RETRY_INTERVAL time.Duration = 200 * time.Millisecond
@@ -22,6 +22,17 @@ type BlockStoreClient interface {
 	GetBlock(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (*Block, error)
 	PutBlock(ctx context.Context, in *Block, opts ...grpc.CallOption) (*Success, error)
 	HasBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockHashes, error)
+	// stores a stream of blocks, returns the hashes of the blocks it stored
+	PutBlocks(ctx context.Context, opts ...grpc.CallOption) (BlockStore_PutBlocksClient, error)
+	// streams the blocks of the given hashes back in the same order
+	GetBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (BlockStore_GetBlocksClient, error)
+	ListBlocks(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockHashes, error)
+	DeleteBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*Success, error)
+	// deletes the blocks that were neither written nor asked for within the
+	// grace period, returns the ones it deleted
+	DeleteUnusedBlocks(ctx context.Context, in *UnusedBlocks, opts ...grpc.CallOption) (*BlockHashes, error)
+	// the codecs the block store accepts blocks in
+	GetCompressions(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Compressions, error)
 }
 
 type blockStoreClient struct {
@@ -59,6 +70,108 @@ func (c *blockStoreClient) HasBlocks(ctx context.Context, in *BlockHashes, opts
 	return out, nil
 }
 
+func (c *blockStoreClient) PutBlocks(ctx context.Context, opts ...grpc.CallOption) (BlockStore_PutBlocksClient, error) {
+	stream, err := c.cc.NewStream(ctx, &BlockStore_ServiceDesc.Streams[0], "/surfstore.BlockStore/PutBlocks", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &blockStorePutBlocksClient{stream}
+	return x, nil
+}
+
+type BlockStore_PutBlocksClient interface {
+	Send(*Block) error
+	CloseAndRecv() (*BlockHashes, error)
+	grpc.ClientStream
+}
+
+type blockStorePutBlocksClient struct {
+	grpc.ClientStream
+}
+
+func (x *blockStorePutBlocksClient) Send(m *Block) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *blockStorePutBlocksClient) CloseAndRecv() (*BlockHashes, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(BlockHashes)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *blockStoreClient) GetBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (BlockStore_GetBlocksClient, error) {
+	stream, err := c.cc.NewStream(ctx, &BlockStore_ServiceDesc.Streams[1], "/surfstore.BlockStore/GetBlocks", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &blockStoreGetBlocksClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type BlockStore_GetBlocksClient interface {
+	Recv() (*Block, error)
+	grpc.ClientStream
+}
+
+type blockStoreGetBlocksClient struct {
+	grpc.ClientStream
+}
+
+func (x *blockStoreGetBlocksClient) Recv() (*Block, error) {
+	m := new(Block)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *blockStoreClient) ListBlocks(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockHashes, error) {
+	out := new(BlockHashes)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/ListBlocks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) DeleteBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/DeleteBlocks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) DeleteUnusedBlocks(ctx context.Context, in *UnusedBlocks, opts ...grpc.CallOption) (*BlockHashes, error) {
+	out := new(BlockHashes)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/DeleteUnusedBlocks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) GetCompressions(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Compressions, error) {
+	out := new(Compressions)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/GetCompressions", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // BlockStoreServer is the server API for BlockStore service.
 // All implementations must embed UnimplementedBlockStoreServer
 // for forward compatibility
@@ -66,6 +179,17 @@ type BlockStoreServer interface {
 	GetBlock(context.Context, *BlockHash) (*Block, error)
 	PutBlock(context.Context, *Block) (*Success, error)
 	HasBlocks(context.Context, *BlockHashes) (*BlockHashes, error)
+	// stores a stream of blocks, returns the hashes of the blocks it stored
+	PutBlocks(BlockStore_PutBlocksServer) error
+	// streams the blocks of the given hashes back in the same order
+	GetBlocks(*BlockHashes, BlockStore_GetBlocksServer) error
+	ListBlocks(context.Context, *emptypb.Empty) (*BlockHashes, error)
+	DeleteBlocks(context.Context, *BlockHashes) (*Success, error)
+	// deletes the blocks that were neither written nor asked for within the
+	// grace period, returns the ones it deleted
+	DeleteUnusedBlocks(context.Context, *UnusedBlocks) (*BlockHashes, error)
+	// the codecs the block store accepts blocks in
+	GetCompressions(context.Context, *emptypb.Empty) (*Compressions, error)
 	mustEmbedUnimplementedBlockStoreServer()
 }
 
@@ -82,6 +206,24 @@ func (UnimplementedBlockStoreServer) PutBlock(context.Context, *Block) (*Success
 func (UnimplementedBlockStoreServer) HasBlocks(context.Context, *BlockHashes) (*BlockHashes, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method HasBlocks not implemented")
 }
+func (UnimplementedBlockStoreServer) PutBlocks(BlockStore_PutBlocksServer) error {
+	return status.Errorf(codes.Unimplemented, "method PutBlocks not implemented")
+}
+func (UnimplementedBlockStoreServer) GetBlocks(*BlockHashes, BlockStore_GetBlocksServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetBlocks not implemented")
+}
+func (UnimplementedBlockStoreServer) ListBlocks(context.Context, *emptypb.Empty) (*BlockHashes, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListBlocks not implemented")
+}
+func (UnimplementedBlockStoreServer) DeleteBlocks(context.Context, *BlockHashes) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteBlocks not implemented")
+}
+func (UnimplementedBlockStoreServer) DeleteUnusedBlocks(context.Context, *UnusedBlocks) (*BlockHashes, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteUnusedBlocks not implemented")
+}
+func (UnimplementedBlockStoreServer) GetCompressions(context.Context, *emptypb.Empty) (*Compressions, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCompressions not implemented")
+}
 func (UnimplementedBlockStoreServer) mustEmbedUnimplementedBlockStoreServer() {}
 
 // UnsafeBlockStoreServer may be embedded to opt out of forward compatibility for this service.
@@ -149,6 +291,125 @@ func _BlockStore_HasBlocks_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _BlockStore_PutBlocks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(BlockStoreServer).PutBlocks(&blockStorePutBlocksServer{stream})
+}
+
+type BlockStore_PutBlocksServer interface {
+	SendAndClose(*BlockHashes) error
+	Recv() (*Block, error)
+	grpc.ServerStream
+}
+
+type blockStorePutBlocksServer struct {
+	grpc.ServerStream
+}
+
+func (x *blockStorePutBlocksServer) SendAndClose(m *BlockHashes) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *blockStorePutBlocksServer) Recv() (*Block, error) {
+	m := new(Block)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _BlockStore_GetBlocks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(BlockHashes)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BlockStoreServer).GetBlocks(m, &blockStoreGetBlocksServer{stream})
+}
+
+type BlockStore_GetBlocksServer interface {
+	Send(*Block) error
+	grpc.ServerStream
+}
+
+type blockStoreGetBlocksServer struct {
+	grpc.ServerStream
+}
+
+func (x *blockStoreGetBlocksServer) Send(m *Block) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _BlockStore_ListBlocks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).ListBlocks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/ListBlocks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).ListBlocks(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_DeleteBlocks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockHashes)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).DeleteBlocks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/DeleteBlocks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).DeleteBlocks(ctx, req.(*BlockHashes))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_DeleteUnusedBlocks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UnusedBlocks)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).DeleteUnusedBlocks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/DeleteUnusedBlocks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).DeleteUnusedBlocks(ctx, req.(*UnusedBlocks))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_GetCompressions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).GetCompressions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/GetCompressions",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).GetCompressions(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // BlockStore_ServiceDesc is the grpc.ServiceDesc for BlockStore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -168,8 +429,35 @@ var BlockStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "HasBlocks",
 			Handler:    _BlockStore_HasBlocks_Handler,
 		},
+		{
+			MethodName: "ListBlocks",
+			Handler:    _BlockStore_ListBlocks_Handler,
+		},
+		{
+			MethodName: "DeleteBlocks",
+			Handler:    _BlockStore_DeleteBlocks_Handler,
+		},
+		{
+			MethodName: "DeleteUnusedBlocks",
+			Handler:    _BlockStore_DeleteUnusedBlocks_Handler,
+		},
+		{
+			MethodName: "GetCompressions",
+			Handler:    _BlockStore_GetCompressions_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "PutBlocks",
+			Handler:       _BlockStore_PutBlocks_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "GetBlocks",
+			Handler:       _BlockStore_GetBlocks_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
 }
 
@@ -180,6 +468,16 @@ type MetaStoreClient interface {
 	GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error)
 	UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error)
 	GetBlockStoreAddr(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error)
+	GetBlockStoreAddrs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddrs, error)
+	GetBlockStoreMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreMap, error)
+	// streams every change after sinceIndex in order, then each change as
+	// it happens. A client further behind than the server keeps changes
+	// gets them coalesced, the latest metadata of each file changed since.
+	WatchChanges(ctx context.Context, in *WatchChangesInput, opts ...grpc.CallOption) (MetaStore_WatchChangesClient, error)
+	// the versions of a file the metastore kept, oldest first
+	GetFileHistory(ctx context.Context, in *FileHistoryInput, opts ...grpc.CallOption) (*FileHistory, error)
+	// makes a kept version of a file its latest, as a new version
+	RestoreFileVersion(ctx context.Context, in *RestoreFileVersionInput, opts ...grpc.CallOption) (*Version, error)
 }
 
 type metaStoreClient struct {
@@ -217,6 +515,74 @@ func (c *metaStoreClient) GetBlockStoreAddr(ctx context.Context, in *emptypb.Emp
 	return out, nil
 }
 
+func (c *metaStoreClient) GetBlockStoreAddrs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddrs, error) {
+	out := new(BlockStoreAddrs)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetBlockStoreAddrs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetBlockStoreMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreMap, error) {
+	out := new(BlockStoreMap)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetBlockStoreMap", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) WatchChanges(ctx context.Context, in *WatchChangesInput, opts ...grpc.CallOption) (MetaStore_WatchChangesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MetaStore_ServiceDesc.Streams[0], "/surfstore.MetaStore/WatchChanges", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metaStoreWatchChangesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type MetaStore_WatchChangesClient interface {
+	Recv() (*FileChange, error)
+	grpc.ClientStream
+}
+
+type metaStoreWatchChangesClient struct {
+	grpc.ClientStream
+}
+
+func (x *metaStoreWatchChangesClient) Recv() (*FileChange, error) {
+	m := new(FileChange)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *metaStoreClient) GetFileHistory(ctx context.Context, in *FileHistoryInput, opts ...grpc.CallOption) (*FileHistory, error) {
+	out := new(FileHistory)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetFileHistory", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) RestoreFileVersion(ctx context.Context, in *RestoreFileVersionInput, opts ...grpc.CallOption) (*Version, error) {
+	out := new(Version)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/RestoreFileVersion", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MetaStoreServer is the server API for MetaStore service.
 // All implementations must embed UnimplementedMetaStoreServer
 // for forward compatibility
@@ -224,6 +590,16 @@ type MetaStoreServer interface {
 	GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error)
 	UpdateFile(context.Context, *FileMetaData) (*Version, error)
 	GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error)
+	GetBlockStoreAddrs(context.Context, *emptypb.Empty) (*BlockStoreAddrs, error)
+	GetBlockStoreMap(context.Context, *emptypb.Empty) (*BlockStoreMap, error)
+	// streams every change after sinceIndex in order, then each change as
+	// it happens. A client further behind than the server keeps changes
+	// gets them coalesced, the latest metadata of each file changed since.
+	WatchChanges(*WatchChangesInput, MetaStore_WatchChangesServer) error
+	// the versions of a file the metastore kept, oldest first
+	GetFileHistory(context.Context, *FileHistoryInput) (*FileHistory, error)
+	// makes a kept version of a file its latest, as a new version
+	RestoreFileVersion(context.Context, *RestoreFileVersionInput) (*Version, error)
 	mustEmbedUnimplementedMetaStoreServer()
 }
 
@@ -240,6 +616,21 @@ func (UnimplementedMetaStoreServer) UpdateFile(context.Context, *FileMetaData) (
 func (UnimplementedMetaStoreServer) GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddr not implemented")
 }
+func (UnimplementedMetaStoreServer) GetBlockStoreAddrs(context.Context, *emptypb.Empty) (*BlockStoreAddrs, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddrs not implemented")
+}
+func (UnimplementedMetaStoreServer) GetBlockStoreMap(context.Context, *emptypb.Empty) (*BlockStoreMap, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreMap not implemented")
+}
+func (UnimplementedMetaStoreServer) WatchChanges(*WatchChangesInput, MetaStore_WatchChangesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchChanges not implemented")
+}
+func (UnimplementedMetaStoreServer) GetFileHistory(context.Context, *FileHistoryInput) (*FileHistory, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFileHistory not implemented")
+}
+func (UnimplementedMetaStoreServer) RestoreFileVersion(context.Context, *RestoreFileVersionInput) (*Version, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RestoreFileVersion not implemented")
+}
 func (UnimplementedMetaStoreServer) mustEmbedUnimplementedMetaStoreServer() {}
 
 // UnsafeMetaStoreServer may be embedded to opt out of forward compatibility for this service.
@@ -307,6 +698,99 @@ func _MetaStore_GetBlockStoreAddr_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetaStore_GetBlockStoreAddrs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetBlockStoreAddrs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetBlockStoreAddrs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetBlockStoreAddrs(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetBlockStoreMap_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetBlockStoreMap(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetBlockStoreMap",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetBlockStoreMap(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_WatchChanges_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchChangesInput)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MetaStoreServer).WatchChanges(m, &metaStoreWatchChangesServer{stream})
+}
+
+type MetaStore_WatchChangesServer interface {
+	Send(*FileChange) error
+	grpc.ServerStream
+}
+
+type metaStoreWatchChangesServer struct {
+	grpc.ServerStream
+}
+
+func (x *metaStoreWatchChangesServer) Send(m *FileChange) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _MetaStore_GetFileHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileHistoryInput)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetFileHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetFileHistory",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetFileHistory(ctx, req.(*FileHistoryInput))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_RestoreFileVersion_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RestoreFileVersionInput)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).RestoreFileVersion(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/RestoreFileVersion",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).RestoreFileVersion(ctx, req.(*RestoreFileVersionInput))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // MetaStore_ServiceDesc is the grpc.ServiceDesc for MetaStore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -326,8 +810,30 @@ var MetaStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetBlockStoreAddr",
 			Handler:    _MetaStore_GetBlockStoreAddr_Handler,
 		},
+		{
+			MethodName: "GetBlockStoreAddrs",
+			Handler:    _MetaStore_GetBlockStoreAddrs_Handler,
+		},
+		{
+			MethodName: "GetBlockStoreMap",
+			Handler:    _MetaStore_GetBlockStoreMap_Handler,
+		},
+		{
+			MethodName: "GetFileHistory",
+			Handler:    _MetaStore_GetFileHistory_Handler,
+		},
+		{
+			MethodName: "RestoreFileVersion",
+			Handler:    _MetaStore_RestoreFileVersion_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchChanges",
+			Handler:       _MetaStore_WatchChanges_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
 }
 
@@ -337,12 +843,34 @@ var MetaStore_ServiceDesc = grpc.ServiceDesc{
 type RaftSurfstoreClient interface {
 	// raft
 	AppendEntries(ctx context.Context, in *AppendEntryInput, opts ...grpc.CallOption) (*AppendEntryOutput, error)
+	RequestVote(ctx context.Context, in *RequestVoteInput, opts ...grpc.CallOption) (*RequestVoteOutput, error)
+	InstallSnapshot(ctx context.Context, in *InstallSnapshotInput, opts ...grpc.CallOption) (*InstallSnapshotOutput, error)
+	TimeoutNow(ctx context.Context, in *TimeoutNowInput, opts ...grpc.CallOption) (*TimeoutNowOutput, error)
 	SetLeader(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error)
 	SendHeartbeat(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error)
+	// membership, only served by the leader
+	AddServer(ctx context.Context, in *RaftMember, opts ...grpc.CallOption) (*Success, error)
+	RemoveServer(ctx context.Context, in *RaftMember, opts ...grpc.CallOption) (*Success, error)
+	PromoteLearner(ctx context.Context, in *RaftMember, opts ...grpc.CallOption) (*Success, error)
+	TransferLeadership(ctx context.Context, in *TransferLeadershipInput, opts ...grpc.CallOption) (*Success, error)
+	// adds a block store to the hash ring and moves blocks onto it
+	AddBlockStore(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*Success, error)
+	// deletes the blocks no file refers to, returns the ones it deleted
+	CollectGarbage(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockHashes, error)
 	// metastore
 	GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error)
 	UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error)
 	GetBlockStoreAddr(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error)
+	GetBlockStoreAddrs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddrs, error)
+	GetBlockStoreMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreMap, error)
+	// streams committed changes with their log index, coalesced like on
+	// MetaStore if the client is far behind. The stream ends when the
+	// server stops being the leader.
+	WatchChanges(ctx context.Context, in *WatchChangesInput, opts ...grpc.CallOption) (RaftSurfstore_WatchChangesClient, error)
+	GetFileHistory(ctx context.Context, in *FileHistoryInput, opts ...grpc.CallOption) (*FileHistory, error)
+	RestoreFileVersion(ctx context.Context, in *RestoreFileVersionInput, opts ...grpc.CallOption) (*Version, error)
+	// served by every member from its own metastore, which may lag behind
+	GetFileInfoMapStale(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error)
 	// testing interface
 	GetInternalState(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RaftInternalState, error)
 	IsCrashed(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*CrashedState, error)
@@ -367,6 +895,33 @@ func (c *raftSurfstoreClient) AppendEntries(ctx context.Context, in *AppendEntry
 	return out, nil
 }
 
+func (c *raftSurfstoreClient) RequestVote(ctx context.Context, in *RequestVoteInput, opts ...grpc.CallOption) (*RequestVoteOutput, error) {
+	out := new(RequestVoteOutput)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/RequestVote", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) InstallSnapshot(ctx context.Context, in *InstallSnapshotInput, opts ...grpc.CallOption) (*InstallSnapshotOutput, error) {
+	out := new(InstallSnapshotOutput)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/InstallSnapshot", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) TimeoutNow(ctx context.Context, in *TimeoutNowInput, opts ...grpc.CallOption) (*TimeoutNowOutput, error) {
+	out := new(TimeoutNowOutput)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/TimeoutNow", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *raftSurfstoreClient) SetLeader(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error) {
 	out := new(Success)
 	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/SetLeader", in, out, opts...)
@@ -376,36 +931,167 @@ func (c *raftSurfstoreClient) SetLeader(ctx context.Context, in *emptypb.Empty,
 	return out, nil
 }
 
-func (c *raftSurfstoreClient) SendHeartbeat(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error) {
-	out := new(Success)
-	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/SendHeartbeat", in, out, opts...)
-	if err != nil {
+func (c *raftSurfstoreClient) SendHeartbeat(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/SendHeartbeat", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) AddServer(ctx context.Context, in *RaftMember, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/AddServer", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) RemoveServer(ctx context.Context, in *RaftMember, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/RemoveServer", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) PromoteLearner(ctx context.Context, in *RaftMember, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/PromoteLearner", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) TransferLeadership(ctx context.Context, in *TransferLeadershipInput, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/TransferLeadership", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) AddBlockStore(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/AddBlockStore", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) CollectGarbage(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockHashes, error) {
+	out := new(BlockHashes)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/CollectGarbage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error) {
+	out := new(FileInfoMap)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetFileInfoMap", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error) {
+	out := new(Version)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/UpdateFile", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) GetBlockStoreAddr(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error) {
+	out := new(BlockStoreAddr)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetBlockStoreAddr", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) GetBlockStoreAddrs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddrs, error) {
+	out := new(BlockStoreAddrs)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetBlockStoreAddrs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) GetBlockStoreMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreMap, error) {
+	out := new(BlockStoreMap)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetBlockStoreMap", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) WatchChanges(ctx context.Context, in *WatchChangesInput, opts ...grpc.CallOption) (RaftSurfstore_WatchChangesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &RaftSurfstore_ServiceDesc.Streams[0], "/surfstore.RaftSurfstore/WatchChanges", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &raftSurfstoreWatchChangesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type RaftSurfstore_WatchChangesClient interface {
+	Recv() (*FileChange, error)
+	grpc.ClientStream
+}
+
+type raftSurfstoreWatchChangesClient struct {
+	grpc.ClientStream
+}
+
+func (x *raftSurfstoreWatchChangesClient) Recv() (*FileChange, error) {
+	m := new(FileChange)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
 		return nil, err
 	}
-	return out, nil
+	return m, nil
 }
 
-func (c *raftSurfstoreClient) GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error) {
-	out := new(FileInfoMap)
-	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetFileInfoMap", in, out, opts...)
+func (c *raftSurfstoreClient) GetFileHistory(ctx context.Context, in *FileHistoryInput, opts ...grpc.CallOption) (*FileHistory, error) {
+	out := new(FileHistory)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetFileHistory", in, out, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-func (c *raftSurfstoreClient) UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error) {
+func (c *raftSurfstoreClient) RestoreFileVersion(ctx context.Context, in *RestoreFileVersionInput, opts ...grpc.CallOption) (*Version, error) {
 	out := new(Version)
-	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/UpdateFile", in, out, opts...)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/RestoreFileVersion", in, out, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-func (c *raftSurfstoreClient) GetBlockStoreAddr(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error) {
-	out := new(BlockStoreAddr)
-	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetBlockStoreAddr", in, out, opts...)
+func (c *raftSurfstoreClient) GetFileInfoMapStale(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error) {
+	out := new(FileInfoMap)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetFileInfoMapStale", in, out, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -454,12 +1140,34 @@ func (c *raftSurfstoreClient) Crash(ctx context.Context, in *emptypb.Empty, opts
 type RaftSurfstoreServer interface {
 	// raft
 	AppendEntries(context.Context, *AppendEntryInput) (*AppendEntryOutput, error)
+	RequestVote(context.Context, *RequestVoteInput) (*RequestVoteOutput, error)
+	InstallSnapshot(context.Context, *InstallSnapshotInput) (*InstallSnapshotOutput, error)
+	TimeoutNow(context.Context, *TimeoutNowInput) (*TimeoutNowOutput, error)
 	SetLeader(context.Context, *emptypb.Empty) (*Success, error)
 	SendHeartbeat(context.Context, *emptypb.Empty) (*Success, error)
+	// membership, only served by the leader
+	AddServer(context.Context, *RaftMember) (*Success, error)
+	RemoveServer(context.Context, *RaftMember) (*Success, error)
+	PromoteLearner(context.Context, *RaftMember) (*Success, error)
+	TransferLeadership(context.Context, *TransferLeadershipInput) (*Success, error)
+	// adds a block store to the hash ring and moves blocks onto it
+	AddBlockStore(context.Context, *BlockStoreAddr) (*Success, error)
+	// deletes the blocks no file refers to, returns the ones it deleted
+	CollectGarbage(context.Context, *emptypb.Empty) (*BlockHashes, error)
 	// metastore
 	GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error)
 	UpdateFile(context.Context, *FileMetaData) (*Version, error)
 	GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error)
+	GetBlockStoreAddrs(context.Context, *emptypb.Empty) (*BlockStoreAddrs, error)
+	GetBlockStoreMap(context.Context, *emptypb.Empty) (*BlockStoreMap, error)
+	// streams committed changes with their log index, coalesced like on
+	// MetaStore if the client is far behind. The stream ends when the
+	// server stops being the leader.
+	WatchChanges(*WatchChangesInput, RaftSurfstore_WatchChangesServer) error
+	GetFileHistory(context.Context, *FileHistoryInput) (*FileHistory, error)
+	RestoreFileVersion(context.Context, *RestoreFileVersionInput) (*Version, error)
+	// served by every member from its own metastore, which may lag behind
+	GetFileInfoMapStale(context.Context, *emptypb.Empty) (*FileInfoMap, error)
 	// testing interface
 	GetInternalState(context.Context, *emptypb.Empty) (*RaftInternalState, error)
 	IsCrashed(context.Context, *emptypb.Empty) (*CrashedState, error)
@@ -475,12 +1183,39 @@ type UnimplementedRaftSurfstoreServer struct {
 func (UnimplementedRaftSurfstoreServer) AppendEntries(context.Context, *AppendEntryInput) (*AppendEntryOutput, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method AppendEntries not implemented")
 }
+func (UnimplementedRaftSurfstoreServer) RequestVote(context.Context, *RequestVoteInput) (*RequestVoteOutput, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RequestVote not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) InstallSnapshot(context.Context, *InstallSnapshotInput) (*InstallSnapshotOutput, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method InstallSnapshot not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) TimeoutNow(context.Context, *TimeoutNowInput) (*TimeoutNowOutput, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TimeoutNow not implemented")
+}
 func (UnimplementedRaftSurfstoreServer) SetLeader(context.Context, *emptypb.Empty) (*Success, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SetLeader not implemented")
 }
 func (UnimplementedRaftSurfstoreServer) SendHeartbeat(context.Context, *emptypb.Empty) (*Success, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SendHeartbeat not implemented")
 }
+func (UnimplementedRaftSurfstoreServer) AddServer(context.Context, *RaftMember) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddServer not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) RemoveServer(context.Context, *RaftMember) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveServer not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) PromoteLearner(context.Context, *RaftMember) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PromoteLearner not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) TransferLeadership(context.Context, *TransferLeadershipInput) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TransferLeadership not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) AddBlockStore(context.Context, *BlockStoreAddr) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddBlockStore not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) CollectGarbage(context.Context, *emptypb.Empty) (*BlockHashes, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CollectGarbage not implemented")
+}
 func (UnimplementedRaftSurfstoreServer) GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetFileInfoMap not implemented")
 }
@@ -490,6 +1225,24 @@ func (UnimplementedRaftSurfstoreServer) UpdateFile(context.Context, *FileMetaDat
 func (UnimplementedRaftSurfstoreServer) GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddr not implemented")
 }
+func (UnimplementedRaftSurfstoreServer) GetBlockStoreAddrs(context.Context, *emptypb.Empty) (*BlockStoreAddrs, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddrs not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) GetBlockStoreMap(context.Context, *emptypb.Empty) (*BlockStoreMap, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreMap not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) WatchChanges(*WatchChangesInput, RaftSurfstore_WatchChangesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchChanges not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) GetFileHistory(context.Context, *FileHistoryInput) (*FileHistory, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFileHistory not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) RestoreFileVersion(context.Context, *RestoreFileVersionInput) (*Version, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RestoreFileVersion not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) GetFileInfoMapStale(context.Context, *emptypb.Empty) (*FileInfoMap, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFileInfoMapStale not implemented")
+}
 func (UnimplementedRaftSurfstoreServer) GetInternalState(context.Context, *emptypb.Empty) (*RaftInternalState, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetInternalState not implemented")
 }
@@ -533,6 +1286,60 @@ func _RaftSurfstore_AppendEntries_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _RaftSurfstore_RequestVote_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RequestVoteInput)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).RequestVote(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/RequestVote",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).RequestVote(ctx, req.(*RequestVoteInput))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_InstallSnapshot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InstallSnapshotInput)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).InstallSnapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/InstallSnapshot",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).InstallSnapshot(ctx, req.(*InstallSnapshotInput))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_TimeoutNow_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TimeoutNowInput)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).TimeoutNow(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/TimeoutNow",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).TimeoutNow(ctx, req.(*TimeoutNowInput))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _RaftSurfstore_SetLeader_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(emptypb.Empty)
 	if err := dec(in); err != nil {
@@ -569,6 +1376,114 @@ func _RaftSurfstore_SendHeartbeat_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _RaftSurfstore_AddServer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RaftMember)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).AddServer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/AddServer",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).AddServer(ctx, req.(*RaftMember))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_RemoveServer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RaftMember)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).RemoveServer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/RemoveServer",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).RemoveServer(ctx, req.(*RaftMember))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_PromoteLearner_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RaftMember)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).PromoteLearner(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/PromoteLearner",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).PromoteLearner(ctx, req.(*RaftMember))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_TransferLeadership_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TransferLeadershipInput)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).TransferLeadership(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/TransferLeadership",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).TransferLeadership(ctx, req.(*TransferLeadershipInput))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_AddBlockStore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockStoreAddr)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).AddBlockStore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/AddBlockStore",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).AddBlockStore(ctx, req.(*BlockStoreAddr))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_CollectGarbage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).CollectGarbage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/CollectGarbage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).CollectGarbage(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _RaftSurfstore_GetFileInfoMap_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(emptypb.Empty)
 	if err := dec(in); err != nil {
@@ -623,6 +1538,117 @@ func _RaftSurfstore_GetBlockStoreAddr_Handler(srv interface{}, ctx context.Conte
 	return interceptor(ctx, in, info, handler)
 }
 
+func _RaftSurfstore_GetBlockStoreAddrs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).GetBlockStoreAddrs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/GetBlockStoreAddrs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).GetBlockStoreAddrs(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_GetBlockStoreMap_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).GetBlockStoreMap(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/GetBlockStoreMap",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).GetBlockStoreMap(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_WatchChanges_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchChangesInput)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RaftSurfstoreServer).WatchChanges(m, &raftSurfstoreWatchChangesServer{stream})
+}
+
+type RaftSurfstore_WatchChangesServer interface {
+	Send(*FileChange) error
+	grpc.ServerStream
+}
+
+type raftSurfstoreWatchChangesServer struct {
+	grpc.ServerStream
+}
+
+func (x *raftSurfstoreWatchChangesServer) Send(m *FileChange) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _RaftSurfstore_GetFileHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileHistoryInput)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).GetFileHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/GetFileHistory",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).GetFileHistory(ctx, req.(*FileHistoryInput))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_RestoreFileVersion_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RestoreFileVersionInput)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).RestoreFileVersion(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/RestoreFileVersion",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).RestoreFileVersion(ctx, req.(*RestoreFileVersionInput))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_GetFileInfoMapStale_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).GetFileInfoMapStale(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/GetFileInfoMapStale",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).GetFileInfoMapStale(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _RaftSurfstore_GetInternalState_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(emptypb.Empty)
 	if err := dec(in); err != nil {
@@ -706,6 +1732,18 @@ var RaftSurfstore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "AppendEntries",
 			Handler:    _RaftSurfstore_AppendEntries_Handler,
 		},
+		{
+			MethodName: "RequestVote",
+			Handler:    _RaftSurfstore_RequestVote_Handler,
+		},
+		{
+			MethodName: "InstallSnapshot",
+			Handler:    _RaftSurfstore_InstallSnapshot_Handler,
+		},
+		{
+			MethodName: "TimeoutNow",
+			Handler:    _RaftSurfstore_TimeoutNow_Handler,
+		},
 		{
 			MethodName: "SetLeader",
 			Handler:    _RaftSurfstore_SetLeader_Handler,
@@ -714,6 +1752,30 @@ var RaftSurfstore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "SendHeartbeat",
 			Handler:    _RaftSurfstore_SendHeartbeat_Handler,
 		},
+		{
+			MethodName: "AddServer",
+			Handler:    _RaftSurfstore_AddServer_Handler,
+		},
+		{
+			MethodName: "RemoveServer",
+			Handler:    _RaftSurfstore_RemoveServer_Handler,
+		},
+		{
+			MethodName: "PromoteLearner",
+			Handler:    _RaftSurfstore_PromoteLearner_Handler,
+		},
+		{
+			MethodName: "TransferLeadership",
+			Handler:    _RaftSurfstore_TransferLeadership_Handler,
+		},
+		{
+			MethodName: "AddBlockStore",
+			Handler:    _RaftSurfstore_AddBlockStore_Handler,
+		},
+		{
+			MethodName: "CollectGarbage",
+			Handler:    _RaftSurfstore_CollectGarbage_Handler,
+		},
 		{
 			MethodName: "GetFileInfoMap",
 			Handler:    _RaftSurfstore_GetFileInfoMap_Handler,
@@ -726,6 +1788,26 @@ var RaftSurfstore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetBlockStoreAddr",
 			Handler:    _RaftSurfstore_GetBlockStoreAddr_Handler,
 		},
+		{
+			MethodName: "GetBlockStoreAddrs",
+			Handler:    _RaftSurfstore_GetBlockStoreAddrs_Handler,
+		},
+		{
+			MethodName: "GetBlockStoreMap",
+			Handler:    _RaftSurfstore_GetBlockStoreMap_Handler,
+		},
+		{
+			MethodName: "GetFileHistory",
+			Handler:    _RaftSurfstore_GetFileHistory_Handler,
+		},
+		{
+			MethodName: "RestoreFileVersion",
+			Handler:    _RaftSurfstore_RestoreFileVersion_Handler,
+		},
+		{
+			MethodName: "GetFileInfoMapStale",
+			Handler:    _RaftSurfstore_GetFileInfoMapStale_Handler,
+		},
 		{
 			MethodName: "GetInternalState",
 			Handler:    _RaftSurfstore_GetInternalState_Handler,
@@ -743,6 +1825,12 @@ var RaftSurfstore_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _RaftSurfstore_Crash_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchChanges",
+			Handler:       _RaftSurfstore_WatchChanges_Handler,
+			ServerStreams: true,
+		},
+	},
 	Metadata: "pkg/surfstore/SurfStore.proto",
 }
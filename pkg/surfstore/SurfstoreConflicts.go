@@ -0,0 +1,117 @@
+package surfstore
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// conflictCopy is a local version of filename that lost against a remote
+// edit, moved out of the way to copyName
+type conflictCopy struct {
+	filename string
+	copyName string
+}
+
+// conflictCopies keeps the local edits a sync would otherwise overwrite.
+// Each goes to a copy next to its file, e.g.
+//
+//	report (conflicted copy from host 2026-10-18).txt
+//
+// which the sync then uploads like any new file.
+type conflictCopies struct {
+	client *RPCClient
+	host   string
+	date   time.Time
+	// names that are in use locally or remotely, a copy gets none of them
+	taken  map[string]bool
+	copies []conflictCopy
+}
+
+func newConflictCopies(client *RPCClient, indexes ...map[string]*FileMetaData) *conflictCopies {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown host"
+	}
+	c := &conflictCopies{client: client, host: host, date: time.Now(), taken: make(map[string]bool)}
+	for _, index := range indexes {
+		for filename := range index {
+			c.taken[filename] = true
+		}
+	}
+	return c
+}
+
+// keep moves the local file filename to a conflict copy, and tells whether
+// it did. Directory entries have no content to lose.
+func (c *conflictCopies) keep(filename string) bool {
+	if isDirEntry(filename) {
+		return false
+	}
+	var copyName string
+	for n := 1; ; n++ {
+		copyName = conflictCopyName(filename, c.host, c.date, n)
+		if c.taken[copyName] {
+			continue
+		}
+		if _, err := os.Lstat(ConcatPath(c.client.BaseDir, copyName)); os.IsNotExist(err) {
+			break
+		}
+	}
+	check(os.Rename(ConcatPath(c.client.BaseDir, filename), ConcatPath(c.client.BaseDir, copyName)))
+	c.taken[copyName] = true
+	c.copies = append(c.copies, conflictCopy{filename: filename, copyName: copyName})
+	return true
+}
+
+// conflictCopyName names the nth conflict copy of filename, the copy
+// number goes after the date from the second copy on
+func conflictCopyName(filename string, host string, date time.Time, n int) string {
+	dir, base := path.Split(filename)
+	ext := path.Ext(base)
+	if ext == base {
+		// a dot file, like .profile
+		ext = ""
+	}
+	label := fmt.Sprintf("conflicted copy from %s %s", host, date.Format(CONFLICT_COPY_DATE_FORMAT))
+	if n > 1 {
+		label += fmt.Sprintf(" %d", n)
+	}
+	return dir + strings.TrimSuffix(base, ext) + " (" + label + ")" + ext
+}
+
+// upload syncs the copies as new files and adds them to localMeta. A copy
+// whose name another client took in the meantime is left for the next sync.
+func (c *conflictCopies) upload(blockStores *ConsistentHashRing, localMeta map[string]*FileMetaData) {
+	for _, conflict := range c.copies {
+		hashes, err := hashFile(c.client, ConcatPath(c.client.BaseDir, conflict.copyName))
+		check(err)
+		uploadFile(c.client, blockStores, conflict.copyName, nil)
+		fileMetaData := &FileMetaData{Filename: conflict.copyName, Version: 1, BlockHashList: hashes}
+		var latestVersion int32
+		check(c.client.UpdateFile(fileMetaData, &latestVersion))
+		if latestVersion == -1 {
+			log.Printf("Could not upload conflict copy %s, its name is taken", conflict.copyName)
+			continue
+		}
+		localMeta[conflict.copyName] = fileMetaData
+	}
+}
+
+// report prints which local edits were kept as conflict copies
+func (c *conflictCopies) report() {
+	if len(c.copies) == 0 {
+		return
+	}
+	if len(c.copies) == 1 {
+		fmt.Println("1 conflict, the local version was kept as a copy:")
+	} else {
+		fmt.Printf("%d conflicts, the local versions were kept as copies:\n", len(c.copies))
+	}
+	for _, conflict := range c.copies {
+		fmt.Printf("  %s -> %s\n", conflict.filename, conflict.copyName)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -39,7 +40,7 @@ func ConcatPath(baseDir, fileDir string) string {
 func NewFileMetaDataFromConfig(configString string) *FileMetaData {
 	configItems := strings.Split(configString, CONFIG_DELIMITER)
 
-	filename := configItems[FILENAME_INDEX]
+	filename := UnescapeIndexName(configItems[FILENAME_INDEX])
 	version, _ := strconv.Atoi(configItems[VERSION_INDEX])
 	blockHashList := strings.Split(configItems[HASH_LIST_INDEX], HASH_DELIMITER)
 
@@ -97,7 +98,7 @@ func LoadMetaFromMetaFile(baseDir string) (fileMetaMap map[string]*FileMetaData,
 // FileMetaDataToString converts a FileMetaData struct
 // to a string for writing back to local metadata file
 func FileMetaDataToString(fm *FileMetaData) (result string) {
-	result += fm.Filename + ","
+	result += EscapeIndexName(fm.Filename) + CONFIG_DELIMITER
 	result += strconv.Itoa(int(fm.Version)) + ","
 
 	for _, blockHash := range fm.BlockHashList {
@@ -108,6 +109,33 @@ func FileMetaDataToString(fm *FileMetaData) (result string) {
 	return
 }
 
+// EscapeIndexName escapes the characters of a file name that would break
+// its line in the local metadata file, the delimiters and line breaks, as
+// %XX. '%' itself is escaped too.
+func EscapeIndexName(name string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '%' || c < 0x20 || c == 0x7f || strings.IndexByte(CONFIG_DELIMITER+HASH_DELIMITER, c) >= 0 {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		} else {
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+// UnescapeIndexName undoes EscapeIndexName. Names that aren't escaped
+// properly, e.g. from an index written before names were escaped, are
+// returned as they are.
+func UnescapeIndexName(escaped string) string {
+	name, err := url.PathUnescape(escaped)
+	if err != nil {
+		return escaped
+	}
+	return name
+}
+
 // WriteMetaFile writes the file meta map back to local metadata file
 func WriteMetaFile(fileMetas map[string]*FileMetaData, baseDir string) error {
 	outputMetaPath := ConcatPath(baseDir, DEFAULT_META_FILENAME)
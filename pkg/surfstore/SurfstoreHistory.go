@@ -0,0 +1,38 @@
+package surfstore
+
+import (
+	"fmt"
+	"os"
+)
+
+// DownloadFileVersion writes a kept version of filename to dest, leaving
+// the base directory alone
+func DownloadFileVersion(client RPCClient, filename string, version int32, dest string) error {
+	defer client.Close()
+	var versions []*FileVersion
+	if err := client.GetFileHistory(filename, &versions); err != nil {
+		return err
+	}
+	var kept *FileMetaData
+	for _, fileVersion := range versions {
+		if fileVersion.GetFileMetaData().GetVersion() == version {
+			kept = fileVersion.GetFileMetaData()
+		}
+	}
+	if kept == nil {
+		return fmt.Errorf("version %d of %s is not kept", version, filename)
+	}
+	hashList := kept.GetBlockHashList()
+	if len(hashList) == 1 && hashList[0] == "0" {
+		return fmt.Errorf("version %d of %s is its deletion", version, filename)
+	}
+	if isDirEntry(filename) {
+		return os.MkdirAll(dest, 0755)
+	}
+
+	blockStoreMap := &BlockStoreMap{}
+	if err := client.GetBlockStoreMap(blockStoreMap); err != nil {
+		return err
+	}
+	return downloadTo(&client, NewConsistentHashRing(blockStoreMap), dest, hashList)
+}
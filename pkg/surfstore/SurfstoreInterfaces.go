@@ -15,6 +15,18 @@ type MetaStoreInterface interface {
 
 	// Get the the BlockStore address
 	GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddr, error)
+
+	// Get the addresses of every BlockStore replica and the write quorum
+	GetBlockStoreAddrs(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddrs, error)
+
+	// Get the hash ring that spreads blocks over the BlockStores
+	GetBlockStoreMap(ctx context.Context, _ *emptypb.Empty) (*BlockStoreMap, error)
+
+	// Get the kept versions of a file
+	GetFileHistory(ctx context.Context, input *FileHistoryInput) (*FileHistory, error)
+
+	// Make a kept version of a file its latest
+	RestoreFileVersion(ctx context.Context, input *RestoreFileVersionInput) (*Version, error)
 }
 
 type BlockStoreInterface interface {
@@ -28,6 +40,24 @@ type BlockStoreInterface interface {
 	// Given a list of hashes “in”, returns a list containing the
 	// subset of in that are stored in the key-value store
 	HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error)
+
+	// Put every block of the stream, returns the hashes of the stored blocks
+	PutBlocks(stream BlockStore_PutBlocksServer) error
+
+	// Stream the blocks of the given hashes in order
+	GetBlocks(blockHashes *BlockHashes, stream BlockStore_GetBlocksServer) error
+
+	// Returns the hashes of every block in the store
+	ListBlocks(ctx context.Context, _ *emptypb.Empty) (*BlockHashes, error)
+
+	// Removes the given blocks, hashes that aren't stored are ignored
+	DeleteBlocks(ctx context.Context, blockHashes *BlockHashes) (*Success, error)
+
+	// Removes the given blocks that were not used within the grace period
+	DeleteUnusedBlocks(ctx context.Context, unused *UnusedBlocks) (*BlockHashes, error)
+
+	// Returns the codecs blocks can be put in
+	GetCompressions(ctx context.Context, _ *emptypb.Empty) (*Compressions, error)
 }
 
 type ClientInterface interface {
@@ -35,9 +65,23 @@ type ClientInterface interface {
 	GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error
 	UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error
 	GetBlockStoreAddr(blockStoreAddr *string) error
+	GetBlockStoreAddrs(blockStores *BlockStoreAddrs) error
+	GetBlockStoreMap(blockStores *BlockStoreMap) error
+	WatchChanges(sinceIndex int64, handle func(change *FileChange)) error
+	GetFileHistory(filename string, versions *[]*FileVersion) error
+	RestoreFileVersion(filename string, version int32, latestVersion *int32) error
 
 	// BlockStore
 	GetBlock(blockHash string, blockStoreAddr string, block *Block) error
 	PutBlock(block *Block, blockStoreAddr string, succ *bool) error
 	HasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error
+	GetBlocks(blockHashes []string, blockStoreAddr string, handle func(block *Block) error) error
+	PutBlocks(next func() (*Block, error), blockStoreAddr string, stored *[]string) error
+
+	// BlockStores on the hash ring
+	GetReplicatedBlock(blockHash string, ring *ConsistentHashRing, block *Block) error
+	PutReplicatedBlock(block *Block, ring *ConsistentHashRing, succ *bool) error
+	HasReplicatedBlocks(blockHashesIn []string, ring *ConsistentHashRing, blockHashesOut *[]string) error
+	GetReplicatedBlocks(blockHashes []string, ring *ConsistentHashRing, handle func(block *Block) error) error
+	PutReplicatedBlocks(next func() (*Block, error), ring *ConsistentHashRing, succ *bool) error
 }
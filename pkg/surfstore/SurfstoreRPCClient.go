@@ -2,10 +2,15 @@ package surfstore
 
 import (
 	context "context"
-	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -13,151 +18,862 @@ type RPCClient struct {
 	MetaStoreAddrs []string
 	BaseDir        string
 	BlockSize      int
+	// codec blocks are sent in, if the block store accepts it
+	Compression Compression
+	// encrypts blocks and file names before they leave the client, nil to
+	// send them as they are
+	Encryption *BlockEncryption
+	// who the versions this client makes are by, in the file history
+	Author string
+
+	// the metastore server that answered last, tried first next time
+	leaderAddr string
+
+	// connections to the block stores, kept open for the whole sync
+	blockConns *blockStoreConns
+
+	// the hashes of the files earlier syncs read, nil unless watching
+	hashCache map[string]*cachedHashes
+}
+
+// blockStoreConns is shared by the copies of an RPCClient
+type blockStoreConns struct {
+	mtx   sync.Mutex
+	conns map[string]*grpc.ClientConn
+	// the codec each block store gets blocks in
+	compressions map[string]Compression
 }
 
 // BlockStore
 func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, block *Block) error {
 	// connect to the server
-
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	c, err := surfClient.blockStoreClient(blockStoreAddr)
 	if err != nil {
 		return err
 	}
-	c := NewBlockStoreClient(conn)
 	// perform the call
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 	b, err := c.GetBlock(ctx, &BlockHash{Hash: blockHash})
 	if err != nil {
-		conn.Close()
 		return err
 	}
+	// never hand out data that isn't the block we asked for
+	b, err = openBlock(blockHash, b)
+	if err != nil {
+		return fmt.Errorf("block store %s returned corrupt data for block %s: %v", blockStoreAddr, blockHash, err)
+	}
 	block.BlockData = b.BlockData
 	block.BlockSize = b.BlockSize
-	// close the connection
-	return conn.Close()
+	return nil
 }
 
 func (surfClient *RPCClient) PutBlock(block *Block, blockStoreAddr string, succ *bool) error {
-
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	c, err := surfClient.blockStoreClient(blockStoreAddr)
 	if err != nil {
 		return err
 	}
-	c := NewBlockStoreClient(conn)
 	// perform the call
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	success, err := c.PutBlock(ctx, &Block{BlockData: block.BlockData, BlockSize: block.BlockSize})
-
+	compressed, err := CompressBlock(block, surfClient.compressionFor(blockStoreAddr))
+	if err != nil {
+		return err
+	}
+	success, err := c.PutBlock(ctx, compressed)
 	if err != nil {
-		conn.Close()
 		return err
 	}
 	*succ = success.Flag
-	// close the connection
-	return conn.Close()
+	return nil
 }
 
 func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error {
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	c, err := surfClient.blockStoreClient(blockStoreAddr)
 	if err != nil {
 		return err
 	}
-	c := NewBlockStoreClient(conn)
 	// perform the call
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 	hashOut, err := c.HasBlocks(ctx, &BlockHashes{Hashes: blockHashesIn})
 	if err != nil {
-		conn.Close()
 		return err
 	}
 	*blockHashesOut = hashOut.Hashes
-	// close the connection
-	return conn.Close()
+	return nil
 }
 
-// MetaStore
-func (surfClient *RPCClient) GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error {
-	// connect to the server
-	for _, addr := range surfClient.MetaStoreAddrs {
-		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+// GetBlocks streams the blocks blockHashes from one block store and hands
+// them to handle in order. gRPC flow control holds the block store back
+// while handle is busy.
+func (surfClient *RPCClient) GetBlocks(blockHashes []string, blockStoreAddr string, handle func(block *Block) error) error {
+	c, err := surfClient.blockStoreClient(blockStoreAddr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := c.GetBlocks(ctx, &BlockHashes{Hashes: blockHashes})
+	if err != nil {
+		return err
+	}
+	for _, hash := range blockHashes {
+		block, err := stream.Recv()
 		if err != nil {
 			return err
 		}
-		c := NewRaftSurfstoreClient(conn)
-		// perform the call
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-		defer cancel()
-		fInfo, err := c.GetFileInfoMap(ctx, &emptypb.Empty{})
-		if errors.Is(err, ERR_NOT_LEADER) { // continue looking for leader
-			continue
+		block, err = openBlock(hash, block)
+		if err != nil {
+			return fmt.Errorf("block store %s returned corrupt data for block %s: %v", blockStoreAddr, hash, err)
+		}
+		if err := handle(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutBlocks streams the blocks next returns to one block store until it
+// returns nil. Send waits while the block store is behind, so next is only
+// asked for another block once there is room for it.
+func (surfClient *RPCClient) PutBlocks(next func() (*Block, error), blockStoreAddr string, stored *[]string) error {
+	c, err := surfClient.blockStoreClient(blockStoreAddr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := c.PutBlocks(ctx)
+	if err != nil {
+		return err
+	}
+	compression := surfClient.compressionFor(blockStoreAddr)
+	for {
+		block, err := next()
+		if err != nil {
+			return err
 		}
+		if block == nil {
+			break
+		}
+		block, err = CompressBlock(block, compression)
 		if err != nil {
-			conn.Close()
 			return err
+		}
+		if err := stream.Send(block); err != nil {
+			// the reason comes with CloseAndRecv
+			break
+		}
+	}
+	hashes, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	*stored = hashes.Hashes
+	return nil
+}
 
+// GetReplicatedBlock reads a block from the first of its block stores that
+// has an intact copy. If none of them does, e.g. while blocks move after a
+// block store joined, it asks the other block stores.
+func (surfClient *RPCClient) GetReplicatedBlock(blockHash string, ring *ConsistentHashRing, block *Block) error {
+	addrs := ring.GetResponsibleServers(blockHash)
+	for _, addr := range ring.Addrs {
+		if !stringExist(addr, addrs) {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	lastErr := fmt.Errorf("block %s is on none of the block stores", blockHash)
+	for _, addr := range addrs {
+		replica := &Block{}
+		if err := surfClient.GetBlock(blockHash, addr, replica); err != nil {
+			lastErr = err
+			continue
+		}
+		block.BlockData = replica.BlockData
+		block.BlockSize = replica.BlockSize
+		return nil
+	}
+	return lastErr
+}
+
+// GetReplicatedBlocks hands the blocks blockHashes to handle in order. It
+// streams them from the first block store of each, one stream per block
+// store, and reads the streams in the order of blockHashes: a stream whose
+// next block isn't needed yet waits on flow control, so at most a window of
+// blocks per block store is buffered. Blocks a stream can't deliver intact
+// are read one by one from the other copies.
+func (surfClient *RPCClient) GetReplicatedBlocks(blockHashes []string, ring *ConsistentHashRing, handle func(block *Block) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	owned := make(map[string][]string)
+	for _, hash := range blockHashes {
+		if owners := ring.GetResponsibleServers(hash); len(owners) > 0 {
+			owned[owners[0]] = append(owned[owners[0]], hash)
+		}
+	}
+	streams := make(map[string]BlockStore_GetBlocksClient)
+	for addr, hashes := range owned {
+		c, err := surfClient.blockStoreClient(addr)
+		if err != nil {
+			continue
+		}
+		stream, err := c.GetBlocks(ctx, &BlockHashes{Hashes: hashes})
+		if err != nil {
+			continue
+		}
+		streams[addr] = stream
+	}
+
+	for _, hash := range blockHashes {
+		var block *Block
+		if owners := ring.GetResponsibleServers(hash); len(owners) > 0 {
+			if stream, ok := streams[owners[0]]; ok {
+				streamed, err := stream.Recv()
+				if err != nil {
+					// the stream is gone, its other blocks come one by one
+					delete(streams, owners[0])
+				} else if streamed, err = openBlock(hash, streamed); err == nil {
+					block = streamed
+				}
+			}
+		}
+		if block == nil {
+			block = &Block{}
+			if err := surfClient.GetReplicatedBlock(hash, ring, block); err != nil {
+				return err
+			}
+		}
+		if err := handle(block); err != nil {
+			return err
 		}
-		*serverFileInfoMap = fInfo.FileInfoMap
-		// close the connection
-		return conn.Close()
 	}
 	return nil
 }
 
-func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error {
-	// connect to the server
-	for _, addr := range surfClient.MetaStoreAddrs {
-		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+// PutReplicatedBlocks streams the blocks next returns to all of their block
+// stores, one stream per block store, until next returns nil. It succeeds if
+// the write quorum of every block stored it.
+func (surfClient *RPCClient) PutReplicatedBlocks(next func() (*Block, error), ring *ConsistentHashRing, succ *bool) error {
+	*succ = false
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	streams := make(map[string]BlockStore_PutBlocksClient)
+	// block stores we stopped sending to, CloseAndRecv tells why
+	broken := make(map[string]bool)
+	var lastErr error
+	sent := make([]string, 0)
+	seen := make(map[string]bool)
+	for {
+		block, err := next()
 		if err != nil {
 			return err
 		}
-		c := NewRaftSurfstoreClient(conn)
-		// perform the call
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-		defer cancel()
-		version, err := c.UpdateFile(ctx, fileMetaData)
-		if errors.Is(err, ERR_NOT_LEADER) { // continue looking for leader
+		if block == nil {
+			break
+		}
+		hash := GetBlockHashString(block.BlockData)
+		if seen[hash] {
 			continue
 		}
+		seen[hash] = true
+		sent = append(sent, hash)
+		compressed, err := CompressBlock(block, surfClient.wireCompression())
 		if err != nil {
-			conn.Close()
 			return err
+		}
 
+		for _, addr := range ring.GetResponsibleServers(hash) {
+			if broken[addr] {
+				continue
+			}
+			stream, ok := streams[addr]
+			if !ok {
+				c, err := surfClient.blockStoreClient(addr)
+				if err == nil {
+					stream, err = c.PutBlocks(ctx)
+				}
+				if err != nil {
+					lastErr = err
+					broken[addr] = true
+					continue
+				}
+				streams[addr] = stream
+			}
+			// block stores that don't take our codec get the block as it is
+			toSend := block
+			if surfClient.compressionFor(addr) == compressed.Compression {
+				toSend = compressed
+			}
+			if err := stream.Send(toSend); err != nil {
+				broken[addr] = true
+			}
+		}
+	}
+
+	copies := make(map[string]int)
+	for _, stream := range streams {
+		stored, err := stream.CloseAndRecv()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		counted := make(map[string]bool)
+		for _, hash := range stored.Hashes {
+			if !counted[hash] {
+				counted[hash] = true
+				copies[hash]++
+			}
 		}
-		*latestVersion = version.Version
-		// close the connection
-		return conn.Close()
 	}
+	for _, hash := range sent {
+		if copies[hash] < ring.WriteQuorum {
+			return fmt.Errorf("block %s stored on %d block stores, %d needed: %v", hash, copies[hash], ring.WriteQuorum, lastErr)
+		}
+	}
+	*succ = true
 	return nil
 }
 
-func (surfClient *RPCClient) GetBlockStoreAddr(blockStoreAddr *string) error {
-	// connect to the server
+// PutReplicatedBlock writes a block to all of its block stores at once and
+// returns as soon as the write quorum stored it
+func (surfClient *RPCClient) PutReplicatedBlock(block *Block, ring *ConsistentHashRing, succ *bool) error {
+	addrs := ring.GetResponsibleServers(GetBlockHashString(block.BlockData))
+	acks := make(chan error, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			var stored bool
+			err := surfClient.PutBlock(block, addr, &stored)
+			if err == nil && !stored {
+				err = fmt.Errorf("block store %s did not store the block", addr)
+			}
+			acks <- err
+		}(addr)
+	}
+
+	stored := 0
+	var lastErr error
+	for range addrs {
+		if err := <-acks; err != nil {
+			lastErr = err
+			continue
+		}
+		stored++
+		if stored >= ring.WriteQuorum {
+			*succ = true
+			return nil
+		}
+	}
+	*succ = false
+	return fmt.Errorf("block stored on %d block stores, %d needed: %v", stored, ring.WriteQuorum, lastErr)
+}
 
-	for _, addr := range surfClient.MetaStoreAddrs {
-		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+// HasReplicatedBlocks returns the hashes in blockHashesIn that at least the
+// write quorum of their block stores hold, the others have to be written
+// again
+func (surfClient *RPCClient) HasReplicatedBlocks(blockHashesIn []string, ring *ConsistentHashRing, blockHashesOut *[]string) error {
+	// ask every block store about the blocks it is responsible for
+	owned := make(map[string][]string)
+	for _, hash := range blockHashesIn {
+		for _, addr := range ring.GetResponsibleServers(hash) {
+			owned[addr] = append(owned[addr], hash)
+		}
+	}
+	replies := make(chan []string, len(owned))
+	for addr, hashes := range owned {
+		go func(addr string, hashes []string) {
+			var stored []string
+			if err := surfClient.HasBlocks(hashes, addr, &stored); err != nil {
+				stored = nil
+			}
+			replies <- stored
+		}(addr, hashes)
+	}
+
+	copies := make(map[string]int)
+	for range owned {
+		for _, hash := range <-replies {
+			copies[hash]++
+		}
+	}
+	*blockHashesOut = nil
+	for _, hash := range blockHashesIn {
+		if copies[hash] >= ring.WriteQuorum {
+			*blockHashesOut = append(*blockHashesOut, hash)
+		}
+	}
+	return nil
+}
+
+// MetaStore
+func (surfClient *RPCClient) GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error {
+	return surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		fInfo, err := c.GetFileInfoMap(ctx, &emptypb.Empty{})
 		if err != nil {
 			return err
 		}
-		c := NewRaftSurfstoreClient(conn)
-		// perform the call
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-		defer cancel()
-		addr, err := c.GetBlockStoreAddr(ctx, &emptypb.Empty{})
-		if errors.Is(err, ERR_NOT_LEADER) { // continue looking for leader
-			continue
+		*serverFileInfoMap = fInfo.FileInfoMap
+		if surfClient.Encryption != nil {
+			*serverFileInfoMap = surfClient.Encryption.OpenFileInfoMap(fInfo.FileInfoMap)
+		}
+		return nil
+	})
+}
+
+func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error {
+	if fileMetaData.GetAuthor() == "" && surfClient.Author != "" {
+		fileMetaData = proto.Clone(fileMetaData).(*FileMetaData)
+		fileMetaData.Author = surfClient.Author
+	}
+	if surfClient.Encryption != nil {
+		var err error
+		if fileMetaData, err = surfClient.Encryption.SealFileMetaData(fileMetaData); err != nil {
+			return err
 		}
+	}
+	return surfClient.callLeaderOnce(func(ctx context.Context, c RaftSurfstoreClient) error {
+		version, err := c.UpdateFile(ctx, fileMetaData)
+		if err != nil {
+			return err
+		}
+		*latestVersion = version.Version
+		return nil
+	}, func() (bool, error) {
+		// the update went through if the metastore has it, at its version or
+		// at the one the metastore gave a file re-created after a delete
+		stored, err := surfClient.storedFileMetaData(fileMetaData.GetFilename())
+		if err != nil || stored == nil || stored.GetVersion() < fileMetaData.GetVersion() {
+			return false, err
+		}
+		sameVersion := proto.Clone(stored).(*FileMetaData)
+		sameVersion.Version = fileMetaData.GetVersion()
+		if !proto.Equal(sameVersion, fileMetaData) {
+			return false, nil
+		}
+		*latestVersion = stored.GetVersion()
+		return true, nil
+	})
+}
+
+// storedFileMetaData gets the metadata the metastore has for filename, as
+// the metastore names it, or nil if it has none
+func (surfClient *RPCClient) storedFileMetaData(filename string) (*FileMetaData, error) {
+	var stored *FileMetaData
+	err := surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		fInfo, err := c.GetFileInfoMap(ctx, &emptypb.Empty{})
+		if err != nil {
+			return err
+		}
+		stored = fInfo.FileInfoMap[filename]
+		return nil
+	})
+	return stored, err
+}
+
+func (surfClient *RPCClient) GetBlockStoreAddr(blockStoreAddr *string) error {
+	return surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		addr, err := c.GetBlockStoreAddr(ctx, &emptypb.Empty{})
 		if err != nil {
-			conn.Close()
 			return err
 		}
 		*blockStoreAddr = addr.Addr
-		// close the connection
-		return conn.Close()
+		return nil
+	})
+}
+
+func (surfClient *RPCClient) GetBlockStoreAddrs(blockStores *BlockStoreAddrs) error {
+	return surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		addrs, err := c.GetBlockStoreAddrs(ctx, &emptypb.Empty{})
+		if err != nil {
+			return err
+		}
+		blockStores.Addrs = addrs.Addrs
+		blockStores.WriteQuorum = addrs.WriteQuorum
+		return nil
+	})
+}
+
+func (surfClient *RPCClient) GetBlockStoreMap(blockStores *BlockStoreMap) error {
+	return surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		blockStoreMap, err := c.GetBlockStoreMap(ctx, &emptypb.Empty{})
+		if err != nil {
+			return err
+		}
+		blockStores.Addrs = blockStoreMap.Addrs
+		blockStores.VirtualNodes = blockStoreMap.VirtualNodes
+		blockStores.Replicas = blockStoreMap.Replicas
+		blockStores.WriteQuorum = blockStoreMap.WriteQuorum
+		return nil
+	})
+}
+
+// GetFileHistory gets the versions of filename the metastore kept, oldest
+// first
+func (surfClient *RPCClient) GetFileHistory(filename string, versions *[]*FileVersion) error {
+	name := filename
+	if surfClient.Encryption != nil {
+		name = surfClient.Encryption.metaStoreName(filename)
 	}
-	return nil
+	return surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		history, err := c.GetFileHistory(ctx, &FileHistoryInput{Filename: name})
+		if err != nil {
+			return err
+		}
+		*versions = history.Versions
+		if surfClient.Encryption == nil {
+			return nil
+		}
+		*versions = make([]*FileVersion, 0, len(history.Versions))
+		for _, version := range history.Versions {
+			opened, err := surfClient.Encryption.OpenFileMetaData(version.FileMetaData)
+			if err != nil {
+				return err
+			}
+			*versions = append(*versions, &FileVersion{FileMetaData: opened, Timestamp: version.Timestamp})
+		}
+		return nil
+	})
+}
+
+// RestoreFileVersion makes version of filename its latest version
+func (surfClient *RPCClient) RestoreFileVersion(filename string, version int32, latestVersion *int32) error {
+	input := &RestoreFileVersionInput{Filename: filename, Version: version, Author: surfClient.Author}
+	if surfClient.Encryption != nil {
+		input.Filename = surfClient.Encryption.metaStoreName(filename)
+	}
+	before, err := surfClient.storedFileMetaData(input.Filename)
+	if err != nil {
+		return err
+	}
+	return surfClient.callLeaderOnce(func(ctx context.Context, c RaftSurfstoreClient) error {
+		restored, err := c.RestoreFileVersion(ctx, input)
+		if err != nil {
+			return err
+		}
+		*latestVersion = restored.Version
+		return nil
+	}, func() (bool, error) {
+		// the restore went through if a version after the one we started
+		// from is ours and a copy of the restored version
+		var versions []*FileVersion
+		if err := surfClient.GetFileHistory(filename, &versions); err != nil || len(versions) == 0 {
+			return false, err
+		}
+		latest := versions[len(versions)-1].GetFileMetaData()
+		if latest.GetVersion() <= before.GetVersion() || latest.GetAuthor() != input.Author {
+			return false, nil
+		}
+		for _, kept := range versions {
+			if kept.GetFileMetaData().GetVersion() != version {
+				continue
+			}
+			copied := proto.Clone(latest).(*FileMetaData)
+			copied.Version = version
+			copied.Author = kept.GetFileMetaData().GetAuthor()
+			if proto.Equal(copied, kept.GetFileMetaData()) {
+				*latestVersion = latest.GetVersion()
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+}
+
+// WatchChanges hands handle every change after sinceIndex the metastore
+// leader streams, file names as the metastore has them. When the leader
+// changes it resumes on the new one from the last change it got.
+func (surfClient *RPCClient) WatchChanges(sinceIndex int64, handle func(change *FileChange)) error {
+	return surfClient.callLeaderWithin(0, leaderHint, func(ctx context.Context, c RaftSurfstoreClient) error {
+		stream, err := c.WatchChanges(ctx, &WatchChangesInput{SinceIndex: sinceIndex})
+		if err != nil {
+			return err
+		}
+		for {
+			change, err := stream.Recv()
+			if err != nil {
+				return err
+			}
+			handle(change)
+			sinceIndex = change.Index
+		}
+	})
+}
+
+// callLeader runs call against the metastore leader. It starts with the
+// leader that answered last time, follows the leader hints of followers and
+// skips servers that are down. While no server knows the leader, e.g. during
+// an election, it keeps trying for LEADER_SEARCH_TIMEOUT.
+func (surfClient *RPCClient) callLeader(call func(ctx context.Context, c RaftSurfstoreClient) error) error {
+	return surfClient.callLeaderWithin(METASTORE_RPC_TIMEOUT, leaderHint, call)
+}
+
+// callLeaderOnce is callLeader for calls that must not be applied twice. It
+// only moves on to another server when the call can't have been applied:
+// the server was out of reach or pointed at another leader. When it can't
+// tell, e.g. the connection broke after the call went out, it asks applied
+// whether the call went through before it tries again.
+func (surfClient *RPCClient) callLeaderOnce(call func(ctx context.Context, c RaftSurfstoreClient) error, applied func() (bool, error)) error {
+	deadline := time.Now().Add(LEADER_SEARCH_TIMEOUT)
+	for {
+		err := surfClient.callLeaderWithin(METASTORE_RPC_TIMEOUT, notAppliedHint, call)
+		if err == nil {
+			return nil
+		}
+		if _, unknown := leaderHint(err); !unknown {
+			return err
+		}
+		done, checkErr := applied()
+		if checkErr != nil {
+			return checkErr
+		}
+		if done {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(LEADER_RETRY_INTERVAL)
+	}
+}
+
+// callLeaderWithin is callLeader with calls that time out after timeout,
+// or never if it is 0, retried on the servers hint names when hint says so
+func (surfClient *RPCClient) callLeaderWithin(timeout time.Duration, hint func(err error) (string, bool),
+	call func(ctx context.Context, c RaftSurfstoreClient) error) error {
+	deadline := time.Now().Add(LEADER_SEARCH_TIMEOUT)
+	for {
+		addrs := surfClient.MetaStoreAddrs
+		if surfClient.leaderAddr != "" {
+			addrs = append([]string{surfClient.leaderAddr}, addrs...)
+		}
+
+		var lastErr error
+		hops := 0
+		for len(addrs) > 0 {
+			addr := addrs[0]
+			addrs = addrs[1:]
+
+			err := callMetaStore(addr, timeout, call)
+			if err == nil {
+				surfClient.leaderAddr = addr
+				return nil
+			}
+			leaderAddr, retry := hint(err)
+			if !retry {
+				return err
+			}
+			lastErr = err
+			if leaderAddr != "" && leaderAddr != addr && hops < len(surfClient.MetaStoreAddrs) {
+				addrs = append([]string{leaderAddr}, addrs...)
+				hops++
+			}
+		}
+
+		surfClient.leaderAddr = ""
+		if time.Now().After(deadline) {
+			return lastErr
+		}
+		time.Sleep(LEADER_RETRY_INTERVAL)
+	}
+}
+
+func callMetaStore(addr string, timeout time.Duration, call func(ctx context.Context, c RaftSurfstoreClient) error) error {
+	conn, err := connectMetaStore(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c := NewRaftSurfstoreClient(conn)
+
+	// perform the call
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	return call(ctx, c)
+}
+
+// connectMetaStore returns a connection to the metastore server at addr
+// once it is up, so calls that fail on it were sent. Failing to connect is
+// a plain error rather than a status.
+func connectMetaStore(addr string) (*grpc.ClientConn, error) {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), METASTORE_DIAL_TIMEOUT)
+	defer cancel()
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		if state == connectivity.Ready {
+			return conn, nil
+		}
+		if state == connectivity.TransientFailure || !conn.WaitForStateChange(ctx, state) {
+			conn.Close()
+			return nil, fmt.Errorf("could not connect to metastore server %s", addr)
+		}
+	}
+}
+
+// leaderHint tells whether a failed metastore call is worth retrying on
+// another server, and which server the answer pointed at, if any
+func leaderHint(err error) (string, bool) {
+	st, ok := status.FromError(err)
+	if !ok {
+		// dial errors
+		return "", true
+	}
+	switch st.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return "", true
+	case codes.FailedPrecondition:
+		for _, detail := range st.Details() {
+			if hint, ok := detail.(*LeaderHint); ok {
+				return hint.LeaderAddr, true
+			}
+		}
+		return "", true
+	}
+	return "", false
+}
+
+// notAppliedHint is leaderHint for calls that must not be applied twice:
+// only servers that couldn't be reached or weren't the leader surely
+// didn't apply them
+func notAppliedHint(err error) (string, bool) {
+	if st, ok := status.FromError(err); ok && st.Code() != codes.FailedPrecondition {
+		return "", false
+	}
+	return leaderHint(err)
+}
+
+// blockStoreClient returns a client for the block store at blockStoreAddr
+// over a connection that stays open for the following calls
+func (surfClient *RPCClient) blockStoreClient(blockStoreAddr string) (BlockStoreClient, error) {
+	if surfClient.blockConns == nil {
+		surfClient.blockConns = newBlockStoreConns()
+	}
+	surfClient.blockConns.mtx.Lock()
+	defer surfClient.blockConns.mtx.Unlock()
+	conn, ok := surfClient.blockConns.conns[blockStoreAddr]
+	if !ok {
+		var err error
+		conn, err = grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+		if err != nil {
+			return nil, err
+		}
+		surfClient.blockConns.conns[blockStoreAddr] = conn
+	}
+	return NewBlockStoreClient(conn), nil
+}
+
+func newBlockStoreConns() *blockStoreConns {
+	return &blockStoreConns{
+		conns:        make(map[string]*grpc.ClientConn),
+		compressions: make(map[string]Compression),
+	}
+}
+
+// Close closes the connections to the block stores
+func (surfClient *RPCClient) Close() error {
+	if surfClient.blockConns == nil {
+		return nil
+	}
+	surfClient.blockConns.mtx.Lock()
+	defer surfClient.blockConns.mtx.Unlock()
+	var lastErr error
+	for addr, conn := range surfClient.blockConns.conns {
+		if err := conn.Close(); err != nil {
+			lastErr = err
+		}
+		delete(surfClient.blockConns.conns, addr)
+	}
+	return lastErr
+}
+
+// openBlock decompresses block and makes sure it is the block blockHash
+func openBlock(blockHash string, block *Block) (*Block, error) {
+	block, err := DecompressBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	if GetBlockHashString(block.BlockData) != blockHash || int(block.BlockSize) != len(block.BlockData) {
+		return nil, fmt.Errorf("hash mismatch")
+	}
+	return block, nil
+}
+
+// sealBlock returns the block data is sent to the block stores as,
+// encrypted if the client encrypts
+func (surfClient *RPCClient) sealBlock(data []byte) (*Block, error) {
+	if surfClient.Encryption == nil {
+		return &Block{BlockData: data, BlockSize: int32(len(data))}, nil
+	}
+	return surfClient.Encryption.SealBlock(data, surfClient.Compression)
+}
+
+// unsealBlock returns the content of the block blockHash that sealBlock
+// made
+func (surfClient *RPCClient) unsealBlock(blockHash string, block *Block) ([]byte, error) {
+	if surfClient.Encryption == nil {
+		return block.BlockData, nil
+	}
+	return surfClient.Encryption.OpenBlock(blockHash, block)
+}
+
+// wireCompression is the codec blocks are sent in. Encrypted blocks were
+// compressed before they were encrypted and are sent as they are.
+func (surfClient *RPCClient) wireCompression() Compression {
+	if surfClient.Encryption != nil {
+		return Compression_NONE
+	}
+	return surfClient.Compression
+}
+
+// compressionFor returns the codec to send blocks to blockStoreAddr in: the
+// one we were asked to use if the block store accepts it, NONE otherwise.
+// The block store is asked once per sync.
+func (surfClient *RPCClient) compressionFor(blockStoreAddr string) Compression {
+	if surfClient.wireCompression() == Compression_NONE {
+		return Compression_NONE
+	}
+	c, err := surfClient.blockStoreClient(blockStoreAddr)
+	if err != nil {
+		return Compression_NONE
+	}
+	surfClient.blockConns.mtx.Lock()
+	compression, ok := surfClient.blockConns.compressions[blockStoreAddr]
+	surfClient.blockConns.mtx.Unlock()
+	if ok {
+		return compression
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	compression = Compression_NONE
+	accepted, err := c.GetCompressions(ctx, &emptypb.Empty{})
+	if err != nil {
+		// try again with the next block
+		return compression
+	}
+	for _, accept := range accepted.Compressions {
+		if accept == surfClient.Compression {
+			compression = accept
+		}
+	}
+	surfClient.blockConns.mtx.Lock()
+	surfClient.blockConns.compressions[blockStoreAddr] = compression
+	surfClient.blockConns.mtx.Unlock()
+	return compression
 }
 
 // This line guarantees all method for RPCClient are implemented
@@ -169,5 +885,6 @@ func NewSurfstoreRPCClient(addrs []string, baseDir string, blockSize int) RPCCli
 		MetaStoreAddrs: addrs,
 		BaseDir:        baseDir,
 		BlockSize:      blockSize,
+		blockConns:     newBlockStoreConns(),
 	}
 }
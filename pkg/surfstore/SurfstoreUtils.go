@@ -1,20 +1,30 @@
 package surfstore
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 // Implement the logic for a client syncing with the server here.
 func ClientSync(client RPCClient) {
-	// get block store addr
-	var blockStoreAddr string
-	if err := client.GetBlockStoreAddr(&blockStoreAddr); err != nil {
-		log.Fatal(err)
-	}
+	clientSync(&client, nil)
+}
+
+// clientSync is ClientSync for the files scope covers
+func clientSync(client *RPCClient, scope *syncScope) {
+	// get the hash ring of block stores
+	blockStoreMap := &BlockStoreMap{}
+	check(client.GetBlockStoreMap(blockStoreMap))
+	blockStores := NewConsistentHashRing(blockStoreMap)
+	defer client.Close()
 
-	blockSize := client.BlockSize
 	indexPath := ConcatPath(client.BaseDir, DEFAULT_META_FILENAME)
 	if indexExist := FileExists(indexPath); !indexExist {
 		_, err := os.Create(indexPath)
@@ -25,45 +35,28 @@ func ClientSync(client RPCClient) {
 	updatedLocalFile := make(map[string][]string)
 	localMeta, err := LoadMetaFromMetaFile(client.BaseDir)
 	check(err)
-	allFiles, err := ioutil.ReadDir(client.BaseDir)
+	localFiles, err := scanBaseDir(client, scope)
 	check(err)
-	for _, localFile := range allFiles {
-		localFileName := localFile.Name()
-		if localFileName != DEFAULT_META_FILENAME && !localFile.IsDir() {
-			var localHashes []string
-			bytes, err := ioutil.ReadFile(ConcatPath(client.BaseDir, localFileName))
-			check(err)
-			blockCnt := int(localFile.Size()) / blockSize
-			for i := 0; i < blockCnt; i++ {
-				tempBytes := bytes[i*blockSize : (i+1)*blockSize]
-				localHashes = append(localHashes, GetBlockHashString(tempBytes))
-			}
-			if localFile.Size()%int64(client.BlockSize) != 0 {
-				lastBlkStartIdx := blockCnt * int(blockSize)
-				tempBytes := bytes[lastBlkStartIdx:]
-				localHashes = append(localHashes, GetBlockHashString(tempBytes))
-			}
-			// new file
-			if _, ok := localMeta[localFileName]; !ok {
-				newLocalFile[localFileName] = localHashes
+	for localFileName, localHashes := range localFiles {
+		// new file
+		if _, ok := localMeta[localFileName]; !ok {
+			newLocalFile[localFileName] = localHashes
+			localMeta[localFileName] = &FileMetaData{Filename: localFileName,
+				Version:       1,
+				BlockHashList: localHashes}
+		} else {
+			// file updated
+			if equal := testEqHashes(localMeta[localFileName].GetBlockHashList(), localHashes); !equal {
+				updatedLocalFile[localFileName] = localHashes
 				localMeta[localFileName] = &FileMetaData{Filename: localFileName,
-					Version:       1,
+					Version:       localMeta[localFileName].GetVersion() + 1,
 					BlockHashList: localHashes}
-			} else {
-				// file updated
-				if equal := testEqHashes(localMeta[localFileName].GetBlockHashList(), localHashes); !equal {
-					updatedLocalFile[localFileName] = localHashes
-					localMeta[localFileName] = &FileMetaData{Filename: localFileName,
-						Version:       localMeta[localFileName].GetVersion() + 1,
-						BlockHashList: localHashes}
-				}
 			}
-
 		}
 	}
 	// handle local deleted file
 	for localFileName := range localMeta {
-		if _, err := os.Stat(ConcatPath(client.BaseDir, localFileName)); os.IsNotExist(err) {
+		if _, ok := localFiles[localFileName]; !ok && scope.covers(localFileName) {
 			localHashList := localMeta[localFileName].BlockHashList
 			if !(len(localHashList) == 1 && localHashList[0] == "0") {
 				localMeta[localFileName].Version++
@@ -76,26 +69,43 @@ func ClientSync(client RPCClient) {
 	var remoteIndex map[string]*FileMetaData
 	err = client.GetFileInfoMap(&remoteIndex)
 	check(err)
+	// local edits that lose against remote ones are kept as copies
+	copies := newConflictCopies(client, localMeta, remoteIndex)
+	// lostUpdate takes the version of filename another client updated
+	// before this one could
+	lostUpdate := func(filename string, localHashes []string) {
+		var latestRmMeta map[string]*FileMetaData
+		err := client.GetFileInfoMap(&latestRmMeta)
+		check(err)
+		thisFileMeta := latestRmMeta[filename]
+		latestHashes := thisFileMeta.GetBlockHashList()
+		kept := !testEqHashes(localHashes, latestHashes) && copies.keep(filename)
+		if len(latestHashes) == 1 && latestHashes[0] == "0" {
+			if !kept {
+				removeFile(client, filename)
+			}
+		} else {
+			downloadFile(client, blockStores, filename, latestHashes)
+		}
+		localMeta[filename] = thisFileMeta
+	}
 
 	for rmFileName, rmFileMeta := range remoteIndex {
+		if !scope.covers(rmFileName) {
+			continue
+		}
+		if !validFileName(rmFileName) {
+			log.Printf("Skipping remote file %q, it would land outside the base directory", rmFileName)
+			delete(remoteIndex, rmFileName)
+			continue
+		}
 		// remote has file not in baseDir
 		remoteFileVersion := rmFileMeta.GetVersion()
 		remoteHashes := rmFileMeta.GetBlockHashList()
 		if _, ok := localMeta[rmFileName]; !ok {
 			if !(len(remoteHashes) == 1 && remoteHashes[0] == "0") { // non-delete case
 				// download from block store and write to local
-				var data []byte
-				//log.Println("remote hashes length: ", len(remoteHashes))
-				for i := 0; i < len(remoteHashes); i++ {
-					tempBlk := &Block{}
-					client.GetBlock(remoteHashes[i], blockStoreAddr, tempBlk)
-					data = append(data, tempBlk.GetBlockData()...)
-				}
-				f, err := os.Create(ConcatPath(client.BaseDir, rmFileName))
-				check(err)
-				defer f.Close()
-				_, err = f.Write(data)
-				check(err)
+				downloadFile(client, blockStores, rmFileName, remoteHashes)
 				// update local index
 				localMeta[rmFileName] = &FileMetaData{Filename: rmFileName,
 					Version:       remoteFileVersion,
@@ -107,57 +117,24 @@ func ClientSync(client RPCClient) {
 			localHashes := localMeta[rmFileName].GetBlockHashList()
 			// remote version higher: download, update local index
 			if remoteFileVersion > localFileVersion {
+				// a local edit since the last sync conflicts
+				_, edited := updatedLocalFile[rmFileName]
+				kept := edited && !testEqHashes(localFiles[rmFileName], remoteHashes) && copies.keep(rmFileName)
+				delete(updatedLocalFile, rmFileName)
 				// delete file case
 				if len(remoteHashes) == 1 && remoteHashes[0] == "0" {
-					err := os.Remove(ConcatPath(client.BaseDir, rmFileName))
-					check(err)
+					if !kept {
+						removeFile(client, rmFileName)
+					}
 					localMeta[rmFileName] = rmFileMeta
 				} else { // normal case
-					var bytes []byte
-					for _, s := range remoteHashes {
-						getBlk := &Block{}
-						err := client.GetBlock(s, blockStoreAddr, getBlk)
-						check(err)
-						bytes = append(bytes, getBlk.BlockData...)
-					}
-					// if deleted, then no more delete needed
-					if !(len(localHashes) == 1 && localHashes[0] == "0") {
-						err := os.Remove(ConcatPath(client.BaseDir, rmFileName))
-						check(err)
-					}
-					f, err := os.Create(ConcatPath(client.BaseDir, rmFileName))
-					check(err)
-					defer f.Close()
-					_, err = f.Write(bytes)
-					check(err)
+					// replaces the local file, if it wasn't deleted
+					downloadFile(client, blockStores, rmFileName, remoteHashes)
 					localMeta[rmFileName] = rmFileMeta
 				}
 			} else if remoteFileVersion+1 == localFileVersion { // local is new
-				if !(len(localHashes) == 1 && localHashes[0] == "0") { // not delete file: put needed block
-					var existedBlockHashes []string
-					err := client.HasBlocks(localHashes, blockStoreAddr, &existedBlockHashes)
-					check(err)
-					bytes, err := ioutil.ReadFile(ConcatPath(client.BaseDir, rmFileName))
-					check(err)
-					for i, s := range localHashes {
-						if exist := stringExist(s, existedBlockHashes); !exist {
-							putBlk := &Block{}
-							var succ bool
-							if i == len(localHashes)-1 {
-								putBlk.BlockData = bytes[i*blockSize:]
-								putBlk.BlockSize = int32(len(bytes) - i*blockSize)
-							} else {
-								putBlk.BlockData = bytes[i*blockSize : (i+1)*blockSize]
-								putBlk.BlockSize = int32(blockSize)
-							}
-							err := client.PutBlock(putBlk, blockStoreAddr, &succ)
-							check(err)
-							if !succ {
-								log.Fatal("fail to put block when remote has file in local meta")
-							}
-						}
-					}
-				} else { // delete file: update meta
+				// updated files are uploaded below
+				if len(localHashes) == 1 && localHashes[0] == "0" { // delete file: update meta
 					err := client.UpdateFile(localMeta[rmFileName], &localFileVersion)
 					check(err)
 				}
@@ -168,50 +145,14 @@ func ClientSync(client RPCClient) {
 	for filename, localHashes := range newLocalFile {
 		if _, ok := remoteIndex[filename]; !ok {
 			// put block
-			bytes, err := ioutil.ReadFile(ConcatPath(client.BaseDir, filename))
-			check(err)
-			totalPutSize := 0
-			for i := range localHashes {
-				putBlk := &Block{}
-				succ := false
-				if i == len(localHashes)-1 {
-					putBlk.BlockData = bytes[i*blockSize:]
-					putBlk.BlockSize = int32(len(bytes) - i*blockSize)
-				} else {
-					putBlk.BlockData = bytes[i*blockSize : (i+1)*blockSize]
-					putBlk.BlockSize = int32(blockSize)
-				}
-				totalPutSize += len(putBlk.BlockData)
-				err := client.PutBlock(putBlk, blockStoreAddr, &succ)
-				check(err)
-				if !succ {
-					log.Fatal("fail to put block when local has file not in remote1")
-				}
-			}
+			uploadFile(client, blockStores, filename, nil)
 			// update file meta
 			var latestVersion int32
-			err = client.UpdateFile(&FileMetaData{Filename: filename, Version: 1, BlockHashList: localHashes},
+			err := client.UpdateFile(&FileMetaData{Filename: filename, Version: 1, BlockHashList: localHashes},
 				&latestVersion)
 			check(err)
 			if latestVersion == -1 { // fail -> download from blockstore (others make it first)
-				var latestRmMeta map[string]*FileMetaData
-				err = client.GetFileInfoMap(&latestRmMeta)
-				check(err)
-				var bytes []byte
-				thisFileMeta := latestRmMeta[filename]
-				for _, s := range thisFileMeta.BlockHashList {
-					getBlk := &Block{}
-					err := client.GetBlock(s, blockStoreAddr, getBlk)
-					check(err)
-					bytes = append(bytes, getBlk.BlockData...)
-				}
-				err := os.Remove(ConcatPath(client.BaseDir, filename))
-				check(err)
-				f, err := os.Create(ConcatPath(client.BaseDir, filename))
-				check(err)
-				defer f.Close()
-				f.Write(bytes)
-				localMeta[filename] = thisFileMeta
+				lostUpdate(filename, localHashes)
 			} else { // success -> update local index
 				localMeta[filename] = &FileMetaData{Filename: filename, Version: latestVersion, BlockHashList: localHashes}
 			}
@@ -221,75 +162,44 @@ func ClientSync(client RPCClient) {
 			remoteHashes := remoteIndex[filename].GetBlockHashList()
 			// remote version higher: download, update local index
 			if remoteFileVersion >= 1 {
+				kept := !testEqHashes(localHashes, remoteHashes) && copies.keep(filename)
 				// delete file case
 				if len(remoteHashes) == 1 && remoteHashes[0] == "0" {
-					err := os.Remove(ConcatPath(client.BaseDir, filename))
-					check(err)
-				} else { // normal case
-					var bytes []byte
-					for _, s := range remoteHashes {
-						getBlk := &Block{}
-						err := client.GetBlock(s, blockStoreAddr, getBlk)
-						check(err)
-						bytes = append(bytes, getBlk.BlockData...)
+					if !kept {
+						removeFile(client, filename)
 					}
-					err := os.Remove(ConcatPath(client.BaseDir, filename))
-					check(err)
-					f, err := os.Create(ConcatPath(client.BaseDir, filename))
-					check(err)
-					defer f.Close()
-					_, err = f.Write(bytes)
-					check(err)
+					localMeta[filename] = remoteIndex[filename]
+				} else { // normal case
+					downloadFile(client, blockStores, filename, remoteHashes)
 					localMeta[filename] = remoteIndex[filename]
 				}
 			}
 		}
 	}
 	for filename, localHashes := range updatedLocalFile {
-		bytes, err := ioutil.ReadFile(ConcatPath(client.BaseDir, filename))
+		// only the blocks the edit changed need to go up
+		var existedBlockHashes []string
+		err := client.HasReplicatedBlocks(localHashes, blockStores, &existedBlockHashes)
 		check(err)
-		for i := range localHashes {
-			putBlk := &Block{}
-			var succ bool
-			if i == len(localHashes)-1 {
-				putBlk.BlockData = bytes[i*blockSize:]
-				putBlk.BlockSize = int32(len(bytes) - i*blockSize)
-			} else {
-				putBlk.BlockData = bytes[i*blockSize : (i+1)*blockSize]
-				putBlk.BlockSize = int32(blockSize)
-			}
-			err := client.PutBlock(putBlk, blockStoreAddr, &succ)
-			check(err)
-			if !succ {
-				log.Fatal("fail to put block when local has file not in remote2")
-			}
-		}
+		uploadFile(client, blockStores, filename, existedBlockHashes)
 		// update file meta
 		var latestVersion int32
 		err = client.UpdateFile(&FileMetaData{Filename: filename, Version: localMeta[filename].GetVersion(), BlockHashList: localHashes},
 			&latestVersion)
 		check(err)
 		if latestVersion == -1 { // fail -> download from blockstore (others make it first)
-			var latestRmMeta map[string]*FileMetaData
-			err = client.GetFileInfoMap(&latestRmMeta)
-			check(err)
-			var bytes []byte
-			thisFileMeta := latestRmMeta[filename]
-			for _, s := range thisFileMeta.BlockHashList {
-				getBlk := &Block{}
-				err := client.GetBlock(s, blockStoreAddr, getBlk)
-				check(err)
-				bytes = append(bytes, getBlk.BlockData...)
-			}
-			err := os.Remove(ConcatPath(client.BaseDir, filename))
-			check(err)
-			f, err := os.Create(ConcatPath(client.BaseDir, filename))
-			check(err)
-			defer f.Close()
-			f.Write(bytes)
-			localMeta[filename] = thisFileMeta
+			lostUpdate(filename, localHashes)
 		} // else : success -> update local index
 	}
+	copies.upload(blockStores, localMeta)
+
+	// removing files may have taken empty directories we keep with them
+	for filename, fileMeta := range localMeta {
+		hashList := fileMeta.GetBlockHashList()
+		if isDirEntry(filename) && !(len(hashList) == 1 && hashList[0] == "0") {
+			check(os.MkdirAll(ConcatPath(client.BaseDir, filename), 0755))
+		}
+	}
 
 	// 1. clean up index.txt
 	// 2. update index.txt
@@ -297,6 +207,7 @@ func ClientSync(client RPCClient) {
 		log.Printf("Failed to truncate: %v", err)
 	}
 	WriteMetaFile(localMeta, client.BaseDir)
+	copies.report()
 	/*
 		fmt.Println("local meta map ")
 		PrintMetaMap(localMeta)
@@ -308,6 +219,233 @@ func ClientSync(client RPCClient) {
 	*/
 }
 
+// downloadFile writes the blocks hashes to filename in the base directory.
+// They go to a temporary file first, which replaces filename once every
+// block arrived intact, so a failed download leaves the old file alone.
+func downloadFile(client *RPCClient, blockStores *ConsistentHashRing, filename string, hashes []string) {
+	target := ConcatPath(client.BaseDir, filename)
+	if isDirEntry(filename) {
+		check(os.MkdirAll(target, 0755))
+		return
+	}
+	check(downloadTo(client, blockStores, target, hashes))
+}
+
+// downloadTo writes the blocks hashes to the file target, through a
+// temporary file next to it
+func downloadTo(client *RPCClient, blockStores *ConsistentHashRing, target string, hashes []string) error {
+	dir := filepath.Dir(target)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(target)+".*"+DOWNLOAD_TMP_SUFFIX)
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	next := 0
+	err = client.GetReplicatedBlocks(hashes, blockStores, func(block *Block) error {
+		data, err := client.unsealBlock(hashes[next], block)
+		if err != nil {
+			return err
+		}
+		next++
+		_, err = tmp.Write(data)
+		return err
+	})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, target)
+}
+
+// removeFile removes filename from the base directory, and the directories
+// that leaves empty. An empty directory entry is only removed if it is
+// still empty, files may have been added to it since.
+func removeFile(client *RPCClient, filename string) {
+	if isDirEntry(filename) {
+		if err := os.Remove(ConcatPath(client.BaseDir, filename)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Keeping directory %s: %v", filename, err)
+			return
+		}
+	} else {
+		check(os.Remove(ConcatPath(client.BaseDir, filename)))
+	}
+	for dir := path.Dir(strings.TrimSuffix(filename, "/")); dir != "."; dir = path.Dir(dir) {
+		if err := os.Remove(ConcatPath(client.BaseDir, dir)); err != nil {
+			break
+		}
+	}
+}
+
+// scanBaseDir hashes every file under the base directory that scope
+// covers, by its slash separated path relative to it. Empty directories
+// are listed too, with a trailing slash and no blocks.
+func scanBaseDir(client *RPCClient, scope *syncScope) (map[string][]string, error) {
+	files := make(map[string][]string)
+	scanStart := time.Now()
+	walk := func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			// a changed path may be gone
+			if scope != nil && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(client.BaseDir, filePath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if info.IsDir() {
+			if name == "." {
+				return nil
+			}
+			entries, err := ioutil.ReadDir(filePath)
+			if err != nil {
+				return err
+			}
+			if len(entries) == 0 {
+				files[name+"/"] = []string{}
+			}
+			return nil
+		}
+		// skip downloads a crash cut short
+		if name == DEFAULT_META_FILENAME || strings.HasSuffix(name, DOWNLOAD_TMP_SUFFIX) {
+			return nil
+		}
+		if hashes, ok := client.cachedHashesOf(name, info); ok {
+			files[name] = hashes
+			return nil
+		}
+		hashes, err := hashFile(client, filePath)
+		if err != nil {
+			return err
+		}
+		files[name] = hashes
+		client.cacheHashes(name, info, hashes, scanStart)
+		return nil
+	}
+
+	var err error
+	if scope == nil {
+		err = filepath.Walk(client.BaseDir, walk)
+	} else {
+		for name := range scope.paths {
+			// names may come from the metastore
+			if !validFileName(name) {
+				continue
+			}
+			if err = filepath.Walk(ConcatPath(client.BaseDir, name), walk); err != nil {
+				break
+			}
+		}
+		// the parents only count as empty directories
+		for dir := range scope.parents {
+			if entries, readErr := ioutil.ReadDir(ConcatPath(client.BaseDir, dir)); readErr == nil && len(entries) == 0 {
+				files[dir+"/"] = []string{}
+			}
+		}
+	}
+	for name := range client.hashCache {
+		if _, ok := files[name]; !ok && scope.covers(name) {
+			delete(client.hashCache, name)
+		}
+	}
+	return files, err
+}
+
+// hashFile returns the hashes of the blocks of the file at filePath
+func hashFile(client *RPCClient, filePath string) ([]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hashes []string
+	data := make([]byte, client.BlockSize)
+	for {
+		n, err := io.ReadFull(f, data)
+		if err == io.EOF {
+			return hashes, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		hashes = append(hashes, hashBlock(client, data[:n]))
+	}
+}
+
+// isDirEntry tells whether filename stands for an empty directory
+func isDirEntry(filename string) bool {
+	return strings.HasSuffix(filename, "/")
+}
+
+// validFileName tells whether filename is a slash separated path inside
+// the base directory, names from the metastore are not to be trusted
+func validFileName(filename string) bool {
+	name := strings.TrimSuffix(filename, "/")
+	return name != "" && name != "." && path.Clean(name) == name && !path.IsAbs(name) &&
+		name != ".." && !strings.HasPrefix(name, "../") && !strings.Contains(name, "\\") &&
+		name != DEFAULT_META_FILENAME
+}
+
+// uploadFile streams the blocks of filename in the base directory to the
+// block stores, except the ones in stored. The file is read one block at a
+// time as the block stores take them.
+func uploadFile(client *RPCClient, blockStores *ConsistentHashRing, filename string, stored []string) {
+	if isDirEntry(filename) {
+		return
+	}
+	skip := make(map[string]bool)
+	for _, hash := range stored {
+		skip[hash] = true
+	}
+	f, err := os.Open(ConcatPath(client.BaseDir, filename))
+	check(err)
+	defer f.Close()
+
+	next := func() (*Block, error) {
+		for {
+			data := make([]byte, client.BlockSize)
+			n, err := io.ReadFull(f, data)
+			if err == io.EOF {
+				return nil, nil
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return nil, err
+			}
+			block, err := client.sealBlock(data[:n])
+			if err != nil {
+				return nil, err
+			}
+			if skip[GetBlockHashString(block.BlockData)] {
+				continue
+			}
+			return block, nil
+		}
+	}
+	var succ bool
+	err = client.PutReplicatedBlocks(next, blockStores, &succ)
+	check(err)
+	if !succ {
+		panic(fmt.Errorf("fail to put the blocks of %s", filename))
+	}
+}
+
+// hashBlock returns the hash of data as it is stored on the block stores
+func hashBlock(client *RPCClient, data []byte) string {
+	block, err := client.sealBlock(data)
+	check(err)
+	return GetBlockHashString(block.BlockData)
+}
+
 func check(e error) {
 	if e != nil {
 		panic(e)
@@ -0,0 +1,260 @@
+package surfstore
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// cachedHashes are the block hashes of a file as a sync saw it
+type cachedHashes struct {
+	size    int64
+	modTime time.Time
+	hashes  []string
+}
+
+// WatchSync keeps the base directory in sync until watching it fails.
+// Local changes, and the remote ones the metastore pushes, are synced once
+// they have stopped coming for WATCH_DEBOUNCE. Every pollInterval it also
+// syncs the files whose version on the metastore differs from the index,
+// in case a push slipped by. Each sync only looks at the paths that
+// changed. The first one, one after events were lost and one after a sync
+// that failed look at everything; a failed sync is logged, not returned.
+func WatchSync(client *RPCClient, pollInterval time.Duration) error {
+	client.hashCache = make(map[string]*cachedHashes)
+
+	// watch first, so nothing that changes during the first sync is missed
+	changed := newChangedPaths()
+	var watchErrors <-chan error
+	watcher, err := newDirWatcher(client.BaseDir, changed)
+	if err != nil {
+		log.Printf("Only polling for changes: %v", err)
+	} else {
+		defer watcher.Close()
+		watchErrors = watcher.Errors
+	}
+
+	// the stream runs alongside syncs, on a copy with a leader of its own
+	go watchRemote(*client, changed)
+
+	changed.addAll()
+	syncChanged(client, changed)
+
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+	settle := time.NewTimer(WATCH_DEBOUNCE)
+	if !settle.Stop() {
+		<-settle.C
+	}
+	for {
+		select {
+		case <-changed.Signal:
+		case err := <-watchErrors:
+			return err
+		case <-settle.C:
+			syncChanged(client, changed)
+			continue
+		case <-poll.C:
+			if watcher == nil {
+				changed.addAll()
+			} else if err := addRemoteChanges(client, changed); err != nil {
+				log.Printf("Polling for changes: %v", err)
+				continue
+			}
+			syncChanged(client, changed)
+			continue
+		}
+		// wait for changes to settle, a file being written changes many
+		// times
+		if !settle.Stop() {
+			select {
+			case <-settle.C:
+			default:
+			}
+		}
+		settle.Reset(WATCH_DEBOUNCE)
+	}
+}
+
+// watchRemote adds the files the metastore streams changes of to changed.
+// It resubscribes from the last change it got when the stream breaks, and
+// gives up on metastores that don't stream changes.
+func watchRemote(client RPCClient, changed *changedPaths) {
+	since := int64(-1)
+	for {
+		err := client.WatchChanges(since, func(change *FileChange) {
+			since = change.Index
+			fileMetaData := change.GetFileMetaData()
+			if client.Encryption != nil {
+				var err error
+				if fileMetaData, err = client.Encryption.OpenFileMetaData(fileMetaData); err != nil {
+					log.Printf("Skipping the change of file %s: %v", change.GetFileMetaData().GetFilename(), err)
+					return
+				}
+			}
+			changed.add(fileMetaData.GetFilename())
+		})
+		if status.Code(err) == codes.Unimplemented {
+			log.Printf("The metastore doesn't push changes, polling only")
+			return
+		}
+		log.Printf("Watching remote changes: %v", err)
+		time.Sleep(WATCH_RECONNECT_INTERVAL)
+	}
+}
+
+// addRemoteChanges adds the files whose version on the metastore differs
+// from the one in the index to changed
+func addRemoteChanges(client *RPCClient, changed *changedPaths) error {
+	localMeta, err := LoadMetaFromMetaFile(client.BaseDir)
+	if err != nil {
+		return err
+	}
+	var remoteIndex map[string]*FileMetaData
+	if err := client.GetFileInfoMap(&remoteIndex); err != nil {
+		return err
+	}
+	for filename, remoteMeta := range remoteIndex {
+		if remoteMeta.GetVersion() != localMeta[filename].GetVersion() {
+			changed.add(filename)
+		}
+	}
+	return nil
+}
+
+// syncChanged syncs the paths in changed, if any
+func syncChanged(client *RPCClient, changed *changedPaths) {
+	scope := changed.take()
+	if scope != nil && len(scope.paths) == 0 {
+		return
+	}
+	if err := syncOnce(client, scope); err != nil {
+		log.Println(err)
+		changed.addAll()
+	}
+}
+
+// syncOnce runs clientSync and returns its panic as an error, so one
+// failed sync doesn't end watching
+func syncOnce(client *RPCClient, scope *syncScope) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("sync failed: %v", r)
+		}
+	}()
+	clientSync(client, scope)
+	return nil
+}
+
+// changedPaths collects the slash separated paths under the base
+// directory that changed until a sync takes them
+type changedPaths struct {
+	mtx   sync.Mutex
+	paths map[string]bool
+	// events were lost, the next sync looks at everything
+	all bool
+
+	// receives a value when something changed since the last receive
+	Signal chan struct{}
+}
+
+func newChangedPaths() *changedPaths {
+	return &changedPaths{paths: make(map[string]bool), Signal: make(chan struct{}, 1)}
+}
+
+func (c *changedPaths) add(name string) {
+	c.mtx.Lock()
+	c.paths[strings.TrimSuffix(name, "/")] = true
+	c.mtx.Unlock()
+	c.signal()
+}
+
+func (c *changedPaths) addAll() {
+	c.mtx.Lock()
+	c.all = true
+	c.mtx.Unlock()
+	c.signal()
+}
+
+func (c *changedPaths) signal() {
+	select {
+	case c.Signal <- struct{}{}:
+	default:
+		// a change is pending already
+	}
+}
+
+// take returns the scope of a sync of the changes so far, and forgets them
+func (c *changedPaths) take() *syncScope {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	paths, all := c.paths, c.all
+	c.paths, c.all = make(map[string]bool), false
+	if all {
+		return nil
+	}
+	return newSyncScope(paths)
+}
+
+// syncScope is the part of the base directory a sync looks at: the paths
+// that changed with everything under them, and the directories they are
+// in, which they may have emptied or filled. nil stands for all of it.
+type syncScope struct {
+	paths   map[string]bool
+	parents map[string]bool
+}
+
+func newSyncScope(paths map[string]bool) *syncScope {
+	scope := &syncScope{paths: paths, parents: make(map[string]bool)}
+	for name := range paths {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			scope.parents[dir] = true
+		}
+	}
+	return scope
+}
+
+// covers tells whether filename is in the scope
+func (scope *syncScope) covers(filename string) bool {
+	if scope == nil {
+		return true
+	}
+	name := strings.TrimSuffix(filename, "/")
+	if isDirEntry(filename) && scope.parents[name] {
+		return true
+	}
+	for ; name != "."; name = path.Dir(name) {
+		if scope.paths[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedHashesOf returns the hashes an earlier sync saw for the file name,
+// if it hasn't changed since
+func (surfClient *RPCClient) cachedHashesOf(name string, info os.FileInfo) ([]string, bool) {
+	cached, ok := surfClient.hashCache[name]
+	if !ok || cached.size != info.Size() || !cached.modTime.Equal(info.ModTime()) {
+		return nil, false
+	}
+	return cached.hashes, true
+}
+
+// cacheHashes remembers the hashes of the file name for the next sync. A
+// file modified just before the scan that started at scanStart is left
+// out: another write within the resolution of modification times would
+// go unnoticed.
+func (surfClient *RPCClient) cacheHashes(name string, info os.FileInfo, hashes []string, scanStart time.Time) {
+	if surfClient.hashCache == nil || info.ModTime().After(scanStart.Add(-HASH_CACHE_MIN_AGE)) {
+		return
+	}
+	surfClient.hashCache[name] = &cachedHashes{size: info.Size(), modTime: info.ModTime(), hashes: hashes}
+}
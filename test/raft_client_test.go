@@ -1,15 +1,22 @@
 package SurfTest
 
 import (
+	"cse224/proj5/pkg/surfstore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
-	//	"time"
+	"time"
 )
 
 // A creates and syncs with a file. B creates and syncs with same file. A syncs again.
 func TestSyncTwoClientsSameFileLeaderFailure(t *testing.T) {
-	t.Logf("client1 syncs with file1. client2 syncs with file1 (different content). client1 syncs again.")
+	t.Logf("client1 syncs with file1. client2 syncs with file1 (different content), keeping its own as a conflict copy. client1 syncs again.")
 	cfgPath := "./config_files/3nodes.txt"
 	test := InitTest(cfgPath, "8080")
 	defer EndTest(test)
@@ -70,7 +77,7 @@ func TestSyncTwoClientsSameFileLeaderFailure(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Could not load meta file for client1")
 	}
-	if len(fileMeta1) != 1 {
+	if len(fileMeta1) != 2 {
 		t.Fatalf("Wrong number of entries in client1 meta file")
 	}
 	if fileMeta1[file1].Version != 1 {
@@ -95,7 +102,7 @@ func TestSyncTwoClientsSameFileLeaderFailure(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Could not load meta file for client2")
 	}
-	if len(fileMeta2) != 1 {
+	if len(fileMeta2) != 2 {
 		t.Fatalf("Wrong number of entries in client2 meta file")
 	}
 	if fileMeta1[file1].Version != 1 {
@@ -109,4 +116,1016 @@ func TestSyncTwoClientsSameFileLeaderFailure(t *testing.T) {
 	if !c {
 		t.Fatalf("wrong file2 contents at client2")
 	}
+
+	//client2's version is kept, and synced to client1
+	copies, _ := filepath.Glob(workingDir + "/test1/multi_file1 (conflicted copy from *).txt")
+	if len(copies) != 1 {
+		t.Fatalf("client2 should keep its version as a conflict copy, found %v", copies)
+	}
+	c, e = SameFile(workingDir+"/test0/"+filepath.Base(copies[0]), copies[0])
+	if e != nil || !c {
+		t.Fatalf("client1 should get the conflict copy")
+	}
+}
+
+// A syncs a file. One of the three block stores fails. B syncs and gets the file from the others, then adds a file.
+func TestSyncReplicatedBlocksSurviveBlockStoreFailure(t *testing.T) {
+	t.Logf("client1 syncs with file1. a block store fails. client2 syncs and gets file1, then syncs with file2.")
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitReplicatedBlockTest(cfgPath, []string{"8080", "8081", "8082"}, 2)
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	file1 := "multi_file1.txt"
+	file2 := "multi_file2.txt"
+	err := worker1.AddFile(file1)
+	if err != nil {
+		t.FailNow()
+	}
+
+	//client1 syncs
+	err = SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+
+	// the first block store goes away with its copy of every block
+	_ = test.Procs[0].Process.Kill()
+	_ = test.Procs[0].Wait()
+
+	//client2 syncs
+	err = worker2.AddFile(file2)
+	if err != nil {
+		t.FailNow()
+	}
+	err = SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync should succeed with two of three block stores")
+	}
+
+	workingDir, _ := os.Getwd()
+	c, e := SameFile(workingDir+"/test1/"+file1, SRC_PATH+"/"+file1)
+	if e != nil || !c {
+		t.Fatalf("client2 should get file1 from the remaining block stores")
+	}
+
+	//client1 syncs
+	err = SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	if !DirFullySynced(*worker1, *worker2) {
+		t.Fatalf("client1 and client2 should hold the same files")
+	}
+}
+
+// A syncs a file spread over two block stores. A third block store joins. B syncs and gets the file.
+func TestSyncShardedBlocksRebalanceOnNewBlockStore(t *testing.T) {
+	t.Logf("client1 syncs with file1. a block store joins the ring. client2 syncs and gets file1.")
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitShardedBlockTest(cfgPath, []string{"8080", "8081"}, 1, 1, "-gc-grace", "1s")
+	// the block store started below must be killed too
+	defer func() { EndTest(test) }()
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	// small blocks, so the file is spread over the ring
+	blockSize := 4
+	file1 := "multi_file1.txt"
+	err := worker1.AddFile(file1)
+	if err != nil {
+		t.FailNow()
+	}
+
+	//client1 syncs
+	err = SyncClient("localhost:8080", "test0", blockSize, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+
+	test.Procs = append(test.Procs, InitBlockStore("8082"))
+	time.Sleep(500 * time.Millisecond)
+
+	// the blocks of file1 are past the grace period. a client still on the
+	// old ring just uploaded a block to 8080 that 8080 won't own anymore.
+	blockStoreMap, err := test.Clients[0].GetBlockStoreMap(test.Context, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("GetBlockStoreMap failed: %v", err)
+	}
+	blockStoreMap.Addrs = append(blockStoreMap.Addrs, "localhost:8082")
+	ring := surfstore.NewConsistentHashRing(blockStoreMap)
+	var inFlight []byte
+	for i := 0; inFlight == nil; i++ {
+		data := []byte("uploaded, UpdateFile still to come " + strconv.Itoa(i))
+		if ring.GetResponsibleServers(surfstore.GetBlockHashString(data))[0] != "localhost:8080" {
+			inFlight = data
+		}
+	}
+	inFlightHash := surfstore.GetBlockHashString(inFlight)
+	time.Sleep(1500 * time.Millisecond)
+	conn, err := grpc.Dial("localhost:8080", grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Could not connect to the block store")
+	}
+	defer conn.Close()
+	_, err = surfstore.NewBlockStoreClient(conn).PutBlock(test.Context, &surfstore.Block{BlockData: inFlight, BlockSize: int32(len(inFlight))})
+	if err != nil {
+		t.Fatalf("PutBlock failed: %v", err)
+	}
+
+	_, err = test.Clients[0].AddBlockStore(test.Context, &surfstore.BlockStoreAddr{Addr: "localhost:8082"})
+	if err != nil {
+		t.Fatalf("AddBlockStore failed: %v", err)
+	}
+
+	// every block is now exactly on the block store the ring gives it, the
+	// in-flight block is also kept where it was uploaded
+	blockStoreMap, err = test.Clients[0].GetBlockStoreMap(test.Context, &emptypb.Empty{})
+	if err != nil || len(blockStoreMap.Addrs) != 3 {
+		t.Fatalf("The new block store should be on the ring: %v", err)
+	}
+	ring = surfstore.NewConsistentHashRing(blockStoreMap)
+	stored := 0
+	kept := false
+	for _, addr := range blockStoreMap.Addrs {
+		hashes := ListBlocks(addr)
+		if addr == "localhost:8082" && len(hashes) == 0 {
+			t.Fatalf("The new block store should have taken over some blocks")
+		}
+		for _, hash := range hashes {
+			if hash == inFlightHash {
+				kept = kept || addr == "localhost:8080"
+				continue
+			}
+			if owners := ring.GetResponsibleServers(hash); owners[0] != addr {
+				t.Fatalf("Block %s is on %s, but %s owns it", hash, addr, owners[0])
+			}
+			stored++
+		}
+	}
+	if !kept {
+		t.Fatalf("The block uploaded within the grace period should stay on localhost:8080")
+	}
+	fileMeta, _ := LoadMetaFromMetaFile("test0")
+	if stored != len(fileMeta[file1].BlockHashList) {
+		t.Fatalf("%d blocks stored, expected %d", stored, len(fileMeta[file1].BlockHashList))
+	}
+
+	//client2 syncs
+	err = SyncClient("localhost:8080", "test1", blockSize, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	workingDir, _ := os.Getwd()
+	c, e := SameFile(workingDir+"/test1/"+file1, SRC_PATH+"/"+file1)
+	if e != nil || !c {
+		t.Fatalf("client2 should get file1 after the rebalance")
+	}
+}
+
+// A syncs with a block store that keeps its blocks on disk. The block store restarts. B syncs and gets the file.
+func TestSyncDiskBlockStoreSurvivesRestart(t *testing.T) {
+	t.Logf("client1 syncs with file1. the block store restarts. client2 syncs and gets file1.")
+	cfgPath := "./config_files/3nodes.txt"
+	blockDir := "block_data"
+	CleanUpDir(blockDir)
+	defer CleanUpDir(blockDir)
+	test := InitDiskBlockTest(cfgPath, "8080", blockDir)
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	file1 := "multi_file1.txt"
+	err := worker1.AddFile(file1)
+	if err != nil {
+		t.FailNow()
+	}
+
+	//client1 syncs
+	err = SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+
+	// the block store restarts with a write that a crash cut short
+	fileMeta, _ := LoadMetaFromMetaFile("test0")
+	hash := fileMeta[file1].BlockHashList[0]
+	tmpPath := blockDir + "/" + hash[:2] + "/" + hash + ".1.tmp"
+	if err := AppendFile(tmpPath, "torn"); err != nil {
+		t.Fatalf("Could not leave a temporary file behind")
+	}
+	RestartBlockStore(test, 0, "8080", "-storage", "disk", "-data", blockDir)
+
+	if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Fatalf("The block store should remove the temporary file on start")
+	}
+	hashes := ListBlocks("localhost:8080")
+	if len(hashes) != len(fileMeta[file1].BlockHashList) {
+		t.Fatalf("The block store should have kept %d blocks, it has %d", len(fileMeta[file1].BlockHashList), len(hashes))
+	}
+
+	//client2 syncs
+	err = SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	workingDir, _ := os.Getwd()
+	c, e := SameFile(workingDir+"/test1/"+file1, SRC_PATH+"/"+file1)
+	if e != nil || !c {
+		t.Fatalf("client2 should get file1 from the restarted block store")
+	}
+}
+
+// A syncs a file, then deletes it and syncs another one. Garbage collection removes the blocks of the deleted file only.
+func TestSyncGarbageCollectionDeletesUnreferencedBlocks(t *testing.T) {
+	t.Logf("client1 syncs with file1, deletes it and syncs with file2. garbage collection keeps the blocks of file2 and of an upload in flight.")
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitGarbageCollectionTest(cfgPath, "8080", "1s", 1)
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	file1 := "multi_file1.txt"
+	file2 := "multi_file2.txt"
+	err := worker1.AddFile(file1)
+	if err != nil {
+		t.FailNow()
+	}
+
+	//client1 syncs
+	err = SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	fileMeta, _ := LoadMetaFromMetaFile("test0")
+	oldHashes := fileMeta[file1].BlockHashList
+
+	//client1 deletes file1 and syncs with file2
+	err = worker1.DeleteFile(file1)
+	if err != nil {
+		t.FailNow()
+	}
+	err = worker1.AddFile(file2)
+	if err != nil {
+		t.FailNow()
+	}
+	err = SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	fileMeta, _ = LoadMetaFromMetaFile("test0")
+	live := make(map[string]bool)
+	for _, hash := range fileMeta[file2].BlockHashList {
+		live[hash] = true
+	}
+
+	// the blocks of file1 are past the grace period, a block that a client
+	// just uploaded is not
+	time.Sleep(1500 * time.Millisecond)
+	conn, err := grpc.Dial("localhost:8080", grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Could not connect to the block store")
+	}
+	defer conn.Close()
+	inFlight := []byte("uploaded, UpdateFile still to come")
+	_, err = surfstore.NewBlockStoreClient(conn).PutBlock(test.Context, &surfstore.Block{BlockData: inFlight, BlockSize: int32(len(inFlight))})
+	if err != nil {
+		t.Fatalf("PutBlock failed: %v", err)
+	}
+	live[surfstore.GetBlockHashString(inFlight)] = true
+
+	deleted, err := test.Clients[0].CollectGarbage(test.Context, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	for _, hash := range deleted.Hashes {
+		if live[hash] {
+			t.Fatalf("Garbage collection deleted the live block %s", hash)
+		}
+	}
+	garbage := make(map[string]bool)
+	for _, hash := range oldHashes {
+		if !live[hash] {
+			garbage[hash] = true
+		}
+	}
+	if len(deleted.Hashes) != len(garbage) {
+		t.Fatalf("Garbage collection deleted %d blocks, expected %d", len(deleted.Hashes), len(garbage))
+	}
+	hashes := ListBlocks("localhost:8080")
+	if len(hashes) != len(live) {
+		t.Fatalf("The block store should hold the %d live blocks, it has %d", len(live), len(hashes))
+	}
+
+	//client2 syncs
+	err = SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	workingDir, _ := os.Getwd()
+	c, e := SameFile(workingDir+"/test1/"+file2, SRC_PATH+"/"+file2)
+	if e != nil || !c {
+		t.Fatalf("client2 should get file2 after garbage collection")
+	}
+}
+
+// The block store turns away malformed blocks and unknown hashes. A block corrupted on disk fails the sync instead of ending up in the file.
+func TestSyncBlockIntegrity(t *testing.T) {
+	t.Logf("the block store checks blocks. client1 syncs with file1. a block is corrupted on disk. client2 fails to sync file1.")
+	cfgPath := "./config_files/3nodes.txt"
+	blockDir := "block_data"
+	CleanUpDir(blockDir)
+	defer CleanUpDir(blockDir)
+	test := InitDiskBlockTest(cfgPath, "8080", blockDir)
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	conn, err := grpc.Dial("localhost:8080", grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Could not connect to the block store")
+	}
+	defer conn.Close()
+	blockStore := surfstore.NewBlockStoreClient(conn)
+
+	data := []byte("some block")
+	_, err = blockStore.PutBlock(test.Context, &surfstore.Block{BlockData: data, BlockSize: int32(len(data)) + 1})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("A block with the wrong size should be refused, got %v", err)
+	}
+	data = make([]byte, surfstore.DEFAULT_MAX_BLOCK_SIZE+1)
+	_, err = blockStore.PutBlock(test.Context, &surfstore.Block{BlockData: data, BlockSize: int32(len(data))})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("A block over the size limit should be refused, got %v", err)
+	}
+	_, err = blockStore.GetBlock(test.Context, &surfstore.BlockHash{Hash: surfstore.GetBlockHashString([]byte("never stored"))})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("A missing block should be NotFound, got %v", err)
+	}
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	file1 := "multi_file1.txt"
+	err = worker1.AddFile(file1)
+	if err != nil {
+		t.FailNow()
+	}
+
+	//client1 syncs
+	err = SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+
+	fileMeta, _ := LoadMetaFromMetaFile("test0")
+	hash := fileMeta[file1].BlockHashList[0]
+	if err := AppendFile(blockDir+"/"+hash[:2]+"/"+hash, "bit rot"); err != nil {
+		t.Fatalf("Could not corrupt the block")
+	}
+
+	//client2 syncs
+	err = SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath)
+	if err == nil {
+		t.Fatalf("Sync should fail on a corrupt block")
+	}
+	if _, err := os.Stat("test1/" + file1); !os.IsNotExist(err) {
+		t.Fatalf("client2 should not write file1 from a corrupt block")
+	}
+}
+
+// Blocks streamed to the block store come back in the order they are asked for, a missing block ends the stream.
+func TestBlockStoreStreams(t *testing.T) {
+	t.Logf("client streams blocks in and out of the block store")
+	blockStore := InitBlockStore("8080")
+	defer func() {
+		_ = blockStore.Process.Kill()
+		_ = blockStore.Wait()
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	client := surfstore.NewSurfstoreRPCClient(nil, "", BLOCK_SIZE)
+	defer client.Close()
+
+	blocks := make([]*surfstore.Block, 0)
+	hashes := make([]string, 0)
+	for i := 0; i < 100; i++ {
+		data := []byte(strings.Repeat(strconv.Itoa(i), 50))
+		blocks = append(blocks, &surfstore.Block{BlockData: data, BlockSize: int32(len(data))})
+		hashes = append(hashes, surfstore.GetBlockHashString(data))
+	}
+	next := 0
+	var stored []string
+	err := client.PutBlocks(func() (*surfstore.Block, error) {
+		if next == len(blocks) {
+			return nil, nil
+		}
+		next++
+		return blocks[next-1], nil
+	}, "localhost:8080", &stored)
+	if err != nil || len(stored) != len(blocks) {
+		t.Fatalf("PutBlocks should store %d blocks: %v", len(blocks), err)
+	}
+
+	// ask for them backwards
+	reversed := make([]string, 0)
+	for i := len(hashes) - 1; i >= 0; i-- {
+		reversed = append(reversed, hashes[i])
+	}
+	received := 0
+	err = client.GetBlocks(reversed, "localhost:8080", func(block *surfstore.Block) error {
+		if surfstore.GetBlockHashString(block.BlockData) != reversed[received] {
+			t.Fatalf("Block %d came out of order", received)
+		}
+		received++
+		return nil
+	})
+	if err != nil || received != len(blocks) {
+		t.Fatalf("GetBlocks should return %d blocks, got %d: %v", len(blocks), received, err)
+	}
+
+	missing := append([]string{hashes[0]}, surfstore.GetBlockHashString([]byte("never stored")))
+	err = client.GetBlocks(missing, "localhost:8080", func(block *surfstore.Block) error { return nil })
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("GetBlocks should end with NotFound on a missing block, got %v", err)
+	}
+}
+
+// A syncs a log file with compressed blocks. B syncs without compression, gets the file and adds a copy of it, which reuses the compressed blocks.
+func TestSyncCompressedBlocks(t *testing.T) {
+	t.Logf("client1 syncs a log file with gzip. client2 syncs without compression, gets it and syncs a copy of it.")
+	cfgPath := "./config_files/3nodes.txt"
+	blockDir := "block_data"
+	CleanUpDir(blockDir)
+	defer CleanUpDir(blockDir)
+	test := InitDiskBlockTest(cfgPath, "8080", blockDir)
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	file1 := "app.log"
+	content := []byte(strings.Repeat("INFO request served in 3ms\n", 400))
+	if err := os.WriteFile("test0/"+file1, content, 0644); err != nil {
+		t.FailNow()
+	}
+
+	//client1 syncs
+	err := SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath, "-compress", "gzip")
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+
+	// the blocks sit compressed on the block store
+	blockFiles, _ := filepath.Glob(blockDir + "/*/*")
+	stored := 0
+	for _, blockFile := range blockFiles {
+		if !strings.HasSuffix(blockFile, ".gz") {
+			t.Fatalf("Block %s should be stored compressed", blockFile)
+		}
+		info, _ := os.Stat(blockFile)
+		stored += int(info.Size())
+	}
+	if len(blockFiles) == 0 || stored >= len(content)/2 {
+		t.Fatalf("%d bytes of blocks stored for a %d byte log file", stored, len(content))
+	}
+
+	//client2 syncs
+	err = SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	c, e := SameFile("test1/"+file1, "test0/"+file1)
+	if e != nil || !c {
+		t.Fatalf("client2 should get the log file")
+	}
+
+	// the copy hashes to the same blocks, whatever codec they are stored in
+	if err := CopyFile("test1/"+file1, "test1/copy.log"); err != nil {
+		t.FailNow()
+	}
+	err = SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	afterCopy, _ := filepath.Glob(blockDir + "/*/*")
+	if len(afterCopy) != len(blockFiles) {
+		t.Fatalf("The copy should reuse the %d stored blocks, there are %d now", len(blockFiles), len(afterCopy))
+	}
+}
+
+// A and B share a passphrase and sync an encrypted file with encrypted names. C syncs notes with convergent keys, D, with another passphrase, syncs a copy of them, which reuses C's blocks. E shares C's passphrase and gets the notes.
+func TestSyncEncryptedBlocks(t *testing.T) {
+	t.Logf("client1 and client2 share a passphrase and sync an encrypted file. client3 and client4 sync the same notes with convergent keys and different passphrases.")
+	cfgPath := "./config_files/3nodes.txt"
+	blockDir := "block_data"
+	CleanUpDir(blockDir)
+	defer CleanUpDir(blockDir)
+	test := InitDiskBlockTest(cfgPath, "8080", blockDir)
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	workers := make([]*DirectoryWorker, 5)
+	for i := range workers {
+		workers[i] = InitDirectoryWorker("test"+strconv.Itoa(i), SRC_PATH)
+		defer workers[i].CleanUp()
+	}
+
+	passphrases := []string{"passphrase_a.txt", "passphrase_b.txt", "passphrase_c.txt"}
+	for i, passphrase := range passphrases {
+		if err := os.WriteFile(passphrase, []byte("passphrase number "+strconv.Itoa(i)+"\n"), 0600); err != nil {
+			t.FailNow()
+		}
+		defer os.Remove(passphrase)
+	}
+	keyed := []string{"-passphrase-file", passphrases[0], "-encrypt-names"}
+	convergentB := []string{"-passphrase-file", passphrases[1], "-encrypt-names", "-convergent"}
+	convergentC := []string{"-passphrase-file", passphrases[2], "-encrypt-names", "-convergent"}
+
+	file1 := "secret.txt"
+	content := []byte(strings.Repeat("the launch code is 0000\n", 100))
+	if err := os.WriteFile("test0/"+file1, content, 0644); err != nil {
+		t.FailNow()
+	}
+
+	//client1 syncs
+	err := SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath, keyed...)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+
+	// neither the block store nor the metastore sees the plaintext
+	blockFiles, _ := filepath.Glob(blockDir + "/*/*")
+	if len(blockFiles) == 0 {
+		t.Fatalf("No blocks stored")
+	}
+	for _, blockFile := range blockFiles {
+		data, _ := os.ReadFile(blockFile)
+		if strings.Contains(string(data), "launch code") {
+			t.Fatalf("Block %s is stored in plaintext", blockFile)
+		}
+	}
+	fileInfoMap, err := test.Clients[0].GetFileInfoMap(test.Context, &emptypb.Empty{})
+	if err != nil || len(fileInfoMap.FileInfoMap) != 1 {
+		t.Fatalf("The metastore should hold one file")
+	}
+	if _, ok := fileInfoMap.FileInfoMap[file1]; ok {
+		t.Fatalf("The file name should be encrypted on the metastore")
+	}
+
+	//client2 syncs with the same passphrase
+	err = SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath, keyed...)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	c, e := SameFile("test1/"+file1, "test0/"+file1)
+	if e != nil || !c {
+		t.Fatalf("client2 should decrypt the file")
+	}
+
+	//client3 syncs notes with convergent keys
+	notes := []byte(strings.Repeat("meeting notes, nothing secret\n", 100))
+	if err := os.WriteFile("test2/notes.txt", notes, 0644); err != nil {
+		t.FailNow()
+	}
+	err = SyncClient("localhost:8080", "test2", BLOCK_SIZE, cfgPath, convergentB...)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	if _, err := os.Stat("test2/" + file1); !os.IsNotExist(err) {
+		t.Fatalf("client3 should not see files of another passphrase")
+	}
+	afterNotes, _ := filepath.Glob(blockDir + "/*/*")
+
+	//client4 syncs a copy of the notes with convergent keys and another passphrase
+	if err := os.WriteFile("test3/copy.txt", notes, 0644); err != nil {
+		t.FailNow()
+	}
+	err = SyncClient("localhost:8080", "test3", BLOCK_SIZE, cfgPath, convergentC...)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	afterCopy, _ := filepath.Glob(blockDir + "/*/*")
+	if len(afterCopy) != len(afterNotes) {
+		t.Fatalf("The copy should reuse the %d stored blocks, there are %d now", len(afterNotes), len(afterCopy))
+	}
+
+	//client5 syncs with client3's passphrase
+	err = SyncClient("localhost:8080", "test4", BLOCK_SIZE, cfgPath, convergentB...)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	c, e = SameFile("test4/notes.txt", "test2/notes.txt")
+	if e != nil || !c {
+		t.Fatalf("client5 should decrypt the notes with the keys client3 stored")
+	}
+	if files := workers[4].ListAllFile(); len(files) != 2 {
+		t.Fatalf("client5 should only get the notes, got %v", files)
+	}
+}
+
+// A syncs a file with convergent keys, deletes it and creates it again. B shares A's passphrase and gets the new content.
+func TestSyncEncryptedRecreatedFile(t *testing.T) {
+	t.Logf("client1 syncs a file with convergent keys, deletes it and creates it again. client2 syncs.")
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	passphrase := "passphrase_a.txt"
+	if err := os.WriteFile(passphrase, []byte("passphrase number 0\n"), 0600); err != nil {
+		t.FailNow()
+	}
+	defer os.Remove(passphrase)
+	convergent := []string{"-passphrase-file", passphrase, "-convergent"}
+
+	file1 := "notes.txt"
+	if err := os.WriteFile("test0/"+file1, []byte(strings.Repeat("first draft\n", 100)), 0644); err != nil {
+		t.FailNow()
+	}
+	err := SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath, convergent...)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+
+	//client1 deletes the file and creates it again
+	if err := os.Remove("test0/" + file1); err != nil {
+		t.FailNow()
+	}
+	err = SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath, convergent...)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	if err := os.WriteFile("test0/"+file1, []byte(strings.Repeat("second draft\n", 100)), 0644); err != nil {
+		t.FailNow()
+	}
+	err = SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath, convergent...)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+
+	// the re-created file keeps the keys of its blocks
+	err = SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath, convergent...)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	c, e := SameFile("test1/"+file1, "test0/"+file1)
+	if e != nil || !c {
+		t.Fatalf("client2 should decrypt the re-created file")
+	}
+}
+
+// A syncs nested folders, a file name with a comma and spaces and an empty folder. B gets them all. A deletes a subtree, B loses it and keeps the rest.
+func TestSyncSubdirectories(t *testing.T) {
+	t.Logf("client1 syncs nested folders. client2 gets them. client1 deletes a folder, client2 syncs again.")
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	files := map[string]string{
+		"docs/notes, final version.txt": "notes",
+		"docs/deep/nested/file.txt":     strings.Repeat("nested ", 200),
+		"top.txt":                       "top",
+	}
+	for name, content := range files {
+		if os.MkdirAll(filepath.Dir("test0/"+name), 0755) != nil || os.WriteFile("test0/"+name, []byte(content), 0644) != nil {
+			t.FailNow()
+		}
+	}
+	if err := os.MkdirAll("test0/empty/folder", 0755); err != nil {
+		t.FailNow()
+	}
+
+	//client1 syncs
+	err := SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+
+	//client2 syncs
+	err = SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	for name := range files {
+		c, e := SameFile("test1/"+name, "test0/"+name)
+		if e != nil || !c {
+			t.Fatalf("client2 should get %s", name)
+		}
+	}
+	if info, err := os.Stat("test1/empty/folder"); err != nil || !info.IsDir() {
+		t.Fatalf("client2 should get the empty folder")
+	}
+
+	// the index survives names with delimiters, syncing again changes nothing
+	err = SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	fileInfoMap, err := test.Clients[0].GetFileInfoMap(test.Context, &emptypb.Empty{})
+	if err != nil || len(fileInfoMap.FileInfoMap) != len(files)+1 {
+		t.Fatalf("The metastore should hold %d entries, got %v", len(files)+1, fileInfoMap)
+	}
+	for name, fileMeta := range fileInfoMap.FileInfoMap {
+		if fileMeta.Version != 1 {
+			t.Fatalf("%s should still be at version 1, is at %d", name, fileMeta.Version)
+		}
+	}
+
+	//client1 deletes the deep folder and syncs
+	if err := os.RemoveAll("test0/docs/deep"); err != nil {
+		t.FailNow()
+	}
+	err = SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+
+	//client2 syncs
+	err = SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	if _, err := os.Stat("test1/docs/deep"); !os.IsNotExist(err) {
+		t.Fatalf("client2 should lose the deleted folder")
+	}
+	if _, err := os.Stat("test1/docs/notes, final version.txt"); err != nil {
+		t.Fatalf("client2 should keep the rest of docs")
+	}
+	if _, err := os.Stat("test1/empty/folder"); err != nil {
+		t.Fatalf("client2 should keep the empty folder")
+	}
+}
+
+// A watches its base directory. A file created in it, and one in a new folder, reach the metastore without another sync. B syncs a file, which A pulls. A's deleted folder is deleted on the metastore.
+func TestSyncWatchMode(t *testing.T) {
+	t.Logf("client1 watches its base directory. client1 gets a new file and a new folder, client2 syncs a file, client1 deletes the folder.")
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	watcher := StartWatchClient("test0", BLOCK_SIZE, cfgPath, "-poll", "500ms")
+	defer func() {
+		_ = watcher.Process.Kill()
+		_ = watcher.Wait()
+	}()
+	time.Sleep(time.Second)
+
+	syncedWhere := func(filename string, done func(fileMeta *surfstore.FileMetaData) bool) bool {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			fileInfoMap, err := test.Clients[0].GetFileInfoMap(test.Context, &emptypb.Empty{})
+			if err == nil {
+				if fileMeta, ok := fileInfoMap.FileInfoMap[filename]; ok && done(fileMeta) {
+					return true
+				}
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		return false
+	}
+	synced := func(filename string) bool {
+		return syncedWhere(filename, func(*surfstore.FileMetaData) bool { return true })
+	}
+
+	//client1 gets a file
+	file1 := "multi_file1.txt"
+	if err := worker1.AddFile(file1); err != nil {
+		t.FailNow()
+	}
+	if !synced(file1) {
+		t.Fatalf("The watching client should sync %s", file1)
+	}
+
+	//client1 gets a folder with a file
+	if os.MkdirAll("test0/new/folder", 0755) != nil || os.WriteFile("test0/new/folder/note.txt", []byte("note"), 0644) != nil {
+		t.FailNow()
+	}
+	if !synced("new/folder/note.txt") {
+		t.Fatalf("The watching client should sync files in new folders")
+	}
+
+	//client2 syncs a file
+	err := SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	c, e := SameFile("test1/"+file1, "test0/"+file1)
+	if e != nil || !c {
+		t.Fatalf("client2 should get %s", file1)
+	}
+	file2 := "multi_file2.txt"
+	if err := worker2.AddFile(file2); err != nil {
+		t.FailNow()
+	}
+	err = SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+
+	// the watching client pulls it
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if c, e := SameFile("test0/"+file2, "test1/"+file2); e == nil && c {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The watching client should pull %s", file2)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	//client1 deletes the folder
+	if os.RemoveAll("test0/new") != nil {
+		t.FailNow()
+	}
+	tombstone := func(fileMeta *surfstore.FileMetaData) bool {
+		hashes := fileMeta.GetBlockHashList()
+		return len(hashes) == 1 && hashes[0] == "0"
+	}
+	if !syncedWhere("new/folder/note.txt", tombstone) {
+		t.Fatalf("The watching client should sync the files of deleted folders")
+	}
+}
+
+// A and B sync two files. A edits one and deletes the other, B edits both. B's edit of the first ends up as a conflict copy on both clients, its edit of the deleted one restores it.
+func TestSyncConflictCopies(t *testing.T) {
+	t.Logf("client1 and client2 share two files. client1 edits one and deletes the other, client2 edits both and syncs last.")
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	edited, deleted := "docs/report.txt", ".profile"
+	if os.MkdirAll("test0/docs", 0755) != nil || os.WriteFile("test0/"+edited, []byte("draft"), 0644) != nil ||
+		os.WriteFile("test0/"+deleted, []byte("settings"), 0644) != nil {
+		t.FailNow()
+	}
+	for _, baseDir := range []string{"test0", "test1"} {
+		if err := SyncClient("localhost:8080", baseDir, BLOCK_SIZE, cfgPath); err != nil {
+			t.Fatalf("Sync failed")
+		}
+	}
+
+	//client1 edits and deletes, client2 edits both
+	if os.WriteFile("test0/"+edited, []byte("client1's report"), 0644) != nil || os.Remove("test0/"+deleted) != nil ||
+		os.WriteFile("test1/"+edited, []byte("client2's report"), 0644) != nil ||
+		os.WriteFile("test1/"+deleted, []byte("client2's settings"), 0644) != nil {
+		t.FailNow()
+	}
+	for _, baseDir := range []string{"test0", "test1", "test0"} {
+		if err := SyncClient("localhost:8080", baseDir, BLOCK_SIZE, cfgPath); err != nil {
+			t.Fatalf("Sync failed")
+		}
+	}
+
+	expected := map[string]string{
+		edited: "client1's report",
+		"docs/report (conflicted copy from *).txt": "client2's report",
+		deleted: "client2's settings",
+	}
+	for _, baseDir := range []string{"test0", "test1"} {
+		for pattern, content := range expected {
+			matches, _ := filepath.Glob(baseDir + "/" + pattern)
+			if len(matches) != 1 {
+				t.Fatalf("%s should have one %s, found %v", baseDir, pattern, matches)
+			}
+			if data, err := os.ReadFile(matches[0]); err != nil || string(data) != content {
+				t.Fatalf("%s should hold %q", matches[0], content)
+			}
+		}
+	}
+}
+
+// A syncs four versions of a file, the metastore keeps the last three. Garbage collection spares their blocks. A downloads and restores an old version, which B syncs.
+func TestSyncFileHistory(t *testing.T) {
+	t.Logf("client1 syncs four versions of file1. garbage collection keeps the three kept versions. client1 downloads and restores version 2, client2 syncs.")
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitGarbageCollectionTest(cfgPath, "8080", "0s", 3)
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+	defer os.Remove("history_v2.txt")
+
+	file1 := "history.txt"
+	for version := 1; version <= 4; version++ {
+		if os.WriteFile("test0/"+file1, []byte("version "+strconv.Itoa(version)), 0644) != nil {
+			t.FailNow()
+		}
+		if err := SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath, "-author", "alice"); err != nil {
+			t.Fatalf("Sync failed")
+		}
+	}
+
+	history, err := test.Clients[0].GetFileHistory(test.Context, &surfstore.FileHistoryInput{Filename: file1})
+	if err != nil || len(history.Versions) != 3 {
+		t.Fatalf("The metastore should keep 3 versions of file1, got %v (%v)", history, err)
+	}
+	for i, version := range history.Versions {
+		fileMeta := version.FileMetaData
+		if fileMeta.Version != int32(i+2) || fileMeta.Author != "alice" || version.Timestamp == 0 {
+			t.Fatalf("Unexpected version %d of file1: %v", i+2, version)
+		}
+	}
+	if err := RunClientCommand(cfgPath, "history", file1); err != nil {
+		t.Fatalf("Listing the history failed")
+	}
+
+	// only the version that dropped out of the history is garbage
+	deleted, err := test.Clients[0].CollectGarbage(test.Context, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if len(deleted.Hashes) != 1 || deleted.Hashes[0] != surfstore.GetBlockHashString([]byte("version 1")) {
+		t.Fatalf("Garbage collection should delete the block of version 1 only, deleted %v", deleted.Hashes)
+	}
+
+	// old versions can be downloaded and restored, but not dropped ones
+	if err := RunClientCommand(cfgPath, "download", file1, "2", "history_v2.txt"); err != nil {
+		t.Fatalf("Downloading version 2 failed")
+	}
+	if data, err := os.ReadFile("history_v2.txt"); err != nil || string(data) != "version 2" {
+		t.Fatalf("The download should hold version 2")
+	}
+	if err := RunClientCommand(cfgPath, "restore", file1, "1"); err == nil {
+		t.Fatalf("Version 1 is not kept, it can't be restored")
+	}
+	if err := RunClientCommand(cfgPath, "-author", "bob", "restore", file1, "2"); err != nil {
+		t.Fatalf("Restoring version 2 failed")
+	}
+
+	//client2 syncs
+	if err := SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath); err != nil {
+		t.Fatalf("Sync failed")
+	}
+	if data, err := os.ReadFile("test1/" + file1); err != nil || string(data) != "version 2" {
+		t.Fatalf("client2 should get the restored version")
+	}
+	fileMeta, _ := LoadMetaFromMetaFile("test1")
+	if fileMeta[file1].Version != 5 {
+		t.Fatalf("The restore should make version 5, client2 has %d", fileMeta[file1].Version)
+	}
+	history, err = test.Clients[0].GetFileHistory(test.Context, &surfstore.FileHistoryInput{Filename: file1})
+	if err != nil || history.Versions[len(history.Versions)-1].FileMetaData.Author != "bob" {
+		t.Fatalf("The restored version should be bob's, got %v (%v)", history, err)
+	}
 }
@@ -3,8 +3,13 @@ package SurfTest
 import (
 	context "context"
 	"cse224/proj5/pkg/surfstore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestRaftSetLeader(t *testing.T) {
@@ -102,8 +107,690 @@ func TestRaftFollowersGetUpdates(t *testing.T) {
 	})
 
 	for _, server := range test.Clients {
+		state := AwaitState(test.Context, server, func(state *surfstore.RaftInternalState) bool {
+			return SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap)
+		})
+		if !SameLog(goldenLog, state.Log) {
+			t.Log("Logs do not match")
+			t.Fail()
+		}
+		if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+			t.Log("MetaStore state is not correct")
+			t.Fail()
+		}
+	}
+}
+
+func TestRaftHeartbeatLoopCatchesUpFollowers(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx := 0
+	laggingIdx := 2
+	test.Clients[laggingIdx].Crash(test.Context, &emptypb.Empty{})
+	test.Clients[leaderIdx].SetLeader(test.Context, &emptypb.Empty{})
+
+	filemeta1 := &surfstore.FileMetaData{
+		Filename:      "testFile1",
+		Version:       1,
+		BlockHashList: nil,
+	}
+	filemeta2 := &surfstore.FileMetaData{
+		Filename:      "testFile2",
+		Version:       1,
+		BlockHashList: nil,
+	}
+	for _, filemeta := range []*surfstore.FileMetaData{filemeta1, filemeta2} {
+		if _, err := test.Clients[leaderIdx].UpdateFile(test.Context, filemeta); err != nil {
+			t.Fatalf("Update should commit without the crashed follower: %v", err)
+		}
+	}
+
+	// nobody calls SendHeartbeat, the leader's heartbeats alone bring the
+	// crashed follower up to date and tell everyone what is committed
+	test.Clients[laggingIdx].Restore(test.Context, &emptypb.Empty{})
+	time.Sleep(time.Second)
+
+	goldenMeta := surfstore.NewMetaStore("")
+	goldenMeta.UpdateFile(test.Context, filemeta1)
+	goldenMeta.UpdateFile(test.Context, filemeta2)
+	goldenLog := []*surfstore.UpdateOperation{
+		{Term: 1, FileMetaData: filemeta1},
+		{Term: 1, FileMetaData: filemeta2},
+	}
+	for idx, server := range test.Clients {
 		state, _ := server.GetInternalState(test.Context, &emptypb.Empty{})
 		if !SameLog(goldenLog, state.Log) {
+			t.Logf("Log of server %d does not match", idx)
+			t.Fail()
+		}
+		if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+			t.Logf("MetaStore state of server %d is not correct", idx)
+			t.Fail()
+		}
+	}
+}
+
+func TestRaftElectLeader(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitElectionTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx, term := findLeader(t, test)
+	if leaderIdx == -1 {
+		t.Fatalf("No leader was elected")
+	}
+
+	// crash the leader, the others should elect a new one in a newer term
+	test.Clients[leaderIdx].Crash(test.Context, &emptypb.Empty{})
+	time.Sleep(2 * time.Second)
+
+	newLeaderIdx, newTerm := findLeader(t, test)
+	if newLeaderIdx == -1 || newLeaderIdx == leaderIdx {
+		t.Fatalf("No new leader was elected after the leader crashed")
+	}
+	if newTerm <= term {
+		t.Fatalf("New leader should be in a term newer than %d, got %d", term, newTerm)
+	}
+
+	// the old leader steps down once it is restored
+	test.Clients[leaderIdx].Restore(test.Context, &emptypb.Empty{})
+	time.Sleep(time.Second)
+
+	state, _ := test.Clients[leaderIdx].GetInternalState(test.Context, &emptypb.Empty{})
+	if state.IsLeader {
+		t.Fatalf("Server %d should have stepped down after being restored", leaderIdx)
+	}
+	if state.Term < newTerm {
+		t.Fatalf("Server %d should have caught up to term %d", leaderIdx, newTerm)
+	}
+}
+
+// findLeader returns the index and term of the only non-crashed leader, or -1
+// if there is none
+func findLeader(t *testing.T, test TestInfo) (int, int64) {
+	leaderIdx, term := -1, int64(0)
+	for idx, server := range test.Clients {
+		crashed, _ := server.IsCrashed(test.Context, &emptypb.Empty{})
+		if crashed == nil || crashed.IsCrashed {
+			continue
+		}
+		state, _ := server.GetInternalState(test.Context, &emptypb.Empty{})
+		if state == nil || !state.IsLeader {
+			continue
+		}
+		if leaderIdx != -1 {
+			t.Fatalf("Servers %d and %d are both leaders", leaderIdx, idx)
+		}
+		leaderIdx, term = idx, state.Term
+	}
+	return leaderIdx, term
+}
+
+func TestRaftLogsConsistentAfterLeaderChange(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	// the leader is cut off from the others, its entry can't be committed
+	test.Clients[1].Crash(test.Context, &emptypb.Empty{})
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+
+	lostMeta := &surfstore.FileMetaData{
+		Filename:      "testFile1",
+		Version:       1,
+		BlockHashList: []string{"lost"},
+	}
+	ctx, cancel := context.WithTimeout(test.Context, 500*time.Millisecond)
+	defer cancel()
+	test.Clients[0].UpdateFile(ctx, lostMeta)
+
+	// the others elect a new leader that commits a different entry
+	test.Clients[0].Crash(test.Context, &emptypb.Empty{})
+	test.Clients[1].Restore(test.Context, &emptypb.Empty{})
+	test.Clients[2].Restore(test.Context, &emptypb.Empty{})
+	test.Clients[1].SetLeader(test.Context, &emptypb.Empty{})
+
+	filemeta1 := &surfstore.FileMetaData{
+		Filename:      "testFile1",
+		Version:       1,
+		BlockHashList: []string{"kept"},
+	}
+	test.Clients[1].UpdateFile(test.Context, filemeta1)
+
+	// the old leader comes back and must drop its uncommitted entry
+	test.Clients[0].Restore(test.Context, &emptypb.Empty{})
+	test.Clients[1].SendHeartbeat(test.Context, &emptypb.Empty{})
+	test.Clients[1].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	goldenMeta := surfstore.NewMetaStore("")
+	goldenMeta.UpdateFile(test.Context, filemeta1)
+	goldenLog := []*surfstore.UpdateOperation{{
+		Term:         2,
+		FileMetaData: filemeta1,
+	}}
+
+	for idx, server := range test.Clients {
+		state, _ := server.GetInternalState(test.Context, &emptypb.Empty{})
+		if !SameLog(goldenLog, state.Log) {
+			t.Logf("Log of server %d does not match", idx)
+			t.Fail()
+		}
+		if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+			t.Logf("MetaStore state of server %d is not correct", idx)
+			t.Fail()
+		}
+	}
+}
+
+func TestRaftRestartRecoversState(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	dataDir := "raft_data"
+	CleanUpDir(dataDir)
+	defer CleanUpDir(dataDir)
+	test := InitPersistentTest(cfgPath, "8080", dataDir)
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx := 0
+	test.Clients[leaderIdx].SetLeader(test.Context, &emptypb.Empty{})
+
+	filemeta1 := &surfstore.FileMetaData{
+		Filename:      "testFile1",
+		Version:       1,
+		BlockHashList: []string{"hash1"},
+	}
+	test.Clients[leaderIdx].UpdateFile(test.Context, filemeta1)
+
+	goldenMeta := surfstore.NewMetaStore("")
+	goldenMeta.UpdateFile(test.Context, filemeta1)
+	goldenLog := []*surfstore.UpdateOperation{{
+		Term:         1,
+		FileMetaData: filemeta1,
+	}}
+	AwaitState(test.Context, test.Clients[1], func(state *surfstore.RaftInternalState) bool {
+		return SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap)
+	})
+
+	// restart a follower with a half written record at the end of its log
+	// and the leader with an intact one
+	for _, idx := range []int{1, leaderIdx} {
+		KillRaftServer(test, idx)
+		if idx != leaderIdx {
+			if err := AppendFile(dataDir+"/raft_1.wal", "torn"); err != nil {
+				t.Fatalf("Could not damage the write-ahead log")
+			}
+		}
+		StartRaftServer(test, idx)
+
+		state, err := test.Clients[idx].GetInternalState(test.Context, &emptypb.Empty{})
+		if err != nil {
+			t.Fatalf("Server %d did not come back: %v", idx, err)
+		}
+		if state.Term != 1 {
+			t.Logf("Server %d should have recovered term 1, got %d", idx, state.Term)
+			t.Fail()
+		}
+		if !SameLog(goldenLog, state.Log) {
+			t.Logf("Server %d did not recover its log", idx)
+			t.Fail()
+		}
+		if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+			t.Logf("Server %d did not rebuild its MetaStore", idx)
+			t.Fail()
+		}
+	}
+}
+
+func TestRaftSnapshotCatchesUpFollower(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := initTest(cfgPath, "8080", "-m", "-snapshot-entries", "2")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx := 0
+	test.Clients[leaderIdx].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[leaderIdx].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	// server 2 misses every update, the leader compacts them away
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+
+	goldenMeta := surfstore.NewMetaStore("")
+	for i := 0; i < 5; i++ {
+		filemeta := &surfstore.FileMetaData{
+			Filename:      "testFile" + strconv.Itoa(i),
+			Version:       1,
+			BlockHashList: []string{"hash" + strconv.Itoa(i)},
+		}
+		test.Clients[leaderIdx].UpdateFile(test.Context, filemeta)
+		goldenMeta.UpdateFile(test.Context, filemeta)
+	}
+
+	test.Clients[2].Restore(test.Context, &emptypb.Empty{})
+	test.Clients[leaderIdx].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	for idx, server := range test.Clients {
+		state, _ := server.GetInternalState(test.Context, &emptypb.Empty{})
+		if len(state.Log) >= 2 {
+			t.Logf("Server %d should have compacted its log, it holds %d entries", idx, len(state.Log))
+			t.Fail()
+		}
+		if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+			t.Logf("MetaStore state of server %d is not correct", idx)
+			t.Fail()
+		}
+	}
+}
+
+func TestRaftAddAndRemoveServer(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx := 0
+	test.Clients[leaderIdx].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[leaderIdx].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	filemeta1 := &surfstore.FileMetaData{
+		Filename:      "testFile1",
+		Version:       1,
+		BlockHashList: nil,
+	}
+	test.Clients[leaderIdx].UpdateFile(test.Context, filemeta1)
+
+	// server 3 is only in the bigger config file and starts outside the cluster
+	proc, conn := StartJoiningRaftServer(test, "./config_files/4nodes.txt", 3)
+	defer proc.Process.Kill()
+	defer conn.Close()
+	newServer := surfstore.NewRaftSurfstoreClient(conn)
+	newMember := &surfstore.RaftMember{ServerId: 3, Addr: "localhost:9010"}
+	if _, err := test.Clients[leaderIdx].AddServer(test.Context, newMember); err != nil {
+		t.Fatalf("AddServer failed: %v", err)
+	}
+
+	goldenMeta := surfstore.NewMetaStore("")
+	goldenMeta.UpdateFile(test.Context, filemeta1)
+	state, _ := newServer.GetInternalState(test.Context, &emptypb.Empty{})
+	if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+		t.Logf("The new server did not catch up with the MetaStore")
+		t.Fail()
+	}
+
+	// with server 1 gone, 0 and 3 are a majority of the new cluster
+	if _, err := test.Clients[leaderIdx].RemoveServer(test.Context, &surfstore.RaftMember{ServerId: 1}); err != nil {
+		t.Fatalf("RemoveServer failed: %v", err)
+	}
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+
+	filemeta2 := &surfstore.FileMetaData{
+		Filename:      "testFile2",
+		Version:       1,
+		BlockHashList: nil,
+	}
+	if _, err := test.Clients[leaderIdx].UpdateFile(test.Context, filemeta2); err != nil {
+		t.Fatalf("Update should commit on the new majority: %v", err)
+	}
+	goldenMeta.UpdateFile(test.Context, filemeta2)
+
+	state = AwaitState(test.Context, newServer, func(state *surfstore.RaftInternalState) bool {
+		return SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap)
+	})
+	if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+		t.Logf("The new server did not get the latest update")
+		t.Fail()
+	}
+	state, _ = test.Clients[1].GetInternalState(test.Context, &emptypb.Empty{})
+	if _, ok := state.MetaMap.FileInfoMap["testFile2"]; ok {
+		t.Logf("The removed server should not get updates anymore")
+		t.Fail()
+	}
+}
+
+func TestRaftMembershipChangeAfterFailover(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx := 0
+	test.Clients[leaderIdx].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[leaderIdx].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	filemeta1 := &surfstore.FileMetaData{
+		Filename:      "testFile1",
+		Version:       1,
+		BlockHashList: nil,
+	}
+	test.Clients[leaderIdx].UpdateFile(test.Context, filemeta1)
+
+	// server 1 takes over from the failed leader and removes it before it
+	// committed anything of its own
+	test.Clients[leaderIdx].Crash(test.Context, &emptypb.Empty{})
+	newLeaderIdx := 1
+	test.Clients[newLeaderIdx].SetLeader(test.Context, &emptypb.Empty{})
+	if _, err := test.Clients[newLeaderIdx].RemoveServer(test.Context, &surfstore.RaftMember{ServerId: int64(leaderIdx)}); err != nil {
+		t.Fatalf("RemoveServer failed: %v", err)
+	}
+
+	// an entry of the new term is committed before the config that removes
+	// server 0
+	state, _ := test.Clients[newLeaderIdx].GetInternalState(test.Context, &emptypb.Empty{})
+	configIdx := -1
+	for idx, entry := range state.Log {
+		if entry.Term == state.Term && entry.Config != nil {
+			configIdx = idx
+			break
+		}
+	}
+	if configIdx < 1 || state.Log[configIdx-1].Term != state.Term || state.Log[configIdx-1].Config != nil {
+		t.Fatalf("The new leader should commit an entry of its term before changing the membership")
+	}
+	if _, err := test.Clients[newLeaderIdx].SendHeartbeat(test.Context, &emptypb.Empty{}); err != nil {
+		t.Fatalf("Heartbeat failed: %v", err)
+	}
+
+	filemeta2 := &surfstore.FileMetaData{
+		Filename:      "testFile2",
+		Version:       1,
+		BlockHashList: nil,
+	}
+	if _, err := test.Clients[newLeaderIdx].UpdateFile(test.Context, filemeta2); err != nil {
+		t.Fatalf("Update should commit on the new cluster: %v", err)
+	}
+
+	goldenMeta := surfstore.NewMetaStore("")
+	goldenMeta.UpdateFile(test.Context, filemeta1)
+	goldenMeta.UpdateFile(test.Context, filemeta2)
+	for _, idx := range []int{1, 2} {
+		state := AwaitState(test.Context, test.Clients[idx], func(state *surfstore.RaftInternalState) bool {
+			return SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap)
+		})
+		if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+			t.Logf("MetaStore state of server %d is not correct", idx)
+			t.Fail()
+		}
+	}
+}
+
+func TestRaftReadNeedsQuorum(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx := 0
+	test.Clients[leaderIdx].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[leaderIdx].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	filemeta1 := &surfstore.FileMetaData{
+		Filename:      "testFile1",
+		Version:       1,
+		BlockHashList: nil,
+	}
+	test.Clients[leaderIdx].UpdateFile(test.Context, filemeta1)
+
+	fileInfoMap, err := test.Clients[leaderIdx].GetFileInfoMap(test.Context, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("Leader should serve reads: %v", err)
+	}
+	if _, ok := fileInfoMap.FileInfoMap["testFile1"]; !ok {
+		t.Fatalf("Read should see the committed update")
+	}
+
+	// cut off from the others the leader can't tell whether it was deposed
+	test.Clients[1].Crash(test.Context, &emptypb.Empty{})
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+
+	if _, err := test.Clients[leaderIdx].GetFileInfoMap(test.Context, &emptypb.Empty{}); err == nil {
+		t.Fatalf("Leader without a majority should refuse reads")
+	}
+}
+
+func TestRaftFollowerPointsAtLeader(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx := 0
+	test.Clients[leaderIdx].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[leaderIdx].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	filemeta1 := &surfstore.FileMetaData{
+		Filename:      "testFile1",
+		Version:       1,
+		BlockHashList: nil,
+	}
+	_, err := test.Clients[1].UpdateFile(test.Context, filemeta1)
+	if err == nil {
+		t.Fatalf("Follower should not accept updates")
+	}
+
+	var hint *surfstore.LeaderHint
+	for _, detail := range status.Convert(err).Details() {
+		if h, ok := detail.(*surfstore.LeaderHint); ok {
+			hint = h
+		}
+	}
+	if hint == nil || hint.LeaderId != int64(leaderIdx) || hint.LeaderAddr != test.Ips[leaderIdx] {
+		t.Fatalf("Follower should point at server %d, got %v", leaderIdx, hint)
+	}
+}
+
+func TestRaftTransferLeadership(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx := 0
+	test.Clients[leaderIdx].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[leaderIdx].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	filemeta1 := &surfstore.FileMetaData{
+		Filename:      "testFile1",
+		Version:       1,
+		BlockHashList: nil,
+	}
+	test.Clients[leaderIdx].UpdateFile(test.Context, filemeta1)
+
+	// server 2 takes over even though nobody's election timer runs out
+	targetIdx := 2
+	input := &surfstore.TransferLeadershipInput{TargetId: int64(targetIdx)}
+	if _, err := test.Clients[leaderIdx].TransferLeadership(test.Context, input); err != nil {
+		t.Fatalf("Transfer failed: %v", err)
+	}
+
+	state, _ := test.Clients[targetIdx].GetInternalState(test.Context, &emptypb.Empty{})
+	if !state.IsLeader || state.Term != 2 {
+		t.Fatalf("Server %d should lead term 2", targetIdx)
+	}
+	state, _ = test.Clients[leaderIdx].GetInternalState(test.Context, &emptypb.Empty{})
+	if state.IsLeader {
+		t.Fatalf("Server %d should have stepped down", leaderIdx)
+	}
+
+	filemeta2 := &surfstore.FileMetaData{
+		Filename:      "testFile2",
+		Version:       1,
+		BlockHashList: nil,
+	}
+	if _, err := test.Clients[targetIdx].UpdateFile(test.Context, filemeta2); err != nil {
+		t.Fatalf("New leader should accept updates: %v", err)
+	}
+
+	goldenMeta := surfstore.NewMetaStore("")
+	goldenMeta.UpdateFile(test.Context, filemeta1)
+	goldenMeta.UpdateFile(test.Context, filemeta2)
+	for idx, server := range test.Clients {
+		state := AwaitState(test.Context, server, func(state *surfstore.RaftInternalState) bool {
+			return SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap)
+		})
+		if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+			t.Logf("MetaStore state of server %d is not correct", idx)
+			t.Fail()
+		}
+	}
+}
+
+func TestRaftLeaseReadsAfterTransfer(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitLeaseTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx := 0
+	test.Clients[leaderIdx].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[leaderIdx].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	filemeta1 := &surfstore.FileMetaData{
+		Filename:      "testFile1",
+		Version:       1,
+		BlockHashList: nil,
+	}
+	test.Clients[leaderIdx].UpdateFile(test.Context, filemeta1)
+	if _, err := test.Clients[leaderIdx].GetFileInfoMap(test.Context, &emptypb.Empty{}); err != nil {
+		t.Fatalf("Leader should serve reads under its lease: %v", err)
+	}
+
+	targetIdx := 2
+	input := &surfstore.TransferLeadershipInput{TargetId: int64(targetIdx)}
+	if _, err := test.Clients[leaderIdx].TransferLeadership(test.Context, input); err != nil {
+		t.Fatalf("Transfer failed: %v", err)
+	}
+
+	filemeta2 := &surfstore.FileMetaData{
+		Filename:      "testFile2",
+		Version:       1,
+		BlockHashList: nil,
+	}
+	if _, err := test.Clients[targetIdx].UpdateFile(test.Context, filemeta2); err != nil {
+		t.Fatalf("New leader should accept updates: %v", err)
+	}
+
+	// the voters that elected the new leader still count towards the old
+	// leader's lease, it must not answer from its own metastore
+	fileInfoMap, err := test.Clients[leaderIdx].GetFileInfoMap(test.Context, &emptypb.Empty{})
+	if err == nil {
+		if _, ok := fileInfoMap.FileInfoMap["testFile2"]; !ok {
+			t.Fatalf("Old leader served a stale read")
+		}
+	} else if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Old leader should point at the new one, got %v", err)
+	}
+}
+
+func TestRaftPreVoteKeepsTermWhenIsolated(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitElectionTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx, term := findLeader(t, test)
+	if leaderIdx == -1 {
+		t.Fatalf("No leader was elected")
+	}
+
+	// the last server times out again and again without anyone to vote for it
+	isolatedIdx := -1
+	for idx, server := range test.Clients {
+		if isolatedIdx == -1 && idx != leaderIdx {
+			isolatedIdx = idx
+			continue
+		}
+		server.Crash(test.Context, &emptypb.Empty{})
+	}
+	time.Sleep(2 * time.Second)
+
+	state, _ := test.Clients[isolatedIdx].GetInternalState(test.Context, &emptypb.Empty{})
+	if state.Term != term {
+		t.Fatalf("Isolated server %d should have stayed in term %d, got %d", isolatedIdx, term, state.Term)
+	}
+}
+
+func TestRaftCheckQuorumStepsDown(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx := 0
+	test.Clients[leaderIdx].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[leaderIdx].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	test.Clients[1].Crash(test.Context, &emptypb.Empty{})
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+	time.Sleep(2 * time.Second)
+
+	state, _ := test.Clients[leaderIdx].GetInternalState(test.Context, &emptypb.Empty{})
+	if state.IsLeader {
+		t.Fatalf("Leader without a majority should have stepped down")
+	}
+}
+
+func TestRaftConcurrentUpdates(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx := 0
+	test.Clients[leaderIdx].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[leaderIdx].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	numFiles := 200
+	goldenMeta := surfstore.NewMetaStore("")
+	var wg sync.WaitGroup
+	for i := 0; i < numFiles; i++ {
+		filemeta := &surfstore.FileMetaData{
+			Filename:      "testFile" + strconv.Itoa(i),
+			Version:       1,
+			BlockHashList: nil,
+		}
+		goldenMeta.UpdateFile(test.Context, filemeta)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := test.Clients[leaderIdx].UpdateFile(test.Context, filemeta); err != nil {
+				t.Log("UpdateFile failed: ", err)
+				t.Fail()
+			}
+		}()
+	}
+	wg.Wait()
+	test.Clients[leaderIdx].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	leaderState, _ := test.Clients[leaderIdx].GetInternalState(test.Context, &emptypb.Empty{})
+	if len(leaderState.Log) != numFiles {
+		t.Logf("Leader has %d entries, expected %d", len(leaderState.Log), numFiles)
+		t.Fail()
+	}
+	for _, server := range test.Clients {
+		state, _ := server.GetInternalState(test.Context, &emptypb.Empty{})
+		if !SameLog(leaderState.Log, state.Log) {
 			t.Log("Logs do not match")
 			t.Fail()
 		}
@@ -113,3 +800,143 @@ func TestRaftFollowersGetUpdates(t *testing.T) {
 		}
 	}
 }
+
+func TestRaftLearnerReplicasAndPromotion(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes_1learner.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx := 0
+	learnerIdx := 3
+	test.Clients[leaderIdx].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[leaderIdx].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	// the learner gets the log, but doesn't make a majority with the leader
+	test.Clients[1].Crash(test.Context, &emptypb.Empty{})
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+	filemeta1 := &surfstore.FileMetaData{
+		Filename:      "testFile1",
+		Version:       1,
+		BlockHashList: nil,
+	}
+	ctx, cancel := context.WithTimeout(test.Context, time.Second)
+	defer cancel()
+	if _, err := test.Clients[leaderIdx].UpdateFile(ctx, filemeta1); err == nil {
+		t.Fatalf("Update should not commit with only the leader and a learner")
+	}
+	state, _ := test.Clients[learnerIdx].GetInternalState(test.Context, &emptypb.Empty{})
+	if len(state.Log) != 1 {
+		t.Fatalf("The learner should have the update in its log, it has %d entries", len(state.Log))
+	}
+
+	// the leader stepped down meanwhile, having lost touch with the voters
+	test.Clients[1].Restore(test.Context, &emptypb.Empty{})
+	test.Clients[2].Restore(test.Context, &emptypb.Empty{})
+	test.Clients[leaderIdx].SetLeader(test.Context, &emptypb.Empty{})
+	// a read commits an entry of the new term, and with it the update
+	test.Clients[leaderIdx].GetFileInfoMap(test.Context, &emptypb.Empty{})
+	test.Clients[leaderIdx].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	goldenMeta := surfstore.NewMetaStore("")
+	goldenMeta.UpdateFile(test.Context, filemeta1)
+	fileInfoMap, err := test.Clients[learnerIdx].GetFileInfoMapStale(test.Context, &emptypb.Empty{})
+	if err != nil || !SameMeta(goldenMeta.FileMetaMap, fileInfoMap.FileInfoMap) {
+		t.Logf("The learner should serve the committed update: %v", err)
+		t.Fail()
+	}
+
+	// once promoted and with server 2 gone, 0 and 3 are a majority
+	learner := &surfstore.RaftMember{ServerId: int64(learnerIdx)}
+	if _, err := test.Clients[leaderIdx].PromoteLearner(test.Context, learner); err != nil {
+		t.Fatalf("PromoteLearner failed: %v", err)
+	}
+	if _, err := test.Clients[leaderIdx].RemoveServer(test.Context, &surfstore.RaftMember{ServerId: 2}); err != nil {
+		t.Fatalf("RemoveServer failed: %v", err)
+	}
+	test.Clients[1].Crash(test.Context, &emptypb.Empty{})
+
+	filemeta2 := &surfstore.FileMetaData{
+		Filename:      "testFile2",
+		Version:       1,
+		BlockHashList: nil,
+	}
+	if _, err := test.Clients[leaderIdx].UpdateFile(test.Context, filemeta2); err != nil {
+		t.Fatalf("Update should commit with the promoted learner's vote: %v", err)
+	}
+}
+
+func TestRaftWatchChanges(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	ctx, cancel := context.WithTimeout(test.Context, 10*time.Second)
+	defer cancel()
+	stream, err := test.Clients[0].WatchChanges(ctx, &surfstore.WatchChangesInput{SinceIndex: -1})
+	if err != nil {
+		t.Fatalf("Could not watch the leader: %v", err)
+	}
+	recv := func(stream surfstore.RaftSurfstore_WatchChangesClient, filename string) *surfstore.FileChange {
+		change, err := stream.Recv()
+		if err != nil || change.FileMetaData.Filename != filename {
+			t.Fatalf("Expected a change of %s, got %v (%v)", filename, change, err)
+		}
+		return change
+	}
+
+	// every committed update is pushed with its log index
+	for _, filename := range []string{"testFile1", "testFile2"} {
+		test.Clients[0].UpdateFile(test.Context, &surfstore.FileMetaData{Filename: filename, Version: 1, BlockHashList: []string{filename}})
+	}
+	first := recv(stream, "testFile1")
+	second := recv(stream, "testFile2")
+	if second.Index <= first.Index {
+		t.Fatalf("Change indexes should grow, got %d then %d", first.Index, second.Index)
+	}
+
+	// a follower doesn't stream, it names the leader
+	followerStream, err := test.Clients[1].WatchChanges(ctx, &surfstore.WatchChangesInput{SinceIndex: -1})
+	if err == nil {
+		_, err = followerStream.Recv()
+	}
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("A follower should turn watchers away, got %v", err)
+	}
+
+	// the stream ends once the leader steps down
+	test.Clients[1].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[1].SendHeartbeat(test.Context, &emptypb.Empty{})
+	if _, err := stream.Recv(); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("The stream should end when the leader steps down, got %v", err)
+	}
+
+	// the new leader resumes after the last change the watcher got
+	test.Clients[1].UpdateFile(test.Context, &surfstore.FileMetaData{Filename: "testFile3", Version: 1, BlockHashList: []string{"testFile3"}})
+	resumed, err := test.Clients[1].WatchChanges(ctx, &surfstore.WatchChangesInput{SinceIndex: first.Index})
+	if err != nil {
+		t.Fatalf("Could not watch the new leader: %v", err)
+	}
+	recv(resumed, "testFile2")
+	third := recv(resumed, "testFile3")
+
+	// a watcher that fell behind gets every version, not just the latest
+	for version := int32(2); version <= 3; version++ {
+		test.Clients[1].UpdateFile(test.Context, &surfstore.FileMetaData{Filename: "testFile3", Version: version, BlockHashList: []string{"testFile3"}})
+	}
+	behind, err := test.Clients[1].WatchChanges(ctx, &surfstore.WatchChangesInput{SinceIndex: third.Index})
+	if err != nil {
+		t.Fatalf("Could not watch the new leader: %v", err)
+	}
+	for version := int32(2); version <= 3; version++ {
+		if change := recv(behind, "testFile3"); change.FileMetaData.Version != version {
+			t.Fatalf("Expected version %d of testFile3, got %d", version, change.FileMetaData.Version)
+		}
+	}
+}
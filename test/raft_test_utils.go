@@ -4,10 +4,13 @@ import (
 	context "context"
 	"cse224/proj5/pkg/surfstore"
 	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
 	"log"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,14 +22,76 @@ type TestInfo struct {
 	Procs      []*exec.Cmd
 	Conns      []*grpc.ClientConn
 	Clients    []surfstore.RaftSurfstoreClient
+	ServerArgs []string
 }
 
+// InitTest starts servers that never elect a leader by themselves,
+// tests pick the leader with SetLeader
 func InitTest(cfgPath, blockStorePort string) TestInfo {
+	return initTest(cfgPath, blockStorePort, "-m")
+}
+
+// InitElectionTest starts servers that elect their leader on their own
+func InitElectionTest(cfgPath, blockStorePort string) TestInfo {
+	return initTest(cfgPath, blockStorePort)
+}
+
+// InitLeaseTest is InitTest with the leader serving reads under a lease
+func InitLeaseTest(cfgPath, blockStorePort string) TestInfo {
+	return initTest(cfgPath, blockStorePort, "-m", "-lease")
+}
+
+// InitPersistentTest is InitTest with the raft state written to dataDir
+func InitPersistentTest(cfgPath, blockStorePort, dataDir string) TestInfo {
+	return initTest(cfgPath, blockStorePort, "-m", "-data", dataDir)
+}
+
+// InitDiskBlockTest is InitTest with the block store keeping its blocks in
+// blockDir
+func InitDiskBlockTest(cfgPath, blockStorePort, blockDir string) TestInfo {
+	test := InitTest(cfgPath, blockStorePort)
+	RestartBlockStore(test, 0, blockStorePort, "-storage", "disk", "-data", blockDir)
+	return test
+}
+
+// InitGarbageCollectionTest is InitTest with blocks that are unused for
+// gracePeriod open to garbage collection, unless one of the historyLength
+// versions of a file the metastore keeps refers to them
+func InitGarbageCollectionTest(cfgPath, blockStorePort, gracePeriod string, historyLength int) TestInfo {
+	return initTest(cfgPath, blockStorePort, "-m", "-gc-grace", gracePeriod, "-history", strconv.Itoa(historyLength))
+}
+
+// InitReplicatedBlockTest is InitTest with a block store on each of
+// blockStorePorts, writeQuorum of which have to store every block. The first
+// block store is test.Procs[0], the others come after the raft servers.
+func InitReplicatedBlockTest(cfgPath string, blockStorePorts []string, writeQuorum int) TestInfo {
+	return InitShardedBlockTest(cfgPath, blockStorePorts, 0, writeQuorum)
+}
+
+// InitShardedBlockTest is InitReplicatedBlockTest with each block stored on
+// only replicas of the block stores. serverArgs go to the raft servers.
+func InitShardedBlockTest(cfgPath string, blockStorePorts []string, replicas, writeQuorum int, serverArgs ...string) TestInfo {
+	addrs := make([]string, 0)
+	for _, port := range blockStorePorts {
+		addrs = append(addrs, "localhost:"+port)
+	}
+	args := append([]string{"-m", "-b", strings.Join(addrs, ","),
+		"-n", strconv.Itoa(replicas), "-w", strconv.Itoa(writeQuorum)}, serverArgs...)
+	test := initTest(cfgPath, blockStorePorts[0], args...)
+	for _, port := range blockStorePorts[1:] {
+		test.Procs = append(test.Procs, InitBlockStore(port))
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	return test
+}
+
+func initTest(cfgPath, blockStorePort string, serverArgs ...string) TestInfo {
 	cfg := surfstore.LoadRaftConfigFile(cfgPath)
 
 	procs := make([]*exec.Cmd, 0)
 	procs = append(procs, InitBlockStore(blockStorePort))
-	procs = append(procs, InitRaftServers(cfgPath)...)
+	procs = append(procs, InitRaftServers(cfgPath, serverArgs...)...)
 
 	conns := make([]*grpc.ClientConn, 0)
 	clients := make([]surfstore.RaftSurfstoreClient, 0)
@@ -51,9 +116,66 @@ func InitTest(cfgPath, blockStorePort string) TestInfo {
 		Procs:      procs,
 		Conns:      conns,
 		Clients:    clients,
+		ServerArgs: serverArgs,
+	}
+}
+
+// AwaitState polls the internal state of server until done accepts it, for
+// a few seconds at most, and returns the last state it got. Followers learn
+// that an update committed shortly after the leader answered the client.
+func AwaitState(ctx context.Context, server surfstore.RaftSurfstoreClient, done func(state *surfstore.RaftInternalState) bool) *surfstore.RaftInternalState {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		state, err := server.GetInternalState(ctx, &emptypb.Empty{})
+		if err == nil && done(state) || time.Now().After(deadline) {
+			return state
+		}
+		time.Sleep(50 * time.Millisecond)
 	}
 }
 
+// KillRaftServer stops the process of server idx without any cleanup
+func KillRaftServer(test TestInfo, idx int) {
+	proc := test.Procs[idx+1]
+	_ = proc.Process.Kill()
+	_ = proc.Wait()
+}
+
+// StartRaftServer starts server idx again with the arguments of the test
+func StartRaftServer(test TestInfo, idx int) {
+	args := []string{"-f", test.CfgPath, "-i", strconv.Itoa(idx), "-b", "localhost:8080"}
+	cmd := exec.Command("_bin/SurfstoreRaftServerExec", append(args, test.ServerArgs...)...)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	if err := cmd.Start(); err != nil {
+		log.Fatal("Error starting server ", err)
+	}
+	test.Procs[idx+1] = cmd
+
+	time.Sleep(time.Second)
+}
+
+// StartJoiningRaftServer starts server idx of cfgPath outside the cluster of
+// the test, to be added with AddServer. The caller stops the process and
+// closes the connection.
+func StartJoiningRaftServer(test TestInfo, cfgPath string, idx int) (*exec.Cmd, *grpc.ClientConn) {
+	args := []string{"-f", cfgPath, "-i", strconv.Itoa(idx), "-b", "localhost:8080", "-join"}
+	cmd := exec.Command("_bin/SurfstoreRaftServerExec", append(args, test.ServerArgs...)...)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	if err := cmd.Start(); err != nil {
+		log.Fatal("Error starting server ", err)
+	}
+
+	conn, err := grpc.Dial(surfstore.LoadRaftConfigFile(cfgPath)[idx], grpc.WithInsecure())
+	if err != nil {
+		log.Fatal("Error connecting to clients ", err)
+	}
+
+	time.Sleep(time.Second)
+	return cmd, conn
+}
+
 func EndTest(test TestInfo) {
 	test.CancelFunc()
 
@@ -61,8 +183,10 @@ func EndTest(test TestInfo) {
 		conn.Close()
 	}
 
+	// wait for the processes to exit, so the next test gets their ports
 	for _, server := range test.Procs {
 		_ = server.Process.Kill()
+		_ = server.Wait()
 	}
 
 	exec.Command("pkill SurfstoreRaftServerExec*")
@@ -70,8 +194,9 @@ func EndTest(test TestInfo) {
 	time.Sleep(100 * time.Millisecond)
 }
 
-func InitBlockStore(blockStorePort string) *exec.Cmd {
-	blockCmd := exec.Command("_bin/SurfstoreServerExec", "-s", "block", "-p", blockStorePort, "-l")
+func InitBlockStore(blockStorePort string, storageArgs ...string) *exec.Cmd {
+	args := []string{"-s", "block", "-p", blockStorePort, "-l"}
+	blockCmd := exec.Command("_bin/SurfstoreServerExec", append(args, storageArgs...)...)
 	blockCmd.Stderr = os.Stderr
 	blockCmd.Stdout = os.Stdout
 	err := blockCmd.Start()
@@ -82,11 +207,21 @@ func InitBlockStore(blockStorePort string) *exec.Cmd {
 	return blockCmd
 }
 
-func InitRaftServers(cfgPath string) []*exec.Cmd {
+// RestartBlockStore replaces the block store test.Procs[idx] with a new one
+// on blockStorePort
+func RestartBlockStore(test TestInfo, idx int, blockStorePort string, storageArgs ...string) {
+	_ = test.Procs[idx].Process.Kill()
+	_ = test.Procs[idx].Wait()
+	test.Procs[idx] = InitBlockStore(blockStorePort, storageArgs...)
+	time.Sleep(500 * time.Millisecond)
+}
+
+func InitRaftServers(cfgPath string, serverArgs ...string) []*exec.Cmd {
 	cfg := surfstore.LoadRaftConfigFile(cfgPath)
 	cmdList := make([]*exec.Cmd, 0)
 	for idx, _ := range cfg {
-		cmd := exec.Command("_bin/SurfstoreRaftServerExec", "-f", cfgPath, "-i", strconv.Itoa(idx), "-b", "localhost:8080")
+		args := []string{"-f", cfgPath, "-i", strconv.Itoa(idx), "-b", "localhost:8080"}
+		cmd := exec.Command("_bin/SurfstoreRaftServerExec", append(args, serverArgs...)...)
 		cmd.Stderr = os.Stderr
 		cmd.Stdout = os.Stdout
 		cmdList = append(cmdList, cmd)
@@ -118,6 +253,9 @@ func SameOperation(op1, op2 *surfstore.UpdateOperation) bool {
 		op1.FileMetaData != nil && op2.FileMetaData == nil {
 		return false
 	}
+	if op1.FileMetaData == nil {
+		return proto.Equal(op1.Config, op2.Config) && proto.Equal(op1.BlockStores, op2.BlockStores)
+	}
 	if op1.FileMetaData.Version != op2.FileMetaData.Version {
 		return false
 	}
@@ -139,3 +277,20 @@ func SameLog(log1, log2 []*surfstore.UpdateOperation) bool {
 	}
 	return true
 }
+
+// ListBlocks returns the hashes of the blocks on the block store at addr
+func ListBlocks(addr string) []string {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		log.Fatal("Error connecting to the block store ", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	hashes, err := surfstore.NewBlockStoreClient(conn).ListBlocks(ctx, &emptypb.Empty{})
+	if err != nil {
+		log.Fatal("Error listing blocks ", err)
+	}
+	return hashes.Hashes
+}
@@ -245,14 +245,38 @@ func KillSurfServers(servers []*exec.Cmd) {
 	exec.Command("pkill SurfstoreServerExec*")
 }
 
-func SyncClient(metaAddr, baseDir string, blockSize int, cfg string) error {
-	clientCmd := exec.Command("_bin/SurfstoreClientExec", "-d", "-f", cfg, baseDir, strconv.Itoa(blockSize))
+func SyncClient(metaAddr, baseDir string, blockSize int, cfg string, clientArgs ...string) error {
+	args := append([]string{"-d", "-f", cfg}, clientArgs...)
+	clientCmd := exec.Command("_bin/SurfstoreClientExec", append(args, baseDir, strconv.Itoa(blockSize))...)
 	clientCmd.Stderr = os.Stderr
 	clientCmd.Stdout = os.Stdout
 
 	return clientCmd.Run()
 }
 
+// RunClientCommand runs one of the client's commands on the history of a
+// file, e.g. "history", filename
+func RunClientCommand(cfg string, command ...string) error {
+	clientCmd := exec.Command("_bin/SurfstoreClientExec", append([]string{"-d", "-f", cfg}, command...)...)
+	clientCmd.Stderr = os.Stderr
+	clientCmd.Stdout = os.Stdout
+
+	return clientCmd.Run()
+}
+
+// StartWatchClient starts a client that keeps baseDir in sync until it is
+// killed
+func StartWatchClient(baseDir string, blockSize int, cfg string, clientArgs ...string) *exec.Cmd {
+	args := append([]string{"-d", "-f", cfg, "-watch"}, clientArgs...)
+	clientCmd := exec.Command("_bin/SurfstoreClientExec", append(args, baseDir, strconv.Itoa(blockSize))...)
+	clientCmd.Stderr = os.Stderr
+	clientCmd.Stdout = os.Stdout
+	if err := clientCmd.Start(); err != nil {
+		log.Fatal("Error starting the watching client ", err)
+	}
+	return clientCmd
+}
+
 func assert(cond bool) {
 	if !cond {
 		debug.PrintStack()